@@ -1,16 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/dovakiin0/proxy-m3u8/config"
+	"github.com/dovakiin0/proxy-m3u8/internal/analytics"
 	"github.com/dovakiin0/proxy-m3u8/internal/handler"
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
+	"github.com/dovakiin0/proxy-m3u8/internal/metrics"
 	mdlware "github.com/dovakiin0/proxy-m3u8/internal/middleware"
+	"github.com/dovakiin0/proxy-m3u8/internal/security"
+	"github.com/dovakiin0/proxy-m3u8/internal/streaming"
+	"github.com/dovakiin0/proxy-m3u8/internal/tracing"
+	"github.com/dovakiin0/proxy-m3u8/internal/utils"
 )
 
 func init() {
@@ -19,11 +34,99 @@ func init() {
 }
 
 func main() {
+	if err := logging.Configure(config.Env.LogLevel, config.Env.LogFormat); err != nil {
+		fatal("Failed to set up logging", err)
+	}
+
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+		Exporter:    config.Env.TracingExporter,
+		Endpoint:    config.Env.TracingEndpoint,
+		SampleRatio: config.Env.TracingSampleRatio,
+		ServiceName: config.Env.TracingServiceName,
+	})
+	if err != nil {
+		fatal("Failed to set up tracing", err)
+	}
+
+	utils.ConfigureDestinationPolicy(destinationConfig())
+	handler.ConfigureURLSigning([]byte(config.Env.ProxySigningKey), config.Env.ProxySignedURLTTL)
+	err = handler.ConfigureStreamTokens([]byte(config.Env.StreamTokenKey), []byte(config.Env.ProxySigningKey),
+		config.Env.ProxySignedURLTTL, config.Env.EmitStreamTokens)
+	if err != nil {
+		fatal("Failed to configure stream tokens", err)
+	}
+	utils.ConfigureSegmentCache(config.Env.CacheMaxBytes, config.Env.CacheMaxEntryBytes, utils.EvictionPolicy(config.Env.CachePolicy))
+	var diskCacheErr error
+	if config.Env.DiskCacheDir != "" {
+		diskCacheErr = utils.EnableDiskCache(config.Env.DiskCacheDir, config.Env.DiskCacheMaxBytes,
+			config.Env.CacheMaxEntryBytes, config.Env.DiskCachePromoteHits, config.Env.DiskCacheMinTTL)
+		if diskCacheErr != nil {
+			slog.Warn("Failed to enable disk cache, using memory only", "error", diskCacheErr)
+		}
+	}
+	utils.StartCacheCleanup()
+	utils.ConfigureCircuitBreakers(utils.BreakerConfig{
+		FailureThreshold: int(config.Env.BreakerFailureThreshold),
+		SlowThreshold:    config.Env.BreakerSlowThreshold,
+		OpenDuration:     config.Env.BreakerOpenDuration,
+		HalfOpenProbes:   int(config.Env.BreakerHalfOpenProbes),
+	})
+	utils.GetCircuitBreakers().SetListener(handler.ReportBreakerState)
+	utils.ConfigureRetries(utils.RetryPolicy{
+		MaxAttempts: int(config.Env.RetryMaxAttempts),
+		BaseDelay:   config.Env.RetryBaseDelay,
+		MaxDelay:    config.Env.RetryMaxDelay,
+		Deadline:    config.Env.RetryDeadline,
+	})
+	utils.ConfigureMirrors(utils.MirrorPolicy{
+		FirstByteTimeout: config.Env.MirrorFirstByteTimeout,
+		HedgeDelay:       config.Env.MirrorHedgeDelay,
+	})
+	utils.ConfigureCoalescer(config.Env.CoalesceMaxBytes)
+	utils.ConfigurePrefetcher(int(config.Env.PrefetchSegments), int(config.Env.PrefetchConcurrency),
+		config.Env.PrefetchIdleTimeout, config.Env.CacheSegmentTTL)
+
+	analytics.Configure(analytics.Config{
+		Window:        config.Env.StatsWindow,
+		ViewerTimeout: config.Env.StatsViewerTimeout,
+		TopN:          int(config.Env.StatsTopN),
+		MaxStreams:    int(config.Env.StatsMaxStreams),
+	})
+
+	var streamingMetrics *streaming.StreamingMetrics
+	var eventSinkErr error
+	sinkConfig := eventSinkConfig()
+	if sinkConfig.Type != streaming.SinkNone {
+		var sink streaming.EventSink
+		sink, eventSinkErr = streaming.OpenSink(sinkConfig)
+		if eventSinkErr != nil {
+			slog.Error("Failed to open event sink, streaming metrics are disabled", "sink", sinkConfig.Type, "error", eventSinkErr)
+		} else {
+			streamingMetrics = streaming.NewStreamingMetrics(sink, streaming.Config{
+				BufferSize:   int(config.Env.EventsBufferSize),
+				Overflow:     config.Env.EventsOverflowPolicy,
+				BlockTimeout: config.Env.EventsBlockTimeout,
+				FlushTimeout: config.Env.EventsFlushTimeout,
+			})
+			handler.ConfigureStreamingMetrics(streamingMetrics, config.Env.SessionIdleTimeout, []byte(config.Env.EventsIPHashKey))
+			metrics.WatchEventPipeline(streamingMetrics.Stats)
+		}
+	}
+
 	e := echo.New()
 	e.HideBanner = true
+	e.IPExtractor, err = mdlware.IPExtractor(config.Env.TrustedProxies)
+	if err != nil {
+		fatal("Failed to configure trusted proxies", err)
+	}
+	if len(config.Env.TrustedProxies) == 0 && (config.Env.RateLimitIPPlaylist.PerSecond > 0 || config.Env.RateLimitIPSegment.PerSecond > 0) {
+		slog.Warn("Per-IP rate limits use the connection address; behind a load balancer or CDN set TRUSTED_PROXIES, " +
+			"or every client shares its address's limits")
+	}
 
-	e.Use(middleware.Logger())
+	e.Use(logging.Middleware())
 	e.Use(middleware.Recover())
+	e.Use(tracing.Middleware())
 	e.Pre(middleware.RemoveTrailingSlash())
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
@@ -38,10 +141,51 @@ func main() {
 	}
 	e.Use(mdlware.CacheControlWithConfig(customCacheConfig))
 
+	rateLimiter := mdlware.NewRateLimiter(mdlware.RateLimitConfig{
+		IP:       rateBudget(config.Env.RateLimitIPPlaylist, config.Env.RateLimitIPSegment),
+		Session:  rateBudget(config.Env.RateLimitSessionPlaylist, config.Env.RateLimitSessionSegment),
+		Host:     rateBudget(config.Env.RateLimitHostPlaylist, config.Env.RateLimitHostSegment),
+		Describe: handler.RateLimitTarget,
+	})
+
 	// Proxy-specific routes (handled locally)
-	e.GET("/m3u8-proxy", handler.M3U8ProxyHandler)
-	e.GET("/health", func(c echo.Context) error {
-		return c.String(200, "OK")
+	e.GET(handler.ProxyPath, handler.M3U8ProxyHandler, metrics.Middleware(), rateLimiter.Middleware())
+	e.GET(handler.StreamTokenPath, handler.StreamTokenHandler, metrics.Middleware(), rateLimiter.Middleware())
+	e.GET("/metrics", metrics.Handler())
+	e.GET("/health", handler.HealthHandler)
+	e.GET("/livez", handler.LivenessHandler)
+	e.GET("/readyz", handler.ReadinessHandler)
+
+	// Internal endpoints are only served with a debug token, to requests carrying it
+	if config.Env.DebugToken != "" {
+		debugAuth := debugTokenAuth(config.Env.DebugToken)
+		e.GET("/debug/ratelimit", rateLimiter.StatsHandler, debugAuth)
+		e.GET("/stats", analytics.Handler, debugAuth)
+	} else if analytics.Get().Enabled() {
+		slog.Info("Stream statistics are collected but /stats is disabled without DEBUG_TOKEN")
+	}
+
+	readinessChecks := []handler.ReadinessCheck{
+		{Name: "nextjs", Check: handler.CheckNextJS},
+		{Name: "cache", Check: func(context.Context) error {
+			if diskCacheErr != nil {
+				return fmt.Errorf("disk cache unavailable: %w", diskCacheErr)
+			}
+			return utils.GetSegmentCache().Health()
+		}},
+	}
+	if sinkConfig.Type != streaming.SinkNone {
+		readinessChecks = append(readinessChecks, handler.ReadinessCheck{Name: "event_sink", Check: func(context.Context) error {
+			if eventSinkErr != nil {
+				return fmt.Errorf("failed to open %s sink: %w", sinkConfig.Type, eventSinkErr)
+			}
+			return streamingMetrics.Health()
+		}})
+	}
+	handler.ConfigureReadiness(handler.ReadinessConfig{
+		Timeout:  config.Env.ReadyzTimeout,
+		Optional: config.Env.ReadyzOptionalChecks,
+		Checks:   readinessChecks,
 	})
 
 	// Reverse proxy to Next.js for all other routes
@@ -49,7 +193,68 @@ func main() {
 
 	port := config.Env.Port
 
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":%s", port)))
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- e.Start(fmt.Sprintf(":%s", port))
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err = <-serverErr:
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String(), "drain_timeout", config.Env.ShutdownDrainTimeout)
+		err = drain(e)
+	}
+
+	// Release upstream connections, then flush buffered events and spans before exiting
+	utils.CloseUpstream()
+	handler.EndSessions()
+	streamingMetrics.Close()
+	tracingCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownTracing(tracingCtx)
+	cancel()
+
+	if err != nil {
+		fatal("Server stopped", err)
+	}
+	slog.Info("Server stopped")
+}
+
+// drain reports the server not ready, stops accepting connections and waits for the
+// requests in flight, e.g. segment transfers, for up to the drain timeout
+func drain(e *echo.Echo) error {
+	handler.StartDraining()
+	// Give load balancers time to notice before the listener goes away
+	time.Sleep(config.Env.ShutdownReadyDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Env.ShutdownDrainTimeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		slog.Warn("Drain timeout reached, closing remaining connections", "error", err)
+		return e.Close()
+	}
+	return nil
+}
+
+// fatal logs an error that keeps the server from running and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// debugTokenAuth requires the debug token as a bearer token
+func debugTokenAuth(token string) echo.MiddlewareFunc {
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+	})
+}
+
+func rateBudget(playlist, segment config.Rate) mdlware.RateBudget {
+	return mdlware.RateBudget{
+		Playlist: mdlware.Rate{PerSecond: playlist.PerSecond, Burst: playlist.Burst},
+		Segment:  mdlware.Rate{PerSecond: segment.PerSecond, Burst: segment.Burst},
+	}
 }
 
 func getCorsDomain() []string {
@@ -72,3 +277,50 @@ func getCorsDomain() []string {
 
 	return allowOrigins
 }
+
+// eventSinkConfig selects the streaming metrics sink, Kafka when only the older
+// ENABLE_STREAMING_METRICS switch is set
+func eventSinkConfig() streaming.SinkConfig {
+	sinkType := config.Env.EventSink
+	if sinkType == "" {
+		sinkType = streaming.SinkNone
+		if config.Env.EnableStreamingMetrics {
+			sinkType = streaming.SinkKafka
+		}
+	}
+
+	return streaming.SinkConfig{
+		Type: sinkType,
+		Kafka: streaming.KafkaConfig{
+			Brokers:       config.Env.RedpandaBrokers,
+			Topic:         config.Env.RedpandaTopic,
+			BatchMessages: int(config.Env.RedpandaBatchMessages),
+			Linger:        config.Env.RedpandaLinger,
+			Compression:   config.Env.RedpandaCompression,
+		},
+		File: config.Env.EventSinkFile,
+		Webhook: streaming.WebhookConfig{
+			URL:           config.Env.EventSinkWebhookURL,
+			BatchMessages: int(config.Env.EventSinkWebhookBatch),
+			FlushInterval: config.Env.EventSinkWebhookInterval,
+			Timeout:       config.Env.EventSinkWebhookTimeout,
+		},
+	}
+}
+
+// destinationConfig builds the upstream destination policy, always denying the
+// Next.js backend so the proxy can't be used to reach it directly
+func destinationConfig() security.DestinationConfig {
+	denyHosts := config.Env.DestinationDenyHosts
+	if nextjsURL, err := url.Parse(config.Env.NextJSURL); err == nil && nextjsURL.Hostname() != "" {
+		denyHosts = append(denyHosts, nextjsURL.Hostname())
+	}
+
+	return security.DestinationConfig{
+		AllowedSchemes: config.Env.DestinationAllowedSchemes,
+		AllowedPorts:   config.Env.DestinationAllowedPorts,
+		AllowHosts:     config.Env.DestinationAllowHosts,
+		DenyHosts:      denyHosts,
+		AllowPrivate:   config.Env.DestinationAllowPrivate,
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/dovakiin0/proxy-m3u8/config"
+	"github.com/dovakiin0/proxy-m3u8/internal/handler"
+)
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name         string
+		drainTimeout time.Duration
+		transfer     time.Duration // How long the request in flight takes
+		wantBody     string        // Empty when the request is cut off
+	}{
+		{name: "waits for requests in flight", drainTimeout: time.Second, transfer: 50 * time.Millisecond, wantBody: "segment"},
+		{name: "closes requests past the timeout", drainTimeout: 20 * time.Millisecond, transfer: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := config.Env
+			t.Cleanup(func() { config.Env = saved })
+			config.Env.ShutdownDrainTimeout = tt.drainTimeout
+			config.Env.ShutdownReadyDelay = 0
+
+			e := echo.New()
+			e.HideBanner, e.HidePort = true, true
+			started := make(chan struct{})
+			e.GET("/segment", func(c echo.Context) error {
+				close(started)
+				select {
+				case <-time.After(tt.transfer):
+				case <-c.Request().Context().Done():
+					return nil
+				}
+				return c.String(http.StatusOK, "segment")
+			})
+			go e.Start("127.0.0.1:0")
+			deadline := time.Now().Add(2 * time.Second)
+			for e.ListenerAddr() == nil {
+				if time.Now().After(deadline) {
+					t.Fatal("server didn't start")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			body := make(chan string, 1)
+			go func() {
+				resp, err := http.Get("http://" + e.ListenerAddr().String() + "/segment")
+				if err != nil {
+					body <- ""
+					return
+				}
+				defer resp.Body.Close()
+				data, _ := io.ReadAll(resp.Body)
+				body <- string(data)
+			}()
+			<-started
+
+			start := time.Now()
+			drain(e)
+			if !handler.Draining() {
+				t.Error("server not marked draining")
+			}
+			elapsed := time.Since(start)
+			if tt.wantBody != "" && elapsed < tt.transfer {
+				t.Errorf("drain returned after %v, before the %v transfer finished", elapsed, tt.transfer)
+			}
+			if elapsed > tt.drainTimeout+time.Second {
+				t.Errorf("drain took %v, want at most the %v timeout", elapsed, tt.drainTimeout)
+			}
+			select {
+			case got := <-body:
+				if got != tt.wantBody {
+					t.Errorf("response = %q, want %q", got, tt.wantBody)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("request still open after drain")
+			}
+		})
+	}
+}
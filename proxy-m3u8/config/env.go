@@ -1,16 +1,133 @@
 package config
 
 import (
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type envConfig struct {
-	Port               string
-	CorsDomain         string
-	RedpandaBrokers    string
-	RedpandaTopic      string
+	Port                   string
+	CorsDomain             string
+	RedpandaBrokers        string
+	RedpandaTopic          string
 	EnableStreamingMetrics bool
-	NextJSURL          string
+	NextJSURL              string
+
+	// Graceful shutdown
+	ShutdownReadyDelay   time.Duration
+	ShutdownDrainTimeout time.Duration
+
+	// Readiness probe
+	ReadyzTimeout        time.Duration
+	ReadyzOptionalChecks []string
+
+	// Streaming metrics event pipeline and sinks
+	EventSink                string
+	EventsBufferSize         int64
+	EventsOverflowPolicy     string
+	EventsBlockTimeout       time.Duration
+	EventsFlushTimeout       time.Duration
+	RedpandaBatchMessages    int64
+	RedpandaLinger           time.Duration
+	RedpandaCompression      string
+	EventSinkFile            string
+	EventSinkWebhookURL      string
+	EventSinkWebhookBatch    int64
+	EventSinkWebhookInterval time.Duration
+	EventSinkWebhookTimeout  time.Duration
+	SessionIdleTimeout       time.Duration
+	EventsIPHashKey          string
+
+	// Per-stream statistics on /stats
+	StatsWindow        time.Duration
+	StatsViewerTimeout time.Duration
+	StatsTopN          int64
+	StatsMaxStreams    int64
+
+	// Segment/playlist memory cache
+	CacheMaxBytes        int64
+	CacheMaxEntryBytes   int64
+	CachePolicy          string
+	CacheSegmentTTL      time.Duration
+	CachePlaylistTTL     time.Duration
+	CacheLivePlaylistTTL time.Duration
+
+	// Optional on-disk second cache tier
+	DiskCacheDir         string
+	DiskCacheMaxBytes    int64
+	DiskCachePromoteHits int64
+	DiskCacheMinTTL      time.Duration
+
+	// Upstream request coalescing
+	CoalesceMaxBytes int64
+
+	// Segment prefetching
+	PrefetchSegments    int64
+	PrefetchConcurrency int64
+	PrefetchIdleTimeout time.Duration
+
+	// Upstream destination policy (SSRF protection)
+	DestinationAllowedSchemes []string
+	DestinationAllowedPorts   []int
+	DestinationAllowHosts     []string
+	DestinationDenyHosts      []string
+	DestinationAllowPrivate   bool
+
+	// Signed proxy URLs
+	ProxySigningKey   string
+	ProxySignedURLTTL time.Duration
+
+	// Token bucket rate limits, per playlist and per segment request
+	RateLimitIPPlaylist      Rate
+	RateLimitIPSegment       Rate
+	RateLimitSessionPlaylist Rate
+	RateLimitSessionSegment  Rate
+	RateLimitHostPlaylist    Rate
+	RateLimitHostSegment     Rate
+
+	// Proxies whose X-Forwarded-For is trusted for the client address
+	TrustedProxies []string
+	// Bearer token for internal endpoints, which are disabled without it
+	DebugToken string
+
+	// Per-upstream-host circuit breakers
+	BreakerFailureThreshold int64
+	BreakerSlowThreshold    time.Duration
+	BreakerOpenDuration     time.Duration
+	BreakerHalfOpenProbes   int64
+
+	// Upstream retries and resumption
+	RetryMaxAttempts int64
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+	RetryDeadline    time.Duration
+
+	// Mirror failover
+	MirrorFirstByteTimeout time.Duration
+	MirrorHedgeDelay       time.Duration
+
+	// OpenTelemetry tracing
+	TracingExporter    string
+	TracingEndpoint    string
+	TracingSampleRatio float64
+	TracingServiceName string
+
+	// Structured logging
+	LogLevel  string
+	LogFormat string
+
+	// Opaque stream tokens
+	StreamTokenKey   string
+	EmitStreamTokens bool
+}
+
+// Rate is a token bucket rate in requests per second with a burst size
+type Rate struct {
+	PerSecond float64
+	Burst     int
 }
 
 var Env envConfig
@@ -23,13 +140,175 @@ func getEnv(varName, defaultValue string) string {
 	return value
 }
 
+func getEnvInt64(varName string, defaultValue int64) int64 {
+	value, err := strconv.ParseInt(getEnv(varName, ""), 10, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvDuration(varName string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(varName, ""))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvFloat(varName string, defaultValue float64) float64 {
+	value, err := strconv.ParseFloat(getEnv(varName, ""), 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvList splits a comma separated variable, dropping empty items
+func getEnvList(varName string, defaultValue []string) []string {
+	value, exists := os.LookupEnv(varName)
+	if !exists {
+		return defaultValue
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvIntList splits a comma separated variable of integers, dropping invalid items
+func getEnvIntList(varName string, defaultValue []int) []int {
+	if _, exists := os.LookupEnv(varName); !exists {
+		return defaultValue
+	}
+	var values []int
+	for _, item := range getEnvList(varName, nil) {
+		if value, err := strconv.Atoi(item); err == nil {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvRate parses "<requests per second>[:<burst>]"; a zero rate disables the limit
+func getEnvRate(varName string, defaultValue Rate) Rate {
+	value, exists := os.LookupEnv(varName)
+	if !exists {
+		return defaultValue
+	}
+	perSecond, burst, _ := strings.Cut(strings.TrimSpace(value), ":")
+	rate := Rate{}
+	var err error
+	if rate.PerSecond, err = strconv.ParseFloat(perSecond, 64); err != nil {
+		return defaultValue
+	}
+	rate.Burst = int(math.Ceil(rate.PerSecond))
+	if burst != "" {
+		if rate.Burst, err = strconv.Atoi(burst); err != nil {
+			return defaultValue
+		}
+	}
+	return rate
+}
+
 func InitConfig() {
 	Env = envConfig{
-		Port:                  getEnv("PORT", "3000"),
-		CorsDomain:            getEnv("CORS_DOMAIN", "*"),
-		RedpandaBrokers:       getEnv("REDPANDA_BROKERS", "localhost:9092"),
-		RedpandaTopic:         getEnv("REDPANDA_TOPIC", "proxy-metrics"),
+		Port:                   getEnv("PORT", "3000"),
+		CorsDomain:             getEnv("CORS_DOMAIN", "*"),
+		RedpandaBrokers:        getEnv("REDPANDA_BROKERS", "localhost:9092"),
+		RedpandaTopic:          getEnv("REDPANDA_TOPIC", "proxy-metrics"),
 		EnableStreamingMetrics: getEnv("ENABLE_STREAMING_METRICS", "false") == "true",
-		NextJSURL:             getEnv("NEXTJS_URL", "http://localhost:3001"),
+		NextJSURL:              getEnv("NEXTJS_URL", "http://localhost:3001"),
+
+		ShutdownReadyDelay:   getEnvDuration("SHUTDOWN_READY_DELAY", 0),
+		ShutdownDrainTimeout: getEnvDuration("SHUTDOWN_DRAIN_TIMEOUT", 30*time.Second),
+
+		ReadyzTimeout:        getEnvDuration("READYZ_TIMEOUT", 2*time.Second),
+		ReadyzOptionalChecks: getEnvList("READYZ_OPTIONAL_CHECKS", []string{"event_sink", "cache"}),
+
+		EventSink:                getEnv("EVENT_SINK", ""),
+		EventsBufferSize:         getEnvInt64("EVENTS_BUFFER_SIZE", 10000),
+		EventsOverflowPolicy:     getEnv("EVENTS_OVERFLOW_POLICY", "drop"),
+		EventsBlockTimeout:       getEnvDuration("EVENTS_BLOCK_TIMEOUT", 50*time.Millisecond),
+		EventsFlushTimeout:       getEnvDuration("EVENTS_FLUSH_TIMEOUT", 15*time.Second),
+		RedpandaBatchMessages:    getEnvInt64("REDPANDA_BATCH_MESSAGES", 10000),
+		RedpandaLinger:           getEnvDuration("REDPANDA_LINGER", 50*time.Millisecond),
+		RedpandaCompression:      getEnv("REDPANDA_COMPRESSION", "lz4"),
+		EventSinkFile:            getEnv("EVENT_SINK_FILE", "events.ndjson"),
+		EventSinkWebhookURL:      getEnv("EVENT_SINK_WEBHOOK_URL", ""),
+		EventSinkWebhookBatch:    getEnvInt64("EVENT_SINK_WEBHOOK_BATCH", 100),
+		EventSinkWebhookInterval: getEnvDuration("EVENT_SINK_WEBHOOK_INTERVAL", time.Second),
+		EventSinkWebhookTimeout:  getEnvDuration("EVENT_SINK_WEBHOOK_TIMEOUT", 5*time.Second),
+		SessionIdleTimeout:       getEnvDuration("SESSION_IDLE_TIMEOUT", 60*time.Second),
+		EventsIPHashKey:          getEnv("EVENTS_IP_HASH_KEY", ""),
+
+		StatsWindow:        getEnvDuration("STATS_WINDOW", 5*time.Minute),
+		StatsViewerTimeout: getEnvDuration("STATS_VIEWER_TIMEOUT", 30*time.Second),
+		StatsTopN:          getEnvInt64("STATS_TOP_N", 10),
+		StatsMaxStreams:    getEnvInt64("STATS_MAX_STREAMS", 10000),
+
+		CacheMaxBytes:        getEnvInt64("CACHE_MAX_BYTES", 256<<20),
+		CacheMaxEntryBytes:   getEnvInt64("CACHE_MAX_ENTRY_BYTES", 16<<20),
+		CachePolicy:          getEnv("CACHE_POLICY", "lru"),
+		CacheSegmentTTL:      getEnvDuration("CACHE_SEGMENT_TTL", 1*time.Hour),
+		CachePlaylistTTL:     getEnvDuration("CACHE_PLAYLIST_TTL", 5*time.Minute),
+		CacheLivePlaylistTTL: getEnvDuration("CACHE_LIVE_PLAYLIST_TTL", 2*time.Second),
+
+		DiskCacheDir:         getEnv("DISK_CACHE_DIR", ""),
+		DiskCacheMaxBytes:    getEnvInt64("DISK_CACHE_MAX_BYTES", 2<<30),
+		DiskCachePromoteHits: getEnvInt64("DISK_CACHE_PROMOTE_HITS", 2),
+		DiskCacheMinTTL:      getEnvDuration("DISK_CACHE_MIN_TTL", 1*time.Minute),
+
+		CoalesceMaxBytes: getEnvInt64("COALESCE_MAX_BYTES", 64<<20),
+
+		PrefetchSegments:    getEnvInt64("PREFETCH_SEGMENTS", 2),
+		PrefetchConcurrency: getEnvInt64("PREFETCH_CONCURRENCY", 2),
+		PrefetchIdleTimeout: getEnvDuration("PREFETCH_IDLE_TIMEOUT", 30*time.Second),
+
+		DestinationAllowedSchemes: getEnvList("DESTINATION_ALLOWED_SCHEMES", []string{"http", "https"}),
+		DestinationAllowedPorts:   getEnvIntList("DESTINATION_ALLOWED_PORTS", []int{80, 443}),
+		DestinationAllowHosts:     getEnvList("DESTINATION_ALLOW_HOSTS", nil),
+		DestinationDenyHosts:      getEnvList("DESTINATION_DENY_HOSTS", nil),
+		DestinationAllowPrivate:   getEnv("DESTINATION_ALLOW_PRIVATE", "false") == "true",
+
+		ProxySigningKey:   getEnv("PROXY_SIGNING_KEY", ""),
+		ProxySignedURLTTL: getEnvDuration("PROXY_SIGNED_URL_TTL", 6*time.Hour),
+
+		RateLimitIPPlaylist:      getEnvRate("RATE_LIMIT_IP_PLAYLIST", Rate{PerSecond: 10, Burst: 50}),
+		RateLimitIPSegment:       getEnvRate("RATE_LIMIT_IP_SEGMENT", Rate{PerSecond: 50, Burst: 200}),
+		RateLimitSessionPlaylist: getEnvRate("RATE_LIMIT_SESSION_PLAYLIST", Rate{PerSecond: 5, Burst: 20}),
+		RateLimitSessionSegment:  getEnvRate("RATE_LIMIT_SESSION_SEGMENT", Rate{PerSecond: 20, Burst: 60}),
+		RateLimitHostPlaylist:    getEnvRate("RATE_LIMIT_HOST_PLAYLIST", Rate{}),
+		RateLimitHostSegment:     getEnvRate("RATE_LIMIT_HOST_SEGMENT", Rate{}),
+
+		TrustedProxies: getEnvList("TRUSTED_PROXIES", nil),
+		DebugToken:     getEnv("DEBUG_TOKEN", ""),
+
+		BreakerFailureThreshold: getEnvInt64("BREAKER_FAILURE_THRESHOLD", 5),
+		BreakerSlowThreshold:    getEnvDuration("BREAKER_SLOW_THRESHOLD", 8*time.Second),
+		BreakerOpenDuration:     getEnvDuration("BREAKER_OPEN_DURATION", 30*time.Second),
+		BreakerHalfOpenProbes:   getEnvInt64("BREAKER_HALF_OPEN_PROBES", 1),
+
+		RetryMaxAttempts: getEnvInt64("RETRY_MAX_ATTEMPTS", 3),
+		RetryBaseDelay:   getEnvDuration("RETRY_BASE_DELAY", 200*time.Millisecond),
+		RetryMaxDelay:    getEnvDuration("RETRY_MAX_DELAY", 2*time.Second),
+		RetryDeadline:    getEnvDuration("RETRY_DEADLINE", 20*time.Second),
+
+		MirrorFirstByteTimeout: getEnvDuration("MIRROR_FIRST_BYTE_TIMEOUT", 4*time.Second),
+		MirrorHedgeDelay:       getEnvDuration("MIRROR_HEDGE_DELAY", 0),
+
+		TracingExporter:    getEnv("TRACING_EXPORTER", "none"),
+		TracingEndpoint:    getEnv("TRACING_OTLP_ENDPOINT", ""),
+		TracingSampleRatio: getEnvFloat("TRACING_SAMPLE_RATIO", 0.1),
+		TracingServiceName: getEnv("TRACING_SERVICE_NAME", "proxy-m3u8"),
+
+		LogLevel:  getEnv("LOG_LEVEL", "info"),
+		LogFormat: getEnv("LOG_FORMAT", "json"),
+
+		StreamTokenKey:   getEnv("STREAM_TOKEN_KEY", ""),
+		EmitStreamTokens: getEnv("STREAM_TOKENS", "false") == "true",
 	}
 }
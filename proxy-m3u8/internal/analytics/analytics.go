@@ -0,0 +1,408 @@
+package analytics
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
+	"github.com/dovakiin0/proxy-m3u8/internal/streaming"
+)
+
+// segmentKind is the request kind viewers are counted from
+const segmentKind = "segment"
+
+// maxTopN bounds the top query parameter of the stats endpoint
+const maxTopN = 1000
+
+// Config configures the aggregator
+type Config struct {
+	Window        time.Duration // Requests, errors and bytes are summed over this window, 0 disables the aggregator
+	ViewerTimeout time.Duration // A viewer counts as watching until this long after their last segment
+	TopN          int           // Streams and upstream hosts listed by default
+	MaxStreams    int           // Streams and hosts tracked at once; further ones aren't aggregated
+}
+
+// Aggregator keeps live per-stream and per-upstream-host statistics from proxy request events.
+// Streams are identified by their master playlist, or media playlist when served without one.
+type Aggregator struct {
+	cfg Config
+
+	mu      sync.Mutex
+	streams map[string]*streamStats
+	hosts   map[string]*slidingWindow
+
+	stop chan struct{}
+}
+
+type streamStats struct {
+	window   *slidingWindow
+	viewers  map[string]*viewer
+	variants map[int64]*variantStats // By bandwidth
+}
+
+type viewer struct {
+	lastSeen  time.Time
+	bandwidth int64 // Variant of the last segment, 0 if unknown
+}
+
+type variantStats struct {
+	resolution string
+	window     *slidingWindow
+}
+
+var aggregator = NewAggregator(Config{})
+
+// NewAggregator creates an aggregator, disabled if cfg.Window isn't positive
+func NewAggregator(cfg Config) *Aggregator {
+	a := &Aggregator{
+		cfg:     cfg,
+		streams: make(map[string]*streamStats),
+		hosts:   make(map[string]*slidingWindow),
+		stop:    make(chan struct{}),
+	}
+	if a.Enabled() {
+		go a.sweepLoop()
+	}
+	return a
+}
+
+// Configure replaces the singleton aggregator
+func Configure(cfg Config) {
+	aggregator.Stop()
+	aggregator = NewAggregator(cfg)
+}
+
+// Get returns the singleton aggregator
+func Get() *Aggregator {
+	return aggregator
+}
+
+// Enabled reports whether the aggregator keeps statistics
+func (a *Aggregator) Enabled() bool {
+	return a.cfg.Window > 0
+}
+
+// Stop ends the background sweep of idle streams
+func (a *Aggregator) Stop() {
+	if a.Enabled() {
+		close(a.stop)
+	}
+}
+
+// Observe accounts a request event to its stream and upstream host. viewerKey
+// tells viewers apart, e.g. by session.
+func (a *Aggregator) Observe(viewerKey string, event *streaming.ProxyRequestEvent) {
+	if !a.Enabled() {
+		return
+	}
+
+	now := time.Now()
+	c := counters{requests: 1, bytes: event.ContentSize, ttfbMs: event.TTFB}
+	// Success only says the transfer completed, upstream error statuses are relayed successfully
+	if !event.Success || event.StatusCode >= 400 {
+		c.errors = 1
+	}
+	if event.CacheStatus == "hit" {
+		c.cacheHits = 1
+	}
+	if event.Kind == segmentKind {
+		c.segments = 1
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if host := event.UpstreamHost; host != "" {
+		window, ok := a.hosts[host]
+		if !ok && len(a.hosts) < a.cfg.MaxStreams {
+			window = newSlidingWindow(a.cfg.Window)
+			a.hosts[host] = window
+		}
+		if window != nil {
+			window.add(now, c)
+		}
+	}
+
+	key := streamKey(event)
+	if key == "" {
+		return
+	}
+	stream, ok := a.streams[key]
+	if !ok {
+		if len(a.streams) >= a.cfg.MaxStreams {
+			return
+		}
+		stream = &streamStats{
+			window:   newSlidingWindow(a.cfg.Window),
+			viewers:  make(map[string]*viewer),
+			variants: make(map[int64]*variantStats),
+		}
+		a.streams[key] = stream
+	}
+	stream.window.add(now, c)
+
+	if bandwidth := event.VariantBandwidth; bandwidth > 0 {
+		variant, ok := stream.variants[bandwidth]
+		if !ok {
+			variant = &variantStats{window: newSlidingWindow(a.cfg.Window)}
+			stream.variants[bandwidth] = variant
+		}
+		if event.VariantResolution != "" {
+			variant.resolution = event.VariantResolution
+		}
+		variant.window.add(now, c)
+	}
+
+	// Players fetch playlists before and after they watch, only segments mean someone is watching
+	if event.Kind == segmentKind && viewerKey != "" {
+		stream.viewers[viewerKey] = &viewer{lastSeen: now, bandwidth: event.VariantBandwidth}
+	}
+}
+
+// streamKey picks the playlist a request is aggregated under, empty if unknown
+func streamKey(event *streaming.ProxyRequestEvent) string {
+	switch {
+	case event.MasterURL != "":
+		return event.MasterURL
+	case event.PlaylistURL != "":
+		return event.PlaylistURL
+	case event.Kind == "playlist":
+		return event.TargetURL
+	}
+	return ""
+}
+
+// Stats is the snapshot served on the stats endpoint
+type Stats struct {
+	GeneratedAt      time.Time     `json:"generated_at"`
+	WindowSeconds    float64       `json:"window_seconds"`
+	Viewers          int           `json:"viewers"` // Watching any stream right now
+	Streams          int           `json:"streams"` // With requests in the window or viewers
+	Requests         int64         `json:"requests"`
+	Errors           int64         `json:"errors"`
+	ErrorRate        float64       `json:"error_rate"`
+	TopStreams       []StreamStats `json:"top_streams"`        // By viewers, then requests
+	TopUpstreamHosts []HostStats   `json:"top_upstream_hosts"` // By requests
+}
+
+// StreamStats describes one stream over the window
+type StreamStats struct {
+	ID            string         `json:"id"`  // Derived from the playlist URL, stable across restarts
+	URL           string         `json:"url"` // Master playlist, or media playlist served without one, with secrets redacted
+	Viewers       int            `json:"viewers"`
+	Requests      int64          `json:"requests"`
+	Segments      int64          `json:"segments"`
+	Errors        int64          `json:"errors"`
+	ErrorRate     float64        `json:"error_rate"`
+	Bytes         int64          `json:"bytes"`
+	ThroughputBps float64        `json:"throughput_bps"` // Bits served per second, averaged over the window
+	Variants      []VariantStats `json:"variants"`       // By bandwidth, highest first
+}
+
+// VariantStats describes the viewers and segments of one variant of a stream
+type VariantStats struct {
+	Bandwidth     int64   `json:"bandwidth"`
+	Resolution    string  `json:"resolution,omitempty"`
+	Viewers       int     `json:"viewers"`        // Whose last segment was of this variant
+	Segments      int64   `json:"segments"`       // Served in the window
+	SegmentsShare float64 `json:"segments_share"` // Of the stream's segments in the window
+}
+
+// HostStats describes the requests to one upstream host over the window
+type HostStats struct {
+	Host          string  `json:"host"`
+	Requests      int64   `json:"requests"`
+	Errors        int64   `json:"errors"`
+	ErrorRate     float64 `json:"error_rate"`
+	Bytes         int64   `json:"bytes"`
+	CacheHitRatio float64 `json:"cache_hit_ratio"`
+	AvgTTFBMs     float64 `json:"avg_ttfb_ms"`
+}
+
+// Stats returns the top streams and upstream hosts. A non-empty streamFilter, either a
+// stream ID or a playlist URL, limits the streams to that one.
+func (a *Aggregator) Stats(top int, streamFilter string) Stats {
+	now := time.Now()
+	stats := Stats{
+		GeneratedAt:      now,
+		WindowSeconds:    a.cfg.Window.Seconds(),
+		TopStreams:       []StreamStats{},
+		TopUpstreamHosts: []HostStats{},
+	}
+	if !a.Enabled() {
+		return stats
+	}
+
+	a.mu.Lock()
+	streams := make([]StreamStats, 0, len(a.streams))
+	for key, stream := range a.streams {
+		s := a.streamSnapshot(key, stream, now)
+		if s.Viewers == 0 && s.Requests == 0 {
+			continue
+		}
+		stats.Streams++
+		stats.Viewers += s.Viewers
+		stats.Requests += s.Requests
+		stats.Errors += s.Errors
+		if streamFilter == "" || streamFilter == s.ID || streamFilter == key || streamFilter == s.URL {
+			streams = append(streams, s)
+		}
+	}
+	hosts := make([]HostStats, 0, len(a.hosts))
+	for host, window := range a.hosts {
+		c := window.sum(now)
+		if c.requests == 0 {
+			continue
+		}
+		hosts = append(hosts, HostStats{
+			Host:          host,
+			Requests:      c.requests,
+			Errors:        c.errors,
+			ErrorRate:     ratio(c.errors, c.requests),
+			Bytes:         c.bytes,
+			CacheHitRatio: ratio(c.cacheHits, c.requests),
+			AvgTTFBMs:     ratio(c.ttfbMs, c.requests-c.cacheHits),
+		})
+	}
+	a.mu.Unlock()
+
+	stats.ErrorRate = ratio(stats.Errors, stats.Requests)
+
+	slices.SortFunc(streams, func(x, y StreamStats) int {
+		return cmp.Or(cmp.Compare(y.Viewers, x.Viewers), cmp.Compare(y.Requests, x.Requests), cmp.Compare(x.ID, y.ID))
+	})
+	slices.SortFunc(hosts, func(x, y HostStats) int {
+		return cmp.Or(cmp.Compare(y.Requests, x.Requests), cmp.Compare(x.Host, y.Host))
+	})
+	stats.TopStreams = streams[:min(top, len(streams))]
+	stats.TopUpstreamHosts = hosts[:min(top, len(hosts))]
+	return stats
+}
+
+// streamIDOf gives a stream a short ID to pick it with
+func streamIDOf(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// streamSnapshot sums a stream's window and counts its current viewers, a.mu held
+func (a *Aggregator) streamSnapshot(key string, stream *streamStats, now time.Time) StreamStats {
+	c := stream.window.sum(now)
+	s := StreamStats{
+		ID:            streamIDOf(key),
+		URL:           logging.RedactURL(key),
+		Requests:      c.requests,
+		Segments:      c.segments,
+		Errors:        c.errors,
+		ErrorRate:     ratio(c.errors, c.requests),
+		Bytes:         c.bytes,
+		ThroughputBps: float64(c.bytes*8) / a.cfg.Window.Seconds(),
+		Variants:      []VariantStats{},
+	}
+
+	viewersByBandwidth := make(map[int64]int)
+	for _, v := range stream.viewers {
+		if now.Sub(v.lastSeen) <= a.cfg.ViewerTimeout {
+			s.Viewers++
+			viewersByBandwidth[v.bandwidth]++
+		}
+	}
+
+	for bandwidth, variant := range stream.variants {
+		segments := variant.window.sum(now).segments
+		viewers := viewersByBandwidth[bandwidth]
+		if segments == 0 && viewers == 0 {
+			continue
+		}
+		s.Variants = append(s.Variants, VariantStats{
+			Bandwidth:     bandwidth,
+			Resolution:    variant.resolution,
+			Viewers:       viewers,
+			Segments:      segments,
+			SegmentsShare: ratio(segments, c.segments),
+		})
+	}
+	slices.SortFunc(s.Variants, func(x, y VariantStats) int {
+		return cmp.Compare(y.Bandwidth, x.Bandwidth)
+	})
+	return s
+}
+
+func ratio(n, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// Handler serves the stats as JSON. The top query parameter sets how many streams
+// and hosts are listed, stream limits the streams to one stream ID or playlist URL.
+func (a *Aggregator) Handler(c echo.Context) error {
+	if !a.Enabled() {
+		return c.String(http.StatusNotFound, "Stream statistics are disabled")
+	}
+
+	top := a.cfg.TopN
+	if raw := c.QueryParam("top"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return c.String(http.StatusBadRequest, "Invalid 'top' query parameter")
+		}
+		top = min(n, maxTopN)
+	}
+	return c.JSON(http.StatusOK, a.Stats(top, c.QueryParam("stream")))
+}
+
+// Handler serves the singleton aggregator's stats
+func Handler(c echo.Context) error {
+	return aggregator.Handler(c)
+}
+
+// sweepLoop forgets viewers that stopped watching and streams that went idle
+func (a *Aggregator) sweepLoop() {
+	ticker := time.NewTicker(max(a.cfg.ViewerTimeout/2, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.sweep(time.Now())
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+func (a *Aggregator) sweep(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, stream := range a.streams {
+		for id, v := range stream.viewers {
+			if now.Sub(v.lastSeen) > a.cfg.ViewerTimeout {
+				delete(stream.viewers, id)
+			}
+		}
+		for bandwidth, variant := range stream.variants {
+			if variant.window.idle(now) {
+				delete(stream.variants, bandwidth)
+			}
+		}
+		if len(stream.viewers) == 0 && stream.window.idle(now) {
+			delete(a.streams, key)
+		}
+	}
+	for host, window := range a.hosts {
+		if window.idle(now) {
+			delete(a.hosts, host)
+		}
+	}
+}
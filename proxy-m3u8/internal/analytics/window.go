@@ -0,0 +1,74 @@
+package analytics
+
+import "time"
+
+// windowBuckets is how many buckets a sliding window is split into; counts
+// age out one bucket at a time
+const windowBuckets = 30
+
+// counters are the totals kept per bucket
+type counters struct {
+	requests  int64
+	errors    int64
+	segments  int64
+	bytes     int64
+	cacheHits int64
+	ttfbMs    int64 // Summed, divided by upstream fetches for the average
+}
+
+func (c *counters) add(o counters) {
+	c.requests += o.requests
+	c.errors += o.errors
+	c.segments += o.segments
+	c.bytes += o.bytes
+	c.cacheHits += o.cacheHits
+	c.ttfbMs += o.ttfbMs
+}
+
+type bucket struct {
+	index int64 // Bucket number since the epoch, identifies stale slots
+	counters
+}
+
+// slidingWindow sums counters over the last window, in fixed width buckets.
+// It isn't safe for concurrent use.
+type slidingWindow struct {
+	width   time.Duration
+	buckets [windowBuckets]bucket
+}
+
+func newSlidingWindow(window time.Duration) *slidingWindow {
+	return &slidingWindow{width: max(window/windowBuckets, time.Second)}
+}
+
+func (w *slidingWindow) add(now time.Time, c counters) {
+	index := now.UnixNano() / int64(w.width)
+	b := &w.buckets[index%windowBuckets]
+	if b.index != index {
+		*b = bucket{index: index}
+	}
+	b.add(c)
+}
+
+// sum totals the buckets still inside the window at now
+func (w *slidingWindow) sum(now time.Time) counters {
+	index := now.UnixNano() / int64(w.width)
+	var total counters
+	for i := range w.buckets {
+		if b := &w.buckets[i]; index-b.index < windowBuckets {
+			total.add(b.counters)
+		}
+	}
+	return total
+}
+
+// idle reports whether nothing was added within the window
+func (w *slidingWindow) idle(now time.Time) bool {
+	index := now.UnixNano() / int64(w.width)
+	for i := range w.buckets {
+		if index-w.buckets[i].index < windowBuckets {
+			return false
+		}
+	}
+	return true
+}
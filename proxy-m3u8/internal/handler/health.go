@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
+)
+
+// draining is set when shutdown begins, so load balancers stop sending new requests
+var draining atomic.Bool
+
+// startedAt is reported as uptime by the liveness probe
+var startedAt = time.Now()
+
+// readinessCacheTTL bounds how often probes reach the dependencies, however often they are polled
+const readinessCacheTTL = time.Second
+
+// StartDraining marks the server as shutting down
+func StartDraining() {
+	draining.Store(true)
+}
+
+// Draining reports whether the server is shutting down
+func Draining() bool {
+	return draining.Load()
+}
+
+// HealthHandler reports the server ready until it starts draining
+func HealthHandler(c echo.Context) error {
+	if Draining() {
+		return c.String(http.StatusServiceUnavailable, "Draining")
+	}
+	return c.String(http.StatusOK, "OK")
+}
+
+// ReadinessCheck is a dependency /readyz checks
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// ReadinessConfig configures /readyz
+type ReadinessConfig struct {
+	Timeout  time.Duration // For all checks together
+	Optional []string      // Checks that are reported but don't make the server unready
+	Checks   []ReadinessCheck
+}
+
+// CheckResult is the outcome of one check in the detailed probe response
+type CheckResult struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"` // ok or failing
+	Optional   bool   `json:"optional,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// ProbeResponse is the detailed (?verbose) response of /livez and /readyz
+type ProbeResponse struct {
+	Status        string        `json:"status"` // alive, ready or not_ready
+	Draining      bool          `json:"draining"`
+	UptimeSeconds float64       `json:"uptime_seconds"`
+	Checks        []CheckResult `json:"checks,omitempty"`
+}
+
+var (
+	readiness = ReadinessConfig{Timeout: 2 * time.Second}
+
+	// readinessResults are the latest dependency results, reused for readinessCacheTTL
+	readinessMu      sync.Mutex
+	readinessResults []CheckResult
+	readinessAt      time.Time
+)
+
+// ConfigureReadiness sets the dependencies /readyz checks besides the drain flag
+func ConfigureReadiness(cfg ReadinessConfig) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	readiness = cfg
+	readinessResults = nil
+}
+
+// LivenessHandler reports the process able to serve requests. It doesn't look at
+// dependencies or the drain flag, an orchestrator restarting the server wouldn't fix those.
+func LivenessHandler(c echo.Context) error {
+	if !verbose(c) {
+		return c.String(http.StatusOK, "OK")
+	}
+	return c.JSON(http.StatusOK, ProbeResponse{
+		Status:        "alive",
+		Draining:      Draining(),
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+	})
+}
+
+// ReadinessHandler reports whether the server should receive traffic: it isn't draining
+// and every required dependency check passes. ?verbose returns every check as JSON.
+func ReadinessHandler(c echo.Context) error {
+	drainCheck := CheckResult{Name: "draining", Status: "ok"}
+	if Draining() {
+		drainCheck.Status = "failing"
+		drainCheck.Error = "server is shutting down"
+	}
+	results := append([]CheckResult{drainCheck}, checkDependencies(c.Request().Context())...)
+
+	ready := true
+	for _, result := range results {
+		if result.Status != "ok" && !result.Optional {
+			ready = false
+		}
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	if !verbose(c) {
+		if !ready {
+			return c.String(code, "Not ready")
+		}
+		return c.String(code, "OK")
+	}
+	return c.JSON(code, ProbeResponse{
+		Status:        status,
+		Draining:      Draining(),
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+		Checks:        results,
+	})
+}
+
+// checkDependencies runs the configured checks in parallel, reusing results younger than readinessCacheTTL
+func checkDependencies(ctx context.Context) []CheckResult {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	if readinessResults != nil && time.Since(readinessAt) < readinessCacheTTL {
+		return slices.Clone(readinessResults)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readiness.Timeout)
+	defer cancel()
+
+	results := make([]CheckResult, len(readiness.Checks))
+	var wg sync.WaitGroup
+	for i, check := range readiness.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := runCheck(ctx, check.Check)
+
+			result := CheckResult{
+				Name:       check.Name,
+				Status:     "ok",
+				Optional:   slices.Contains(readiness.Optional, check.Name),
+				DurationMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				result.Status = "failing"
+				// Probes may be public, dependency URLs can carry credentials
+				result.Error = logging.RedactError(err)
+			}
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+
+	// A probe whose client went away doesn't say anything about the dependencies
+	if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		readinessResults, readinessAt = results, time.Now()
+	}
+	return slices.Clone(results)
+}
+
+// runCheck returns when the check does or the context is done, whichever comes first
+func runCheck(ctx context.Context, check func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func verbose(c echo.Context) bool {
+	return c.QueryParams().Has("verbose")
+}
@@ -1,10 +1,14 @@
 package handler
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 
 	"github.com/dovakiin0/proxy-m3u8/config"
+	"github.com/dovakiin0/proxy-m3u8/internal/tracing"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
@@ -19,10 +23,13 @@ func NextJSProxyHandler() echo.MiddlewareFunc {
 				URL: nextjsURL,
 			},
 		}),
+		// Continue the proxy's trace in Next.js
+		Transport: tracing.Transport(http.DefaultTransport, true),
 		Skipper: func(c echo.Context) bool {
 			// Skip proxying for these routes (handle them locally)
 			path := c.Path()
-			return path == "/m3u8-proxy" || path == "/health"
+			return path == ProxyPath || path == StreamTokenPath || path == "/health" || path == "/livez" || path == "/readyz" ||
+				path == "/debug/ratelimit" || path == "/metrics" || path == "/stats"
 		},
 		ModifyResponse: func(res *http.Response) error {
 			// Preserve Next.js response headers
@@ -32,3 +39,29 @@ func NextJSProxyHandler() echo.MiddlewareFunc {
 
 	return middleware.ProxyWithConfig(proxyConfig)
 }
+
+// nextJSProbeClient checks the Next.js backend, without tracing every probe
+var nextJSProbeClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// CheckNextJS reports an error if the Next.js backend is unreachable or answers with a server error
+func CheckNextJS(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, config.Env.NextJSURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := nextJSProbeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Next.js responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
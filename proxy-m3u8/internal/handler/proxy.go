@@ -1,41 +1,125 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dovakiin0/proxy-m3u8/config"
+	"github.com/dovakiin0/proxy-m3u8/internal/analytics"
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
+	"github.com/dovakiin0/proxy-m3u8/internal/metrics"
+	mdlware "github.com/dovakiin0/proxy-m3u8/internal/middleware"
+	"github.com/dovakiin0/proxy-m3u8/internal/security"
 	"github.com/dovakiin0/proxy-m3u8/internal/streaming"
+	"github.com/dovakiin0/proxy-m3u8/internal/tracing"
 	"github.com/dovakiin0/proxy-m3u8/internal/video"
 	"github.com/dovakiin0/proxy-m3u8/internal/utils"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ProxyPath is the route serving /m3u8-proxy?url=... links
+const ProxyPath = "/m3u8-proxy"
+
 // Global streaming metrics client
 var streamingMetrics *streaming.StreamingMetrics
 
-func init() {
-	if config.Env.EnableStreamingMetrics {
-		var err error
-		streamingMetrics, err = streaming.NewStreamingMetrics(
-			config.Env.RedpandaBrokers,
-			config.Env.RedpandaTopic,
-		)
-		if err != nil {
-			log.Printf("Failed to initialize streaming metrics: %v", err)
-			streamingMetrics = nil
+var (
+	// sessionTracker derives viewing sessions from segment request events
+	sessionTracker *streaming.SessionTracker
+	// clientIPKey keys the hash that replaces client addresses in events
+	clientIPKey = randomIPHashKey()
+)
+
+// urlSigner verifies incoming proxy URLs and signs rewritten ones; nil disables signing
+var urlSigner *security.Signer
+
+// ConfigureURLSigning requires every proxy URL to carry a valid signature made with key
+func ConfigureURLSigning(key []byte, ttl time.Duration) {
+	if len(key) == 0 {
+		urlSigner = nil
+		return
+	}
+	urlSigner = security.NewSigner(key, ttl)
+}
+
+// ConfigureStreamingMetrics sets the client proxy and circuit breaker events are sent to, nil disables them.
+// Viewing sessions end after sessionIdleTimeout without segment requests; client addresses are hashed
+// with ipHashKey, or a random key if it is empty.
+func ConfigureStreamingMetrics(sm *streaming.StreamingMetrics, sessionIdleTimeout time.Duration, ipHashKey []byte) {
+	EndSessions()
+	streamingMetrics = sm
+	if sm == nil {
+		return
+	}
+
+	if len(ipHashKey) > 0 {
+		clientIPKey = ipHashKey
+	}
+	sessionTracker = streaming.NewSessionTracker(sessionIdleTimeout, func(event *streaming.SessionEvent) {
+		if err := sm.LogSession(event); err != nil {
+			slog.Warn("Failed to log session event", "error", err)
 		}
+	})
+}
+
+// EndSessions emits the end of every open viewing session, before the event sink is closed
+func EndSessions() {
+	if sessionTracker != nil {
+		sessionTracker.Close()
+		sessionTracker = nil
 	}
 }
 
+func randomIPHashKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// hashClientIP pseudonymizes a client address for events
+func hashClientIP(ip string) string {
+	mac := hmac.New(sha256.New, clientIPKey)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// streamRequest is the upstream resource a proxy request resolves to, taken either
+// from the url/referer query parameters or from a stream token
+type streamRequest struct {
+	targetURL     string
+	referer       string // As given by the client, carried over to rewritten child links
+	refererHeader string // Referer sent upstream
+	profile       string   // Upstream header profile
+	session       string   // session query parameter or token session, carried over to rewritten child links
+	mirrors       []string // Origins serving the same content as targetURL's origin
+	viaToken      bool   // Request came in through /s/{token}
+	startTime     time.Time
+
+	// Learned while serving, reported with the request event
+	kind         string
+	upstreamHost string
+	cacheHit     bool
+	ttfb         time.Duration
+}
+
 func M3U8ProxyHandler(c echo.Context) error {
 	startTime := time.Now()
 
@@ -54,20 +138,62 @@ func M3U8ProxyHandler(c echo.Context) error {
 	if referer != "" {
 		unscaped, err := url.QueryUnescape(referer)
 		if err != nil {
-			log.Printf("Error unescaping referer: %v", err)
+			requestLogger(c).Info("Invalid referer parameter", "error", err)
 			return c.String(http.StatusBadRequest, "Invalid 'referer' query parameter")
 		}
 		refererHeader = unscaped
 	}
 
-	
-	_, err := url.ParseRequestURI(targetURL)
+	// Equivalent origins, tried when the primary one fails or is slow
+	mirrors := c.QueryParams()["mirror"]
+
+	profile := c.QueryParam("profile")
+	session := c.QueryParam("session")
+
+	// Signed URLs keep the endpoint from being used as an open relay
+	if urlSigner != nil {
+		signed := security.SignedFields{URL: targetURL, Referer: referer, Profile: profile, Session: session, Mirrors: mirrors}
+		if err := urlSigner.Verify(signed, c.QueryParam("exp"), c.QueryParam("sig")); err != nil {
+			requestLogger(c).Warn("Rejected proxy URL", "upstream", logging.RedactURL(targetURL), "error", err)
+			return c.String(http.StatusForbidden, "Invalid or expired signature")
+		}
+	}
+
+	return proxyStream(c, &streamRequest{
+		targetURL:     targetURL,
+		referer:       referer,
+		refererHeader: refererHeader,
+		profile:       profile,
+		session:       session,
+		mirrors:       mirrors,
+		startTime:     startTime,
+	})
+}
+
+// proxyStream fetches an upstream resource and relays it to the client, rewriting playlists
+func proxyStream(c echo.Context, sr *streamRequest) error {
+	targetURL := sr.targetURL
+
+	parsedTargetURL, err := url.ParseRequestURI(targetURL)
 	if err != nil {
-		log.Printf("Invalid target URL: %s, error: %v", targetURL, err)
+		requestLogger(c).Info("Invalid target URL", "upstream", logging.RedactURL(targetURL), logging.ErrorAttr(err))
 		return c.String(http.StatusBadRequest, "Invalid 'url' query parameter")
 	}
-	isM3U8 := strings.HasSuffix(strings.ToLower(targetURL), ".m3u8")
-	isTS := strings.HasSuffix(strings.ToLower(targetURL), ".ts")
+	logging.Annotate(c,
+		slog.String("upstream", logging.RedactURL(targetURL)),
+		slog.String("upstream_host", parsedTargetURL.Hostname()),
+	)
+	if sessionID := sessionIDFor(c); sessionID != "" {
+		logging.Annotate(c, slog.String("session", sessionID))
+	}
+
+	// Reject internal addresses, odd schemes and ports before anything is fetched
+	if err := utils.CheckDestination(parsedTargetURL); err != nil {
+		requestLogger(c).Warn("Rejected target URL", "upstream", logging.RedactURL(targetURL), logging.ErrorAttr(err))
+		return c.String(http.StatusForbidden, "Destination not allowed")
+	}
+	// Classify on the URL path so signed segments like seg-1.ts?st=abc&e=123 take the fast path
+	isTS := utils.URLExtension(targetURL) == ".ts"
 	isOtherStatic := utils.IsStaticFileExtension(targetURL)
 
 	// Video segments are often disguised with other extensions (.jpg, .html, .js, .css)
@@ -76,32 +202,98 @@ func M3U8ProxyHandler(c echo.Context) error {
 		isTS = true
 	}
 
+	kind := metrics.KindStatic
+	if isTS {
+		kind = metrics.KindSegment
+	}
+	metrics.SetKind(c, kind)
+	logging.Annotate(c, slog.String("kind", kind))
+	sr.kind, sr.upstreamHost = kind, parsedTargetURL.Hostname()
+
+	span := trace.SpanFromContext(c.Request().Context())
+	span.SetAttributes(
+		attribute.String("proxy.kind", kind),
+		attribute.String("proxy.upstream_host", parsedTargetURL.Hostname()),
+		attribute.Int("proxy.mirrors", len(sr.mirrors)),
+	)
+
+	// Serving segment N lets the prefetcher warm N+1..N+k for this viewer
+	utils.GetPrefetcher().OnSegment(viewerKey(c), targetURL)
+
+	// Cached segments and playlists are answered locally, including byte ranges
+	entry, cached := utils.GetSegmentCache().GetEntry(targetURL)
+	span.SetAttributes(attribute.Bool("proxy.cache_hit", cached))
+	logging.Annotate(c, slog.Bool("cache_hit", cached))
+	sr.cacheHit = cached
+	if cached {
+		return serveCached(c, entry, sr)
+	}
+
+	// Anything not addressed like a segment may be a playlist and is charged to the
+	// playlist limits before the origin is asked for it
+	if !isTS {
+		if wait := mdlware.ChargePlaylist(c); wait > 0 {
+			return mdlware.RateLimited(c, wait)
+		}
+	}
+
 	req, err := http.NewRequest("GET", targetURL, nil)
 	if err != nil {
-		log.Printf("Error creating request to target %s: %v", targetURL, err)
+		requestLogger(c).Error("Failed to create upstream request", logging.ErrorAttr(err))
 		return c.String(http.StatusInternalServerError, "Failed to create request to target server")
 	}
 
-	// Set request timeout for streaming
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	// Set request timeout for streaming; the fetch keeps the request's trace but not its cancellation
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request().Context()), 60*time.Second)
 	defer cancel()
 	req = req.WithContext(ctx)
 
 	// Generate dynamic headers with session consistency
-	sessionID := c.Request().Header.Get("X-Session-ID")
-	if sessionID == "" {
-		sessionID = c.QueryParam("session")
-	}
-	
-	dynamicHeaders := utils.GenerateDynamicHeaders(refererHeader, sessionID)
+	dynamicHeaders := upstreamHeaders(c, sr)
 	for key, value := range dynamicHeaders {
 		req.Header.Set(key, value)
 	}
 
-	upstreamResp, err := utils.ProxyHTTPClient.Do(req)
+	// Forward range requests so seeking and EXT-X-BYTERANGE don't download whole files
+	if rangeHeader := c.Request().Header.Get("Range"); rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+		if ifRange := c.Request().Header.Get("If-Range"); ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+		// Byte offsets only make sense on the identity encoding
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+
+	// Forward validators so the origin can answer 304 Not Modified
+	for _, hName := range utils.ConditionalHeaders {
+		if hVal := c.Request().Header.Get(hName); hVal != "" {
+			req.Header.Set(hName, hVal)
+		}
+	}
+
+	// Concurrent viewers of the same segment share a single origin fetch,
+	// transient failures are retried or failed over to a mirror before anything
+	// is sent to the client. Segments may race two mirrors.
+	fetchStart := time.Now()
+	upstreamResp, upstreamReq, err := utils.FetchMirrored(req, utils.MirrorURLs(targetURL, sr.mirrors), isTS)
+	ttfb := time.Since(fetchStart)
+	sr.ttfb = ttfb
 	if err != nil {
-		log.Printf("Error fetching target URL %s: %v", targetURL, err)
-		logProxyEvent(c, targetURL, refererHeader, startTime, 0, 0, false)
+		metrics.ObserveUpstreamError(err)
+		requestLogger(c).Warn("Failed to fetch upstream", logging.ErrorAttr(err),
+			"error_class", metrics.ErrorClass(err), "upstream_ttfb_ms", ttfb.Milliseconds())
+		logProxyEvent(c, sr, 0, 0, false)
+		// A redirect or DNS answer pointing at a forbidden address
+		if errors.Is(err, security.ErrDestinationDenied) {
+			return c.String(http.StatusForbidden, "Destination not allowed")
+		}
+		// The upstream host is ejected, fail fast instead of waiting on it
+		var circuitErr *utils.CircuitOpenError
+		if errors.As(err, &circuitErr) {
+			retryAfter := int(math.Ceil(circuitErr.RetryAfter.Seconds()))
+			c.Response().Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			return c.String(http.StatusServiceUnavailable, "Upstream host temporarily unavailable")
+		}
 		// Check for timeout or other specific errors if needed
 		if urlErr, ok := err.(*url.Error); ok && urlErr.Timeout() {
 			return c.String(http.StatusGatewayTimeout, "Upstream server timed out")
@@ -109,6 +301,14 @@ func M3U8ProxyHandler(c echo.Context) error {
 		return c.String(http.StatusBadGateway, "Failed to fetch content from upstream server")
 	}
 	defer upstreamResp.Body.Close()
+	metrics.ObserveUpstreamStatus(upstreamResp.StatusCode)
+	logging.Annotate(c,
+		slog.Int("upstream_status", upstreamResp.StatusCode),
+		slog.Int64("upstream_ttfb_ms", ttfb.Milliseconds()),
+	)
+	if upstreamReq.URL.Host != req.URL.Host {
+		logging.Annotate(c, slog.String("mirror_host", upstreamReq.URL.Hostname()))
+	}
 
 	responseHeadersToClient := http.Header{}
 
@@ -116,7 +316,8 @@ func M3U8ProxyHandler(c echo.Context) error {
 	headerWhitelist := []string{
 		"Content-Type", "Content-Disposition", "Accept-Ranges", "Content-Range",
 	}
-	if upstreamResp.StatusCode == http.StatusOK || upstreamResp.StatusCode == http.StatusPartialContent {
+	if upstreamResp.StatusCode == http.StatusOK || upstreamResp.StatusCode == http.StatusPartialContent ||
+		upstreamResp.StatusCode == http.StatusNotModified {
 		headerWhitelist = append(headerWhitelist, "ETag", "Last-Modified")
 	}
 
@@ -126,8 +327,56 @@ func M3U8ProxyHandler(c echo.Context) error {
 		}
 	}
 
-	// Fast path for TS segments - stream directly without buffering
-	if isTS && upstreamResp.StatusCode == http.StatusOK {
+	// Revalidated by the origin - pass the 304 through without a body
+	if upstreamResp.StatusCode == http.StatusNotModified {
+		for key, values := range responseHeadersToClient {
+			for _, value := range values {
+				c.Response().Header().Set(key, value)
+			}
+		}
+		c.Response().WriteHeader(http.StatusNotModified)
+		logProxyEvent(c, sr, http.StatusNotModified, 0, true)
+		return nil
+	}
+
+	isPartial := upstreamResp.StatusCode == http.StatusPartialContent
+
+	// Segments that break off mid-stream are resumed from the bytes already read
+	if isTS || isPartial {
+		upstreamResp.Body = utils.GetRetryPolicy().Resumable(upstreamReq, upstreamResp)
+	}
+
+	// Playlists are detected by content, not by URL: origins serve them from
+	// /playlist?id=123, .m3u8?token=... or even .txt URLs
+	upstreamBody := bufio.NewReaderSize(upstreamResp.Body, 64<<10)
+	upstreamContentType := upstreamResp.Header.Get("Content-Type")
+	isM3U8 := utils.IsPlaylistContentType(upstreamContentType)
+	// Peeking holds back the first byte until the buffer fills, media types are trusted as they are
+	if !isM3U8 && upstreamResp.StatusCode == http.StatusOK && utils.NeedsPlaylistSniff(upstreamContentType) {
+		prefix, _ := upstreamBody.Peek(utils.PlaylistSniffLength)
+		isM3U8 = utils.SniffPlaylist(prefix)
+	}
+	if isM3U8 {
+		kind = metrics.KindPlaylist
+		metrics.SetKind(c, kind)
+		span.SetAttributes(attribute.String("proxy.kind", kind))
+		logging.Annotate(c, slog.String("kind", kind))
+		sr.kind = kind
+
+		// Playlists behind segment-like URLs are only recognised now, the others were charged already
+		if wait := mdlware.ChargePlaylist(c); wait > 0 {
+			return mdlware.RateLimited(c, wait)
+		}
+	}
+	metrics.ObserveTTFB(kind, ttfb)
+
+	cache := utils.GetSegmentCache()
+	// Only complete objects fetched without a client range are worth caching
+	cacheable := cache.Enabled() && upstreamResp.StatusCode == http.StatusOK &&
+		req.Header.Get("Range") == "" && utils.IsCacheableResponse(upstreamResp.Header)
+
+	// Fast path for TS segments and partial content - stream directly without buffering
+	if (isTS && !isM3U8 && upstreamResp.StatusCode == http.StatusOK) || isPartial {
 		// CRITICAL: Skip video enhancement for TS segments - massive performance overhead
 		// Enhancement adds 500-2000ms latency via ffmpeg processing
 		// Stream directly from upstream to client for <50ms latency
@@ -142,58 +391,82 @@ func M3U8ProxyHandler(c echo.Context) error {
 				c.Response().Header().Set(key, value)
 			}
 		}
+		if upstreamResp.ContentLength >= 0 {
+			c.Response().Header().Set("Content-Length", strconv.FormatInt(upstreamResp.ContentLength, 10))
+		}
 
 		c.Response().WriteHeader(upstreamResp.StatusCode)
 
+		// Keep a copy for the cache while streaming, dropped if the segment is too large
+		var dst io.Writer = c.Response()
+		var capture *utils.CaptureBuffer
+		if cacheable {
+			capture = utils.NewCaptureBuffer(upstreamResp.ContentLength, cache.MaxEntryBytes())
+			dst = io.MultiWriter(dst, capture)
+		}
+
 		// Stream directly with optimized buffer - NO intermediate buffering
-		written, err := io.CopyBuffer(c.Response().Writer, upstreamResp.Body, make([]byte, 64<<10)) // 64KB buffer
+		_, streamSpan := tracing.StartSpan(c.Request().Context(), "stream body")
+		written, err := io.CopyBuffer(dst, upstreamBody, make([]byte, 64<<10)) // 64KB buffer
+		streamSpan.SetAttributes(attribute.Int64("bytes", written))
+		streamSpan.End()
 
 		if err != nil {
-			log.Printf("Error streaming TS segment to client: %v", err)
-			logProxyEvent(c, targetURL, refererHeader, startTime, upstreamResp.StatusCode, 0, false)
+			requestLogger(c).Warn("Failed to stream segment to client", logging.ErrorAttr(err), "bytes", written)
+			logProxyEvent(c, sr, upstreamResp.StatusCode, 0, false)
 		} else {
-			logProxyEvent(c, targetURL, refererHeader, startTime, upstreamResp.StatusCode, written, true)
+			if capture != nil && capture.Complete(upstreamResp.ContentLength) {
+				cache.SetEntry(targetURL, utils.NewCacheEntry(upstreamResp.Header, capture.Bytes(), false), config.Env.CacheSegmentTTL)
+			}
+			logProxyEvent(c, sr, upstreamResp.StatusCode, written, true)
 		}
 
 		return nil
 	}
 
 	// M3U8 and other files - buffer and transform
-	rawBodyBytes, err := io.ReadAll(upstreamResp.Body)
+	rawBodyBytes, err := io.ReadAll(upstreamBody)
 	if err != nil {
-		log.Printf("Error reading response body from upstream %s: %v", targetURL, err)
-		logProxyEvent(c, targetURL, refererHeader, startTime, 0, 0, false)
+		requestLogger(c).Warn("Failed to read upstream response", logging.ErrorAttr(err))
+		logProxyEvent(c, sr, 0, 0, false)
 		return c.String(http.StatusInternalServerError, "Failed to read response from upstream server")
 	}
 
 	var responseBodyBytes []byte
 
 	if isM3U8 && upstreamResp.StatusCode == http.StatusOK {
-		var transformedBodyBuffer bytes.Buffer
-
-		// Build the full proxy URL prefix
-		scheme := "http"
-		if c.Request().TLS != nil {
-			scheme = "https"
-		}
-		host := c.Request().Host
-		proxyRoutePath := c.Path()
-
-		// Construct full URL with referer preserved
-		urlPrefix := scheme + "://" + host + proxyRoutePath + "?url="
-		if referer != "" {
-			urlPrefix += "{URL}&referer=" + url.QueryEscape(referer)
-		} else {
-			urlPrefix += "{URL}"
+		// The raw playlist is cached, it is rewritten for the requesting client on every hit
+		if cacheable {
+			ttl := config.Env.CachePlaylistTTL
+			if utils.IsLivePlaylist(rawBodyBytes) {
+				ttl = config.Env.CacheLivePlaylistTTL
+			}
+			cache.SetEntry(targetURL, utils.NewCacheEntry(upstreamResp.Header, rawBodyBytes, true), ttl)
 		}
+		observePlaylist(c, rawBodyBytes, sr)
 
-		err = utils.ProcessM3U8Stream(bytes.NewReader(rawBodyBytes), &transformedBodyBuffer, targetURL, urlPrefix)
+		var etag string
+		responseBodyBytes, etag, err = rewritePlaylist(c, rawBodyBytes, sr)
 		if err != nil {
-			log.Printf("Error processing M3U8 stream for %s: %v", targetURL, err)
+			requestLogger(c).Error("Failed to rewrite playlist", "error", err)
 			return c.String(http.StatusInternalServerError, "Error transforming M3U8 content")
 		}
-		responseBodyBytes = transformedBodyBuffer.Bytes()
+		// Sniffed playlists may come with a bogus type such as text/plain
+		responseHeadersToClient.Set("Content-Type", utils.PlaylistContentTypes[0])
+
+		// The origin's validators describe the raw playlist, not the rewritten one
+		responseHeadersToClient.Del("Last-Modified")
+		responseHeadersToClient.Set("ETag", etag)
+		if utils.IsNotModified(c.Request().Header, etag, "") {
+			c.Response().Header().Set("ETag", etag)
+			c.Response().WriteHeader(http.StatusNotModified)
+			logProxyEvent(c, sr, http.StatusNotModified, 0, true)
+			return nil
+		}
 	} else {
+		if cacheable {
+			cache.SetEntry(targetURL, utils.NewCacheEntry(upstreamResp.Header, rawBodyBytes, false), config.Env.CacheSegmentTTL)
+		}
 		// No transformation or non-OK status
 		responseBodyBytes = rawBodyBytes
 		// Set Content-Length from upstream if present
@@ -212,22 +485,244 @@ func M3U8ProxyHandler(c echo.Context) error {
 	c.Response().WriteHeader(upstreamResp.StatusCode)
 
 	// Write response
-	_, err = io.Copy(c.Response().Writer, bytes.NewReader(responseBodyBytes))
+	_, writeSpan := tracing.StartSpan(c.Request().Context(), "write response", attribute.Int("bytes", len(responseBodyBytes)))
+	_, err = io.Copy(c.Response(), bytes.NewReader(responseBodyBytes))
+	writeSpan.End()
 	if err != nil {
-		log.Printf("Error writing response body to client for %s: %v", targetURL, err)
-		logProxyEvent(c, targetURL, refererHeader, startTime, 0, 0, false)
+		requestLogger(c).Warn("Failed to write response to client", "error", err)
+		logProxyEvent(c, sr, 0, 0, false)
 	} else {
 		contentSize := int64(len(responseBodyBytes))
-		logProxyEvent(c, targetURL, refererHeader, startTime, upstreamResp.StatusCode, contentSize, true)
+		logProxyEvent(c, sr, upstreamResp.StatusCode, contentSize, true)
+	}
+
+	return nil
+}
+
+// rewritePlaylist routes every URI of a playlist back through this proxy. It also
+// returns the rewritten playlist's ETag.
+func rewritePlaylist(c echo.Context, raw []byte, sr *streamRequest) ([]byte, string, error) {
+	_, span := tracing.StartSpan(c.Request().Context(), "rewrite playlist", attribute.Int("bytes", len(raw)))
+	defer span.End()
+
+	var transformedBodyBuffer bytes.Buffer
+
+	// Build the full proxy URL prefix
+	scheme := "http"
+	if c.Request().TLS != nil {
+		scheme = "https"
+	}
+	host := c.Request().Host
+
+	// Construct full URL with referer preserved. Playlists served through /s/{token}
+	// fall back to these links when a token can't be encoded, so the route is fixed.
+	urlPrefix := scheme + "://" + host + ProxyPath + "?url="
+	if sr.referer != "" {
+		urlPrefix += "{URL}&referer=" + url.QueryEscape(sr.referer)
+	} else {
+		urlPrefix += "{URL}"
+	}
+	if sr.profile != "" {
+		urlPrefix += "&profile=" + url.QueryEscape(sr.profile)
+	}
+	if sr.session != "" {
+		urlPrefix += "&session=" + url.QueryEscape(sr.session)
+	}
+
+	// Every child link shares one expiry, which only moves every tenth of the TTL
+	var signExp, tokenExp int64
+	if urlSigner != nil {
+		signExp = urlSigner.Expiry()
+	}
+	if streamTokenTTL > 0 {
+		tokenExp = security.ExpiryAfter(streamTokenTTL)
+	}
+	useTokens := sr.viaToken || emitStreamTokens
+
+	rewrite := func(childURL string) string {
+		mirrors := utils.MirrorsFor(childURL, sr.targetURL, sr.mirrors)
+
+		// Opaque tokens hide the upstream URL and keep playlists small
+		if useTokens {
+			if link, err := streamTokenURL(c, sr, childURL, mirrors, tokenExp); err == nil {
+				return link
+			}
+		}
+
+		proxied := strings.Replace(urlPrefix, "{URL}", url.QueryEscape(childURL), 1)
+		for _, mirror := range mirrors {
+			proxied += "&mirror=" + url.QueryEscape(mirror)
+		}
+		if urlSigner != nil {
+			// Re-sign every child so the whole playlist tree stays playable
+			sig := urlSigner.SignWithExpiry(security.SignedFields{
+				URL: childURL, Referer: sr.referer, Profile: sr.profile, Session: sr.session, Mirrors: mirrors,
+			}, signExp)
+			proxied += "&exp=" + strconv.FormatInt(signExp, 10) + "&sig=" + sig
+		}
+		return proxied
+	}
+
+	err := utils.RewriteM3U8Stream(bytes.NewReader(raw), &transformedBodyBuffer, sr.targetURL, rewrite)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Encrypted tokens differ on every rewrite, so the ETag is derived from what the
+	// links are built from rather than from the rewritten bytes
+	etag := playlistETag(raw, urlPrefix, sessionIDFor(c), strings.Join(sr.mirrors, " "),
+		strconv.FormatBool(useTokens), strconv.FormatInt(signExp, 10), strconv.FormatInt(tokenExp, 10))
+	return transformedBodyBuffer.Bytes(), etag, nil
+}
+
+// observePlaylist indexes a playlist served to this viewer, so its segments can be
+// traced back to their variant, and hands its segments to the prefetcher
+func observePlaylist(c echo.Context, raw []byte, sr *streamRequest) {
+	playlist := utils.ParsePlaylist(raw, sr.targetURL)
+	utils.GetPlaylistIndex().OnPlaylist(sr.targetURL, playlist)
+
+	prefetcher := utils.GetPrefetcher()
+	if prefetcher.Enabled() {
+		prefetcher.OnPlaylist(viewerKey(c), sr.targetURL, playlist, upstreamHeaders(c, sr))
+	}
+}
+
+// upstreamHeaders builds the browser-like headers sent to the origin
+func upstreamHeaders(c echo.Context, sr *streamRequest) map[string]string {
+	headers := utils.GenerateDynamicHeaders(sr.refererHeader, sessionIDFor(c))
+	return utils.ApplyHeaderProfile(headers, sr.profile)
+}
+
+// sessionIDFor returns the viewer's session from the X-Session-ID header, the
+// stream token or the session query parameter
+func sessionIDFor(c echo.Context) string {
+	if sessionID := c.Request().Header.Get("X-Session-ID"); sessionID != "" {
+		return sessionID
+	}
+	if sessionID, ok := c.Get(sessionContextKey).(string); ok && sessionID != "" {
+		return sessionID
+	}
+	return c.QueryParam("session")
+}
+
+// requestLogger returns the logger of the current request, carrying its ID and
+// what is known about the upstream so far
+func requestLogger(c echo.Context) *slog.Logger {
+	return logging.FromContext(c.Request().Context())
+}
+
+// viewerKey identifies a viewer by session, falling back to the client IP
+func viewerKey(c echo.Context) string {
+	if sessionID := sessionIDFor(c); sessionID != "" {
+		return sessionID
+	}
+	return c.RealIP()
+}
+
+// playlistETag derives a weak validator for a rewritten playlist from the upstream
+// playlist and the parameters of its links
+func playlistETag(raw []byte, linkParams ...string) string {
+	h := sha256.New()
+	h.Write(raw)
+	for _, param := range linkParams {
+		fmt.Fprintf(h, "\n%d:%s", len(param), param)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// serveCached answers a request from the segment cache, honouring validators and single byte ranges
+func serveCached(c echo.Context, entry *utils.CacheEntry, sr *streamRequest) error {
+
+	res := c.Response()
+	reqHeader := c.Request().Header
+
+	if entry.Playlist {
+		metrics.SetKind(c, metrics.KindPlaylist)
+		logging.Annotate(c, slog.String("kind", metrics.KindPlaylist))
+		sr.kind = metrics.KindPlaylist
+		if wait := mdlware.ChargePlaylist(c); wait > 0 {
+			return mdlware.RateLimited(c, wait)
+		}
+		observePlaylist(c, entry.Data, sr)
+		body, etag, err := rewritePlaylist(c, entry.Data, sr)
+		if err != nil {
+			requestLogger(c).Error("Failed to rewrite cached playlist", "error", err)
+			return c.String(http.StatusInternalServerError, "Error transforming M3U8 content")
+		}
+
+		// Rewritten URIs carry expiring signatures, the origin's validators don't apply
+		res.Header().Set("ETag", etag)
+		if utils.IsNotModified(reqHeader, etag, "") {
+			res.WriteHeader(http.StatusNotModified)
+			logProxyEvent(c, sr, http.StatusNotModified, 0, true)
+			return nil
+		}
+		res.Header().Set("Content-Type", utils.PlaylistContentTypes[0])
+		res.WriteHeader(http.StatusOK)
+		written, err := res.Write(body)
+		if err != nil {
+			logProxyEvent(c, sr, http.StatusOK, 0, false)
+			return nil
+		}
+		logProxyEvent(c, sr, http.StatusOK, int64(written), true)
+		return nil
+	}
+
+	res.Header().Set("Accept-Ranges", "bytes")
+	if entry.ETag != "" {
+		res.Header().Set("ETag", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		res.Header().Set("Last-Modified", entry.LastModified)
+	}
+
+	if utils.IsNotModified(reqHeader, entry.ETag, entry.LastModified) {
+		res.WriteHeader(http.StatusNotModified)
+		logProxyEvent(c, sr, http.StatusNotModified, 0, true)
+		return nil
+	}
+
+	if entry.ContentType != "" {
+		res.Header().Set("Content-Type", entry.ContentType)
+	}
+
+	rangeHeader := reqHeader.Get("Range")
+	if !utils.IfRangeMatches(reqHeader.Get("If-Range"), entry.ETag, entry.LastModified) {
+		// The client's copy is stale, send the full object instead of a range
+		rangeHeader = ""
+	}
+
+	size := int64(len(entry.Data))
+	data, byteRange, partial, err := entry.Range(rangeHeader)
+	if err == utils.ErrRangeNotSatisfiable {
+		res.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		logProxyEvent(c, sr, http.StatusRequestedRangeNotSatisfiable, 0, false)
+		return c.NoContent(http.StatusRequestedRangeNotSatisfiable)
+	}
+
+	status := http.StatusOK
+	if partial {
+		status = http.StatusPartialContent
+		res.Header().Set("Content-Range", byteRange.ContentRange(size))
+	}
+	res.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	res.WriteHeader(status)
+
+	written, err := res.Write(data)
+	if err != nil {
+		requestLogger(c).Warn("Failed to write cached segment to client", "error", err)
+		logProxyEvent(c, sr, status, 0, false)
+		return nil
 	}
 
+	logProxyEvent(c, sr, status, int64(written), true)
 	return nil
 }
 
 // applyVideoEnhancements applies video enhancement processing to TS segments using ffmpeg
 func applyVideoEnhancements(data []byte, options *video.EnhancementOptions) ([]byte, error) {
-	log.Printf("Video enhancement requested - profile: %s, upscale: %dx, sharpen: %.2f, hdr: %v",
-		options.Profile, options.UpscaleFactor, options.Sharpen, options.HDRSimulation)
+	slog.Debug("Video enhancement requested", "profile", options.Profile, "upscale", options.UpscaleFactor,
+		"sharpen", options.Sharpen, "hdr", options.HDRSimulation)
 
 	// Build ffmpeg filter string
 	filters := buildFFmpegFilters(options)
@@ -260,12 +755,12 @@ func applyVideoEnhancements(data []byte, options *video.EnhancementOptions) ([]b
 	// Run ffmpeg
 	err := cmd.Run()
 	if err != nil {
-		log.Printf("ffmpeg error: %v, stderr: %s", err, errBuf.String())
+		slog.Warn("ffmpeg failed", "error", err, "stderr", errBuf.String())
 		// Return original data if enhancement fails
 		return data, nil
 	}
 
-	log.Printf("Video enhanced successfully, original: %d bytes, enhanced: %d bytes", len(data), outBuf.Len())
+	slog.Debug("Video enhanced", "original_bytes", len(data), "enhanced_bytes", outBuf.Len())
 	return outBuf.Bytes(), nil
 }
 
@@ -325,34 +820,89 @@ func buildFFmpegFilters(options *video.EnhancementOptions) string {
 	return result
 }
 
-// logProxyEvent logs proxy events to Redpanda if enabled
-func logProxyEvent(c echo.Context, targetURL, referer string, startTime time.Time, statusCode int, contentSize int64, success bool) {
-	if streamingMetrics == nil || !streamingMetrics.IsEnabled() {
+// logProxyEvent logs proxy events to the event sink and stream statistics if enabled
+func logProxyEvent(c echo.Context, sr *streamRequest, statusCode int, contentSize int64, success bool) {
+	sendEvents := streamingMetrics != nil && streamingMetrics.IsEnabled()
+	stats := analytics.Get()
+	if !sendEvents && !stats.Enabled() {
 		return
 	}
 
-	sessionID := c.Request().Header.Get("X-Session-ID")
-	if sessionID == "" {
-		sessionID = c.QueryParam("session")
-	}
+	sessionID := sessionIDFor(c)
 	if sessionID == "" {
 		sessionID = "anonymous"
 	}
 
+	elapsed := time.Since(sr.startTime)
 	event := &streaming.ProxyRequestEvent{
-		Timestamp:    startTime,
+		Timestamp:    sr.startTime,
 		SessionID:    sessionID,
-		TargetURL:    targetURL,
-		Referer:      referer,
+		TargetURL:    sr.targetURL,
+		Referer:      sr.refererHeader,
 		StatusCode:   statusCode,
-		ResponseTime: time.Since(startTime).Milliseconds(),
+		ResponseTime: elapsed.Milliseconds(),
 		ContentType:  c.Response().Header().Get("Content-Type"),
 		ContentSize:  contentSize,
 		UserAgent:    c.Request().UserAgent(),
 		Success:      success,
+
+		Kind:         sr.kind,
+		UpstreamHost: sr.upstreamHost,
+		CacheStatus:  "miss",
+		TTFB:         sr.ttfb.Milliseconds(),
+		ClientIPHash: hashClientIP(c.RealIP()),
+	}
+	if sr.cacheHit {
+		event.CacheStatus = "hit"
+	}
+	if elapsed > 0 {
+		event.BytesPerSecond = float64(contentSize) / elapsed.Seconds()
+	}
+
+	if info, ok := utils.GetPlaylistIndex().Lookup(sr.targetURL); ok {
+		event.MasterURL = info.MasterURL
+		event.PlaylistURL = info.PlaylistURL
+		event.VariantBandwidth = info.Bandwidth
+		event.VariantResolution = info.Resolution
+		if info.IsSegment {
+			sequence := info.Sequence
+			event.MediaSequence = &sequence
+			event.SegmentDuration = info.Duration.Seconds()
+			event.SlowDownload = success && info.Duration > 0 && elapsed > info.Duration
+		}
+	}
+
+	sessionKey := sessionID
+	if sessionKey == "anonymous" {
+		// Viewers without a session are told apart by address, which is never sent out in clear
+		sessionKey = "ip-" + event.ClientIPHash
 	}
+	stats.Observe(sessionKey, event)
 
+	if !sendEvents {
+		return
+	}
 	if err := streamingMetrics.LogProxyRequest(event); err != nil {
-		log.Printf("Failed to log proxy event: %v", err)
+		requestLogger(c).Warn("Failed to log proxy event", "error", err)
+	}
+	if sessionTracker != nil {
+		sessionTracker.Observe(sessionKey, event)
+	}
+}
+
+// ReportBreakerState sends upstream circuit breaker state changes to Redpanda if enabled
+func ReportBreakerState(host string, from, to utils.BreakerState) {
+	if streamingMetrics == nil || !streamingMetrics.IsEnabled() {
+		return
+	}
+
+	event := &streaming.BreakerStateEvent{
+		Timestamp: time.Now(),
+		Host:      host,
+		From:      string(from),
+		To:        string(to),
+	}
+	if err := streamingMetrics.LogBreakerState(event); err != nil {
+		slog.Warn("Failed to log circuit breaker event", "error", err)
 	}
 }
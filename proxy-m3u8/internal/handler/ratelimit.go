@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	mdlware "github.com/dovakiin0/proxy-m3u8/internal/middleware"
+)
+
+// RateLimitTarget describes a proxy request for the rate limiter. Requests whose
+// target can't be determined are still limited by client IP. Whether it is a
+// playlist depends on the upstream URL or response, the handler charges that
+// through mdlware.ChargePlaylist.
+func RateLimitTarget(c echo.Context) (mdlware.RateLimitTarget, bool) {
+	target := mdlware.RateLimitTarget{Session: sessionIDFor(c)}
+
+	targetURL := c.QueryParam("url")
+	if token := c.Param("token"); token != "" {
+		decoded, err := streamTokens.Decode(token)
+		if err != nil {
+			return target, true
+		}
+		targetURL = decoded.URL
+		if target.Session == "" {
+			target.Session = decoded.Session
+		}
+	}
+
+	if parsed, err := url.Parse(targetURL); err == nil {
+		target.UpstreamHost = strings.ToLower(parsed.Hostname())
+	}
+	return target, true
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
+	"github.com/dovakiin0/proxy-m3u8/internal/security"
+)
+
+// StreamTokenPath is the route serving /s/{token} links
+const StreamTokenPath = "/s/:token"
+
+// sessionContextKey carries the session decoded from a stream token to sessionIDFor
+const sessionContextKey = "streamSession"
+
+var (
+	// streamTokens packs child links into /s/{token} URLs
+	streamTokens, _ = security.NewTokenCodec(nil, nil)
+	// streamTokenTTL bounds how long a rewritten token link stays valid, 0 for no expiry
+	streamTokenTTL time.Duration
+	// emitStreamTokens rewrites playlists requested through /m3u8-proxy to token links as well
+	emitStreamTokens bool
+)
+
+// ConfigureStreamTokens sets up stream tokens. With an encryption key tokens are
+// opaque; with a MAC key (the proxy signing key) they can't be forged. When signed
+// URLs are enforced, a MAC or encryption key is required for tokens to be accepted.
+func ConfigureStreamTokens(encryptionKey, macKey []byte, ttl time.Duration, emit bool) error {
+	codec, err := security.NewTokenCodec(encryptionKey, macKey)
+	if err != nil {
+		return err
+	}
+	streamTokens = codec
+	streamTokenTTL = ttl
+	emitStreamTokens = emit
+	return nil
+}
+
+// StreamTokenHandler serves /s/{token}, the compact alternative to
+// /m3u8-proxy?url=...&referer=...
+func StreamTokenHandler(c echo.Context) error {
+	startTime := time.Now()
+
+	// Unauthenticated tokens would bypass signed URLs
+	if urlSigner != nil && !streamTokens.Authenticated() {
+		return c.String(http.StatusForbidden, "Invalid or expired token")
+	}
+
+	token, err := streamTokens.Decode(c.Param("token"))
+	if err != nil {
+		if !errors.Is(err, security.ErrTokenExpired) {
+			requestLogger(c).Warn("Rejected stream token", "path", logging.RedactPath(c.Request().URL.Path), "error", err)
+		}
+		return c.String(http.StatusForbidden, "Invalid or expired token")
+	}
+	if token.URL == "" {
+		return c.String(http.StatusBadRequest, "Missing stream URL")
+	}
+
+	// Like the session query parameter on /m3u8-proxy, the token's session scopes
+	// rate limits and analytics and is carried over to child links
+	session := token.Session
+	if session == "" {
+		session = c.QueryParam("session")
+	}
+	if session != "" {
+		c.Set(sessionContextKey, session)
+	}
+
+	return proxyStream(c, &streamRequest{
+		targetURL:     token.URL,
+		referer:       token.Referer,
+		refererHeader: token.Referer,
+		profile:       token.Profile,
+		session:       session,
+		mirrors:       token.Mirrors,
+		viaToken:      true,
+		startTime:     startTime,
+	})
+}
+
+// streamTokenURL builds the /s/{token} link for a child URI of the playlist being
+// served, expiring at expires (unix seconds, 0 for never)
+func streamTokenURL(c echo.Context, sr *streamRequest, childURL string, mirrors []string, expires int64) (string, error) {
+	token := security.StreamToken{
+		URL:     childURL,
+		Referer: sr.refererHeader,
+		Session: sessionIDFor(c),
+		Profile: sr.profile,
+		Mirrors: mirrors,
+		Expires: expires,
+	}
+
+	encoded, err := streamTokens.Encode(token)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := "http"
+	if c.Request().TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request().Host + "/s/" + encoded, nil
+}
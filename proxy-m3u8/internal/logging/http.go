@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxRequestIDLength bounds request IDs accepted from clients
+const maxRequestIDLength = 64
+
+// Middleware assigns every request an ID, taken from a well-formed X-Request-ID
+// header or generated, echoes it in the response and writes one access log
+// line per request once it has been served
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+
+			id := req.Header.Get(echo.HeaderXRequestID)
+			if !validRequestID(id) {
+				id = newRequestID()
+				// Passed on to Next.js along with the rest of the request headers
+				req.Header.Set(echo.HeaderXRequestID, id)
+			}
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+
+			rl := newRequestLog(id)
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), contextKey{}, rl)))
+
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			level := slog.LevelInfo
+			if status >= http.StatusInternalServerError {
+				level = slog.LevelWarn
+			}
+
+			route := c.Path()
+			if route == "" {
+				route = req.URL.Path
+			}
+			_, annotations := rl.snapshot()
+			attrs := []slog.Attr{
+				slog.String("request_id", id),
+				slog.String("method", req.Method),
+				slog.String("route", route),
+				slog.String("path", RedactPath(req.URL.Path)),
+				slog.Int("status", status),
+				slog.Int64("bytes", c.Response().Size),
+				slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+				slog.String("remote_ip", c.RealIP()),
+				slog.String("user_agent", req.UserAgent()),
+			}
+			attrs = append(attrs, annotations...)
+			ctx := c.Request().Context()
+			if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+				attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+			}
+			// Annotations are listed explicitly, so start from a logger without them
+			slog.Default().LogAttrs(ctx, level, "request", attrs...)
+
+			// The error was handled above, don't let Echo write a second response
+			return nil
+		}
+	}
+}
+
+// Annotate adds fields to the request's logger and its access log line
+func Annotate(c echo.Context, attrs ...slog.Attr) {
+	if rl, ok := c.Request().Context().Value(contextKey{}).(*requestLog); ok {
+		rl.add(attrs...)
+	}
+}
+
+// validRequestID accepts short IDs made of characters safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
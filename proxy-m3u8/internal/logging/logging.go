@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Formats selectable in Configure
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Configure installs the default slog logger. The standard log package is
+// routed through it as well, so stray log.Printf calls keep the same format.
+func Configure(level, format string) error {
+	return configure(os.Stderr, level, format)
+}
+
+func configure(w io.Writer, level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// requestLog holds the request scoped logger, enriched by handlers as they
+// learn more about the request
+type requestLog struct {
+	mu     sync.Mutex
+	base   *slog.Logger
+	logger *slog.Logger
+	attrs  []slog.Attr
+}
+
+type contextKey struct{}
+
+func newRequestLog(id string) *requestLog {
+	base := slog.Default().With(slog.String("request_id", id))
+	return &requestLog{base: base, logger: base}
+}
+
+// add sets fields on the request's logger, replacing earlier values of the same keys
+func (rl *requestLog) add(attrs ...slog.Attr) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, attr := range attrs {
+		replaced := false
+		for i := range rl.attrs {
+			if rl.attrs[i].Key == attr.Key {
+				rl.attrs[i] = attr
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			rl.attrs = append(rl.attrs, attr)
+		}
+	}
+
+	args := make([]any, len(rl.attrs))
+	for i, attr := range rl.attrs {
+		args[i] = attr
+	}
+	rl.logger = rl.base.With(args...)
+}
+
+func (rl *requestLog) snapshot() (*slog.Logger, []slog.Attr) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.logger, append([]slog.Attr(nil), rl.attrs...)
+}
+
+// FromContext returns the logger of the request ctx belongs to, carrying its
+// request ID, trace ID and annotations, or the default logger outside a request
+func FromContext(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if rl, ok := ctx.Value(contextKey{}).(*requestLog); ok {
+		logger, _ = rl.snapshot()
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.With(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return logger
+}
@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+// redacted replaces secrets in logged URLs
+const redacted = "REDACTED"
+
+// sensitiveParams are query parameters carrying signatures, tokens or keys,
+// ours as well as common CDN ones
+var sensitiveParams = map[string]bool{
+	"sig":                  true,
+	"signature":            true,
+	"token":                true,
+	"auth":                 true,
+	"key":                  true,
+	"hdnts":                true,
+	"hmac":                 true,
+	"policy":               true,
+	"key-pair-id":          true,
+	"x-amz-signature":      true,
+	"x-amz-credential":     true,
+	"x-amz-security-token": true,
+}
+
+// nestedURLParams hold URLs that are redacted in turn
+var nestedURLParams = map[string]bool{
+	"url":    true,
+	"mirror": true,
+}
+
+// RedactURL strips credentials, signatures and tokens from a URL before it is
+// logged, including from upstream URLs nested in proxy links
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redacted
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	u.Path = RedactPath(u.Path)
+	u.RawPath = ""
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name, values := range query {
+			lower := strings.ToLower(name)
+			for i, value := range values {
+				switch {
+				case sensitiveParams[lower]:
+					values[i] = redacted
+				case nestedURLParams[lower]:
+					values[i] = RedactURL(value)
+				}
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// RedactPath hides the token of /s/{token} links
+func RedactPath(path string) string {
+	if strings.HasPrefix(path, "/s/") && len(path) > len("/s/") {
+		return "/s/" + redacted
+	}
+	return path
+}
+
+// ErrorAttr logs err under "error" with the URLs of failed HTTP requests redacted
+func ErrorAttr(err error) slog.Attr {
+	return slog.String("error", RedactError(err))
+}
+
+// RedactError returns the message of err with the URLs of failed HTTP requests redacted
+func RedactError(err error) string {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.URL != "" {
+		msg = strings.ReplaceAll(msg, urlErr.URL, RedactURL(urlErr.URL))
+	}
+	return msg
+}
@@ -0,0 +1,282 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/security"
+	"github.com/dovakiin0/proxy-m3u8/internal/streaming"
+	"github.com/dovakiin0/proxy-m3u8/internal/utils"
+)
+
+// Request kinds used as the kind label
+const (
+	KindPlaylist = "playlist"
+	KindSegment  = "segment"
+	KindStatic   = "static"
+	KindUnknown  = "unknown" // Rejected before the target was classified
+)
+
+// kindContextKey holds the kind a handler classified its request as
+const kindContextKey = "metricsKind"
+
+// Registry holds every proxy metric plus Go runtime and process stats
+var Registry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Proxied requests by kind and response status.",
+	}, []string{"kind", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_request_duration_seconds",
+		Help:    "Time to serve a proxied request, including streaming the body.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"kind"})
+
+	upstreamTTFB = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_upstream_ttfb_seconds",
+		Help:    "Time until the upstream response headers arrived.",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"kind"})
+
+	responseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_response_bytes_total",
+		Help: "Body bytes sent to clients.",
+	}, []string{"kind"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_errors_total",
+		Help: "Failed upstream fetches by error class.",
+	}, []string{"class"})
+
+	inFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_requests_in_flight",
+		Help: "Proxied requests currently being served.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		upstreamTTFB,
+		responseBytes,
+		upstreamErrors,
+		inFlight,
+		cacheCollector{},
+		upstreamCollector{},
+		eventsCollector{},
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+}
+
+// Middleware records count, duration, status and bytes of every request it wraps
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			inFlight.Inc()
+			defer inFlight.Dec()
+
+			start := time.Now()
+			err := next(c)
+
+			status := c.Response().Status
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			}
+
+			kind := kindOf(c)
+			requestsTotal.WithLabelValues(kind, strconv.Itoa(status)).Inc()
+			requestDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+			responseBytes.WithLabelValues(kind).Add(float64(c.Response().Size))
+			return err
+		}
+	}
+}
+
+// SetKind classifies the current request
+func SetKind(c echo.Context, kind string) {
+	c.Set(kindContextKey, kind)
+}
+
+func kindOf(c echo.Context) string {
+	if kind, ok := c.Get(kindContextKey).(string); ok {
+		return kind
+	}
+	return KindUnknown
+}
+
+// ObserveTTFB records how long the upstream took to send response headers
+func ObserveTTFB(kind string, ttfb time.Duration) {
+	upstreamTTFB.WithLabelValues(kind).Observe(ttfb.Seconds())
+}
+
+// ObserveUpstreamError counts a failed upstream fetch
+func ObserveUpstreamError(err error) {
+	upstreamErrors.WithLabelValues(ErrorClass(err)).Inc()
+}
+
+// ObserveUpstreamStatus counts an upstream error response
+func ObserveUpstreamStatus(status int) {
+	switch {
+	case status >= 500:
+		upstreamErrors.WithLabelValues("http_5xx").Inc()
+	case status >= 400:
+		upstreamErrors.WithLabelValues("http_4xx").Inc()
+	}
+}
+
+// ErrorClass maps an upstream error onto a small set of label values
+func ErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var tlsErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, security.ErrDestinationDenied):
+		return "denied"
+	case errors.Is(err, utils.ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &tlsErr), errors.As(err, &recordErr):
+		return "tls"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return "connection_reset"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// cacheCollector reports the segment cache tiers at scrape time
+type cacheCollector struct{}
+
+var (
+	cacheEntriesDesc   = prometheus.NewDesc("proxy_cache_entries", "Entries held by a cache tier.", []string{"tier"}, nil)
+	cacheBytesDesc     = prometheus.NewDesc("proxy_cache_bytes", "Bytes held by a cache tier.", []string{"tier"}, nil)
+	cacheMaxBytesDesc  = prometheus.NewDesc("proxy_cache_max_bytes", "Byte budget of a cache tier.", []string{"tier"}, nil)
+	cacheHitsDesc      = prometheus.NewDesc("proxy_cache_hits_total", "Cache lookups answered by a tier.", []string{"tier"}, nil)
+	cacheMissesDesc    = prometheus.NewDesc("proxy_cache_misses_total", "Cache lookups a tier couldn't answer.", []string{"tier"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("proxy_cache_evictions_total", "Entries evicted from a tier to stay within budget.", []string{"tier"}, nil)
+	cacheHitRatioDesc  = prometheus.NewDesc("proxy_cache_hit_ratio", "Share of lookups answered by a tier since start.", []string{"tier"}, nil)
+	cacheDroppedDesc   = prometheus.NewDesc("proxy_cache_dropped_writes_total", "Entries not written to the disk tier because its write queue was full.", nil, nil)
+)
+
+func (cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{cacheEntriesDesc, cacheBytesDesc, cacheMaxBytesDesc,
+		cacheHitsDesc, cacheMissesDesc, cacheEvictionsDesc, cacheHitRatioDesc, cacheDroppedDesc} {
+		ch <- desc
+	}
+}
+
+func (cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := utils.GetSegmentCache().Stats()
+	collectCacheTier(ch, "memory", stats)
+	if stats.Disk != nil {
+		collectCacheTier(ch, "disk", *stats.Disk)
+		ch <- prometheus.MustNewConstMetric(cacheDroppedDesc, prometheus.CounterValue, float64(stats.Disk.DroppedWrites))
+	}
+}
+
+func collectCacheTier(ch chan<- prometheus.Metric, tier string, stats utils.CacheStats) {
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries), tier)
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(stats.Bytes), tier)
+	ch <- prometheus.MustNewConstMetric(cacheMaxBytesDesc, prometheus.GaugeValue, float64(stats.MaxBytes), tier)
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits), tier)
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses), tier)
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions), tier)
+
+	ratio := 0.0
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		ratio = float64(stats.Hits) / float64(lookups)
+	}
+	ch <- prometheus.MustNewConstMetric(cacheHitRatioDesc, prometheus.GaugeValue, ratio, tier)
+}
+
+// upstreamCollector reports coalescing and circuit breakers at scrape time
+type upstreamCollector struct{}
+
+var (
+	coalescedFetchesDesc = prometheus.NewDesc("proxy_upstream_fetches_total", "Upstream fetches started by the coalescer.", nil, nil)
+	coalescedSharedDesc  = prometheus.NewDesc("proxy_upstream_coalesced_total", "Requests that shared an in-flight upstream fetch.", nil, nil)
+	breakersDesc         = prometheus.NewDesc("proxy_upstream_breakers", "Upstream hosts whose circuit breaker is open or half-open.", []string{"state"}, nil)
+)
+
+func (upstreamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- coalescedFetchesDesc
+	ch <- coalescedSharedDesc
+	ch <- breakersDesc
+}
+
+func (upstreamCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := utils.UpstreamCoalescer.Stats()
+	ch <- prometheus.MustNewConstMetric(coalescedFetchesDesc, prometheus.CounterValue, float64(stats.Fetches))
+	ch <- prometheus.MustNewConstMetric(coalescedSharedDesc, prometheus.CounterValue, float64(stats.Shared))
+
+	counts := map[utils.BreakerState]int{utils.BreakerOpen: 0, utils.BreakerHalfOpen: 0}
+	for _, state := range utils.GetCircuitBreakers().States() {
+		counts[state]++
+	}
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(breakersDesc, prometheus.GaugeValue, float64(count), string(state))
+	}
+}
+
+// eventStats reports the streaming metrics pipeline, nil while it is disabled
+var eventStats func() streaming.PipelineStats
+
+// WatchEventPipeline exports the counters of the streaming metrics pipeline
+func WatchEventPipeline(stats func() streaming.PipelineStats) {
+	eventStats = stats
+}
+
+// eventsCollector reports the streaming metrics pipeline at scrape time
+type eventsCollector struct{}
+
+var (
+	eventsDesc         = prometheus.NewDesc("proxy_events_total", "Streaming metrics events by outcome.", []string{"result"}, nil)
+	eventsBufferedDesc = prometheus.NewDesc("proxy_events_buffered", "Events waiting to be handed to the producer.", nil, nil)
+)
+
+func (eventsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- eventsDesc
+	ch <- eventsBufferedDesc
+}
+
+func (eventsCollector) Collect(ch chan<- prometheus.Metric) {
+	if eventStats == nil {
+		return
+	}
+	stats := eventStats()
+	ch <- prometheus.MustNewConstMetric(eventsDesc, prometheus.CounterValue, float64(stats.Enqueued), "enqueued")
+	ch <- prometheus.MustNewConstMetric(eventsDesc, prometheus.CounterValue, float64(stats.Dropped), "dropped")
+	ch <- prometheus.MustNewConstMetric(eventsDesc, prometheus.CounterValue, float64(stats.Delivered), "delivered")
+	ch <- prometheus.MustNewConstMetric(eventsDesc, prometheus.CounterValue, float64(stats.Failed), "failed")
+	ch <- prometheus.MustNewConstMetric(eventsBufferedDesc, prometheus.GaugeValue, float64(stats.Buffered))
+}
@@ -0,0 +1,257 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Rate is a token bucket: PerSecond tokens are added up to Burst. A zero PerSecond disables the limit.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// RateBudget holds separate rates for playlist and segment requests, since a
+// player fetches many segments for every playlist. Every request is charged to
+// the segment rate up front; requests the handler takes for playlists, by their
+// URL before fetching or by their content after, are charged to the playlist rate
+// as well (see ChargePlaylist).
+type RateBudget struct {
+	Playlist Rate
+	Segment  Rate
+}
+
+// RateLimitTarget describes a proxied request for rate limiting
+type RateLimitTarget struct {
+	Session      string
+	UpstreamHost string
+}
+
+type RateLimitConfig struct {
+	IP      RateBudget // Per client IP
+	Session RateBudget // Per session within a client IP, sessions are chosen by clients
+	Host    RateBudget // Per upstream host, shared by all clients
+
+	// Describe classifies a request; requests it returns false for aren't limited
+	Describe func(c echo.Context) (RateLimitTarget, bool)
+
+	// Buckets unused for this long are dropped
+	IdleTimeout time.Duration
+}
+
+// RateLimiter enforces token bucket limits by client IP, session and upstream host
+type RateLimiter struct {
+	config RateLimitConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	stats   map[string]*rateScopeCounters
+}
+
+type tokenBucket struct {
+	scope    string
+	tokens   float64
+	rate     Rate
+	lastSeen time.Time
+}
+
+// rateLimitChargeKey holds a request's pending playlist charge in the Echo context
+const rateLimitChargeKey = "rateLimitCharge"
+
+// playlistCharge is what ChargePlaylist needs to charge a request after the fact
+type playlistCharge struct {
+	rl      *RateLimiter
+	ip      string
+	target  RateLimitTarget
+	charged bool
+}
+
+type rateScopeCounters struct {
+	allowed int64
+	limited int64
+}
+
+// RateScopeStats is the limit state of one scope, e.g. "ip/segment"
+type RateScopeStats struct {
+	Buckets   int   `json:"buckets"`
+	Throttled int   `json:"throttled"` // Buckets currently out of tokens
+	Allowed   int64 `json:"allowed"`
+	Limited   int64 `json:"limited"`
+}
+
+// NewRateLimiter creates a rate limiter and starts dropping idle buckets
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = 10 * time.Minute
+	}
+	rl := &RateLimiter{
+		config:  config,
+		buckets: make(map[string]*tokenBucket),
+		stats:   make(map[string]*rateScopeCounters),
+	}
+	go rl.cleanupLoop()
+	return rl
+}
+
+// Middleware returns the Echo middleware answering over-limit requests with 429 and Retry-After
+func (rl *RateLimiter) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if rl.config.Describe == nil {
+				return next(c)
+			}
+			target, ok := rl.config.Describe(c)
+			if !ok {
+				return next(c)
+			}
+
+			ip := c.RealIP()
+			if wait := rl.take(ip, target, false); wait > 0 {
+				return RateLimited(c, wait)
+			}
+			c.Set(rateLimitChargeKey, &playlistCharge{rl: rl, ip: ip, target: target})
+			return next(c)
+		}
+	}
+}
+
+// ChargePlaylist charges a request the handler recognised as a playlist to the
+// playlist rates. It returns how long the client has to wait if one of them is
+// exhausted, zero otherwise or if the request isn't rate limited.
+func ChargePlaylist(c echo.Context) time.Duration {
+	charge, ok := c.Get(rateLimitChargeKey).(*playlistCharge)
+	if !ok || charge.charged {
+		return 0
+	}
+	charge.charged = true
+	return charge.rl.take(charge.ip, charge.target, true)
+}
+
+// RateLimited answers an over-limit request with 429 and Retry-After
+func RateLimited(c echo.Context, wait time.Duration) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	return c.String(http.StatusTooManyRequests, "Rate limit exceeded")
+}
+
+// take consumes a token from every bucket the request falls into. If any bucket
+// is empty nothing is consumed and the time until it refills is returned.
+func (rl *RateLimiter) take(ip string, target RateLimitTarget, playlist bool) time.Duration {
+	class := "segment"
+	if playlist {
+		class = "playlist"
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	var buckets []*tokenBucket
+	add := func(scope string, budget RateBudget, key string) {
+		rate := budget.Segment
+		if playlist {
+			rate = budget.Playlist
+		}
+		if rate.PerSecond <= 0 || key == "" {
+			return
+		}
+		buckets = append(buckets, rl.bucketLocked(scope+"/"+class, key, rate, now))
+	}
+	add("ip", rl.config.IP, ip)
+	if target.Session != "" {
+		// Rotating the session doesn't get a client past its IP's limits
+		add("session", rl.config.Session, ip+"|"+target.Session)
+	}
+	add("host", rl.config.Host, target.UpstreamHost)
+
+	var wait time.Duration
+	var denied *tokenBucket
+	for _, b := range buckets {
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) / b.rate.PerSecond * float64(time.Second)); w > wait {
+				wait, denied = w, b
+			}
+		}
+	}
+
+	if denied != nil {
+		rl.countersLocked(denied.scope).limited++
+		return wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+		rl.countersLocked(b.scope).allowed++
+	}
+	return 0
+}
+
+// bucketLocked returns the refilled bucket for a key; the caller must hold the lock
+func (rl *RateLimiter) bucketLocked(scope, key string, rate Rate, now time.Time) *tokenBucket {
+	burst := float64(max(rate.Burst, 1))
+	id := scope + "|" + key
+	b, exists := rl.buckets[id]
+	if !exists {
+		b = &tokenBucket{scope: scope, tokens: burst, rate: rate, lastSeen: now}
+		rl.buckets[id] = b
+		return b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.lastSeen).Seconds()*rate.PerSecond)
+	b.lastSeen = now
+	return b
+}
+
+func (rl *RateLimiter) countersLocked(scope string) *rateScopeCounters {
+	counters, exists := rl.stats[scope]
+	if !exists {
+		counters = &rateScopeCounters{}
+		rl.stats[scope] = counters
+	}
+	return counters
+}
+
+// Stats returns the limit state per scope
+func (rl *RateLimiter) Stats() map[string]RateScopeStats {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	stats := make(map[string]RateScopeStats)
+	for scope, counters := range rl.stats {
+		stats[scope] = RateScopeStats{Allowed: counters.allowed, Limited: counters.limited}
+	}
+	for _, b := range rl.buckets {
+		s := stats[b.scope]
+		s.Buckets++
+		if b.tokens+now.Sub(b.lastSeen).Seconds()*b.rate.PerSecond < 1 {
+			s.Throttled++
+		}
+		stats[b.scope] = s
+	}
+	return stats
+}
+
+// StatsHandler serves Stats as JSON
+func (rl *RateLimiter) StatsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, rl.Stats())
+}
+
+// cleanupLoop drops buckets that have been idle long enough to be full again
+func (rl *RateLimiter) cleanupLoop() {
+	ticker := time.NewTicker(rl.config.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rl.mu.Lock()
+		for id, b := range rl.buckets {
+			if time.Since(b.lastSeen) > rl.config.IdleTimeout {
+				delete(rl.buckets, id)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
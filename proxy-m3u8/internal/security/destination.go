@@ -0,0 +1,248 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrDestinationDenied is wrapped by every error returned for a forbidden destination
+var ErrDestinationDenied = errors.New("destination not allowed")
+
+// Address ranges a proxied request must never reach: loopback, RFC 1918 and
+// unique-local networks, link-local (including cloud metadata at 169.254.169.254),
+// carrier-grade NAT, multicast and other special-purpose blocks. 6to4 and Teredo
+// addresses embed an IPv4 address that could be private, so both are blocked whole.
+var blockedPrefixes = mustParsePrefixes(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001::/32",
+	"2001:db8::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// DestinationConfig configures a DestinationPolicy
+type DestinationConfig struct {
+	AllowedSchemes []string // Defaults to http and https
+	AllowedPorts   []int    // Defaults to 80 and 443
+	AllowHosts     []string // When set, only these hosts (and their subdomains) may be reached
+	DenyHosts      []string // Hosts (and their subdomains) that may never be reached
+	AllowPrivate   bool     // Permit private and loopback addresses, for local development only
+}
+
+// DestinationPolicy decides which upstream URLs and addresses the proxy may fetch
+type DestinationPolicy struct {
+	schemes      map[string]bool
+	ports        map[int]bool
+	allowHosts   []string
+	denyHosts    []string
+	allowPrivate bool
+	lookupNetIP  func(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// NewDestinationPolicy creates a policy from its configuration
+func NewDestinationPolicy(cfg DestinationConfig) *DestinationPolicy {
+	schemes := cfg.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	ports := cfg.AllowedPorts
+	if len(ports) == 0 {
+		ports = []int{80, 443}
+	}
+
+	p := &DestinationPolicy{
+		schemes:      make(map[string]bool),
+		ports:        make(map[int]bool),
+		allowHosts:   normalizeHosts(cfg.AllowHosts),
+		denyHosts:    normalizeHosts(cfg.DenyHosts),
+		allowPrivate: cfg.AllowPrivate,
+		lookupNetIP:  net.DefaultResolver.LookupNetIP,
+	}
+	for _, scheme := range schemes {
+		p.schemes[strings.ToLower(strings.TrimSpace(scheme))] = true
+	}
+	for _, port := range ports {
+		p.ports[port] = true
+	}
+	return p
+}
+
+// CheckURL validates scheme, port and host lists of a URL without resolving it.
+// Literal IP hosts are checked against the blocked ranges right away.
+func (p *DestinationPolicy) CheckURL(u *url.URL) error {
+	if !p.schemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("%w: scheme %q", ErrDestinationDenied, u.Scheme)
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrDestinationDenied)
+	}
+
+	port, err := urlPort(u)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDestinationDenied, err)
+	}
+	if !p.ports[port] {
+		return fmt.Errorf("%w: port %d", ErrDestinationDenied, port)
+	}
+
+	if err := p.checkHost(host); err != nil {
+		return err
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.CheckAddr(addr)
+	}
+	return nil
+}
+
+// CheckAddr rejects addresses in the blocked ranges
+func (p *DestinationPolicy) CheckAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if p.allowPrivate {
+		return nil
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("%w: address %s is in %s", ErrDestinationDenied, addr, prefix)
+		}
+	}
+	return nil
+}
+
+// DialContext wraps a dialer so that the host is resolved exactly once, every
+// resolved address is checked, and the connection goes to a checked address.
+// This closes the DNS rebinding gap between validating a URL and connecting.
+func (p *DestinationPolicy) DialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if err := p.checkHost(host); err != nil {
+			return nil, err
+		}
+
+		addrs, err := p.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, addr := range addrs {
+			if err := p.CheckAddr(addr); err != nil {
+				// One bad record poisons the whole name
+				return nil, err
+			}
+		}
+		for _, addr := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+func (p *DestinationPolicy) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	addrs, err := p.lookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	return addrs, nil
+}
+
+// checkHost applies the allow and deny lists
+func (p *DestinationPolicy) checkHost(host string) error {
+	for _, denied := range p.denyHosts {
+		if matchHost(host, denied) {
+			return fmt.Errorf("%w: host %s is denied", ErrDestinationDenied, host)
+		}
+	}
+	if len(p.allowHosts) == 0 {
+		return nil
+	}
+	for _, allowed := range p.allowHosts {
+		if matchHost(host, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %s is not allowlisted", ErrDestinationDenied, host)
+}
+
+// matchHost matches a host against a pattern, including subdomains of the pattern
+func matchHost(host, pattern string) bool {
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+func normalizeHosts(hosts []string) []string {
+	var normalized []string
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		host = strings.TrimPrefix(host, "*.")
+		host = strings.TrimSuffix(host, ".")
+		if host != "" {
+			normalized = append(normalized, host)
+		}
+	}
+	return normalized
+}
+
+func urlPort(u *url.URL) (int, error) {
+	if portStr := u.Port(); portStr != "" {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			return 0, fmt.Errorf("invalid port %q", portStr)
+		}
+		return port, nil
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		return 443, nil
+	default:
+		return 80, nil
+	}
+}
+
+func mustParsePrefixes(prefixes ...string) []netip.Prefix {
+	parsed := make([]netip.Prefix, len(prefixes))
+	for i, prefix := range prefixes {
+		parsed[i] = netip.MustParsePrefix(prefix)
+	}
+	return parsed
+}
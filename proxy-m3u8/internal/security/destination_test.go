@@ -0,0 +1,181 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestDestinationPolicyCheckURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     DestinationConfig
+		url     string
+		allowed bool
+	}{
+		{name: "https", url: "https://cdn.example.com/master.m3u8", allowed: true},
+		{name: "http", url: "http://cdn.example.com/master.m3u8", allowed: true},
+		{name: "explicit default port", url: "https://cdn.example.com:443/master.m3u8", allowed: true},
+		{name: "other scheme", url: "ftp://cdn.example.com/master.m3u8"},
+		{name: "missing host", url: "https:///master.m3u8"},
+		{name: "port outside the defaults", url: "https://cdn.example.com:8443/master.m3u8"},
+		{name: "ssh port", url: "http://cdn.example.com:22/"},
+		{name: "invalid port", url: "http://cdn.example.com:99999/"},
+		{name: "widened ports", cfg: DestinationConfig{AllowedPorts: []int{443, 8443}}, url: "https://cdn.example.com:8443/master.m3u8", allowed: true},
+		{name: "widened ports replace the defaults", cfg: DestinationConfig{AllowedPorts: []int{8443}}, url: "http://cdn.example.com/master.m3u8"},
+		{name: "loopback literal", url: "http://127.0.0.1/"},
+		{name: "metadata literal", url: "http://169.254.169.254/latest/meta-data/"},
+		{name: "ipv6 loopback literal", url: "http://[::1]/"},
+		{name: "ipv4-mapped loopback literal", url: "http://[::ffff:127.0.0.1]/"},
+		{name: "public literal", url: "http://93.184.216.34/", allowed: true},
+		{name: "private literal allowed", cfg: DestinationConfig{AllowPrivate: true}, url: "http://10.0.0.1/", allowed: true},
+		{name: "denied host", cfg: DestinationConfig{DenyHosts: []string{"example.com"}}, url: "https://cdn.example.com/"},
+		{name: "denied host with trailing dot", cfg: DestinationConfig{DenyHosts: []string{"example.com"}}, url: "https://cdn.example.com./"},
+		{name: "allowlisted subdomain", cfg: DestinationConfig{AllowHosts: []string{"*.example.com"}}, url: "https://cdn.example.com/", allowed: true},
+		{name: "not allowlisted", cfg: DestinationConfig{AllowHosts: []string{"example.com"}}, url: "https://example.org/"},
+		{name: "allowlist suffix is not a subdomain", cfg: DestinationConfig{AllowHosts: []string{"example.com"}}, url: "https://badexample.com/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = NewDestinationPolicy(tt.cfg).CheckURL(u)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Fatalf("CheckURL(%s) = %v, want allowed %v", tt.url, err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrDestinationDenied) {
+				t.Errorf("CheckURL(%s) = %v, want it to wrap ErrDestinationDenied", tt.url, err)
+			}
+		})
+	}
+}
+
+func TestDestinationPolicyCheckAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{addr: "93.184.216.34", allowed: true},
+		{addr: "2606:2800:220:1:248:1893:25c8:1946", allowed: true},
+		{addr: "127.0.0.1"},
+		{addr: "10.1.2.3"},
+		{addr: "172.16.0.1"},
+		{addr: "192.168.1.1"},
+		{addr: "100.64.0.1"},
+		{addr: "169.254.169.254"},
+		{addr: "0.0.0.0"},
+		{addr: "224.0.0.1"},
+		{addr: "::"},
+		{addr: "::1"},
+		{addr: "fe80::1"},
+		{addr: "fd00::1"},
+		{addr: "::ffff:127.0.0.1"},
+		{addr: "::ffff:169.254.169.254"},
+		{addr: "::ffff:93.184.216.34", allowed: true},
+		{addr: "64:ff9b::7f00:1"},
+		{addr: "2002:7f00:1::1"},
+		{addr: "2001:0:4136:e378:8000:63bf:80ff:fffe"},
+	}
+
+	policy := NewDestinationPolicy(DestinationConfig{})
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := policy.CheckAddr(netip.MustParseAddr(tt.addr))
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("CheckAddr(%s) = %v, want allowed %v", tt.addr, err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestDestinationPolicyDialContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	// The test server listens on loopback, which only AllowPrivate may reach
+	lookup := func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		switch host {
+		case "internal.example.com":
+			return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+		case "mixed.example.com":
+			return []netip.Addr{netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("127.0.0.1")}, nil
+		case "mapped.example.com":
+			return []netip.Addr{netip.MustParseAddr("::ffff:127.0.0.1")}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	tests := []struct {
+		name    string
+		cfg     DestinationConfig
+		host    string
+		denied  bool // Rejected by the policy rather than failing to connect
+		connect bool
+	}{
+		{name: "name resolving to a private address", host: "internal.example.com", denied: true},
+		{name: "one private record among public ones", host: "mixed.example.com", denied: true},
+		{name: "name resolving to an ipv4-mapped address", host: "mapped.example.com", denied: true},
+		{name: "private literal", host: "127.0.0.1", denied: true},
+		{name: "denied host", cfg: DestinationConfig{DenyHosts: []string{"example.com"}, AllowPrivate: true}, host: "internal.example.com", denied: true},
+		{name: "unknown name", host: "missing.example.com"},
+		{name: "private allowed", cfg: DestinationConfig{AllowPrivate: true}, host: "internal.example.com", connect: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := NewDestinationPolicy(tt.cfg)
+			policy.lookupNetIP = lookup
+
+			dial := policy.DialContext(&net.Dialer{})
+			conn, err := dial(context.Background(), "tcp", net.JoinHostPort(tt.host, port))
+			if conn != nil {
+				conn.Close()
+			}
+			if connected := err == nil; connected != tt.connect {
+				t.Fatalf("dial %s = %v, want connected %v", tt.host, err, tt.connect)
+			}
+			if denied := errors.Is(err, ErrDestinationDenied); denied != tt.denied {
+				t.Errorf("dial %s = %v, want denied %v", tt.host, err, tt.denied)
+			}
+		})
+	}
+}
+
+func TestDestinationPolicyDialsCheckedAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	// The name is resolved once, the connection goes to the checked address
+	var lookups int
+	policy := NewDestinationPolicy(DestinationConfig{AllowedPorts: []int{portNum}, AllowPrivate: true})
+	policy.lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		lookups++
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+	}
+	client := &http.Client{Transport: &http.Transport{DialContext: policy.DialContext(&net.Dialer{})}}
+
+	target, _ := url.Parse("http://stream.example.com:" + port + "/")
+	if err := policy.CheckURL(target); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if lookups != 1 {
+		t.Errorf("lookups = %d, want 1", lookups)
+	}
+}
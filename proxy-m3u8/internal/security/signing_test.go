@@ -0,0 +1,92 @@
+package security
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignerVerify(t *testing.T) {
+	signer := NewSigner([]byte("secret"), time.Hour)
+	fields := SignedFields{
+		URL:     "https://cdn.example.com/master.m3u8",
+		Referer: "https://example.com/",
+		Profile: "default",
+		Session: "abc",
+		Mirrors: []string{"https://cdn2.example.com"},
+	}
+	exp, sig := signer.Sign(fields)
+	expParam := strconv.FormatInt(exp, 10)
+
+	tampered := func(edit func(*SignedFields)) SignedFields {
+		f := fields
+		f.Mirrors = append([]string(nil), fields.Mirrors...)
+		edit(&f)
+		return f
+	}
+	past := time.Now().Add(-time.Minute).Unix()
+
+	tests := []struct {
+		name     string
+		signer   *Signer
+		fields   SignedFields
+		expParam string
+		sig      string
+		want     error
+	}{
+		{name: "valid", fields: fields, expParam: expParam, sig: sig},
+		{name: "missing signature", fields: fields, expParam: expParam, want: ErrSignatureMissing},
+		{name: "missing expiry", fields: fields, sig: sig, want: ErrSignatureMissing},
+		{name: "malformed expiry", fields: fields, expParam: "soon", sig: sig, want: ErrSignatureInvalid},
+		{name: "malformed signature", fields: fields, expParam: expParam, sig: "!!", want: ErrSignatureInvalid},
+		{name: "extended expiry", fields: fields, expParam: strconv.FormatInt(exp+3600, 10), sig: sig, want: ErrSignatureInvalid},
+		{name: "wrong key", signer: NewSigner([]byte("other"), time.Hour), fields: fields, expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "tampered url", fields: tampered(func(f *SignedFields) { f.URL = "https://evil.example.com/master.m3u8" }), expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "tampered referer", fields: tampered(func(f *SignedFields) { f.Referer = "" }), expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "tampered profile", fields: tampered(func(f *SignedFields) { f.Profile = "browser" }), expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "tampered session", fields: tampered(func(f *SignedFields) { f.Session = "xyz" }), expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "added mirror", fields: tampered(func(f *SignedFields) { f.Mirrors = append(f.Mirrors, "https://evil.example.com") }), expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "dropped mirror", fields: tampered(func(f *SignedFields) { f.Mirrors = nil }), expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "fields shifted between parameters", fields: tampered(func(f *SignedFields) { f.Profile, f.Session = f.Session, f.Profile }), expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "newline moved between fields", fields: tampered(func(f *SignedFields) { f.URL, f.Referer = f.URL+"\n"+f.Referer, "" }), expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "mirror moved into the session", fields: tampered(func(f *SignedFields) { f.Session, f.Mirrors = f.Session+"\n"+f.Mirrors[0], nil }), expParam: expParam, sig: sig, want: ErrSignatureInvalid},
+		{name: "expired", fields: fields, expParam: strconv.FormatInt(past, 10), sig: signer.SignWithExpiry(fields, past), want: ErrSignatureExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.signer
+			if s == nil {
+				s = signer
+			}
+			if err := s.Verify(tt.fields, tt.expParam, tt.sig); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiryAfter(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		step int64
+	}{
+		{ttl: 6 * time.Hour, step: 36 * 60},
+		{ttl: time.Minute, step: 6},
+		{ttl: 5 * time.Second, step: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ttl.String(), func(t *testing.T) {
+			earliest := time.Now().Add(tt.ttl).Unix()
+			exp := ExpiryAfter(tt.ttl)
+			if exp < earliest || exp > earliest+tt.step {
+				t.Errorf("ExpiryAfter = %d, want within [%d, %d]", exp, earliest, earliest+tt.step)
+			}
+			if exp%tt.step != 0 {
+				t.Errorf("ExpiryAfter = %d, want a multiple of %d", exp, tt.step)
+			}
+		})
+	}
+}
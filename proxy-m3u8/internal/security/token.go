@@ -0,0 +1,211 @@
+package security
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrTokenInvalid is returned for tokens that can't be decoded or authenticated
+var ErrTokenInvalid = errors.New("invalid stream token")
+
+// ErrTokenExpired is returned for tokens past their expiry
+var ErrTokenExpired = errors.New("stream token expired")
+
+const (
+	tokenVersion = 1
+
+	// Flags stored next to the version in the first payload byte
+	tokenFlagDeflate = 1 << 4
+
+	tokenMACSize = 16
+)
+
+// StreamToken is everything the proxy needs to fetch an upstream resource,
+// packed into an opaque URL path segment instead of url/referer query parameters
+type StreamToken struct {
+	URL     string
+	Referer string
+	Session string
+	Profile string   // Header profile used for the upstream request
+	Mirrors []string // Origins serving the same content as URL's origin
+	Expires int64    // Unix seconds, 0 for no expiry
+}
+
+// TokenCodec encodes stream tokens. With an encryption key tokens are sealed
+// with AES-256-GCM, hiding the upstream provider; with only a MAC key they are
+// readable but tamper-proof; with neither they are merely compact.
+type TokenCodec struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// NewTokenCodec creates a codec. Keys of any length are accepted; the encryption
+// key is stretched to 256 bits with SHA-256.
+func NewTokenCodec(encryptionKey, macKey []byte) (*TokenCodec, error) {
+	codec := &TokenCodec{macKey: macKey}
+	if len(encryptionKey) > 0 {
+		key := sha256.Sum256(encryptionKey)
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create token cipher: %w", err)
+		}
+		codec.aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create token cipher: %w", err)
+		}
+	}
+	return codec, nil
+}
+
+// Authenticated reports whether tokens can't be forged without a key
+func (tc *TokenCodec) Authenticated() bool {
+	return tc.aead != nil || len(tc.macKey) > 0
+}
+
+// Encode packs a token into a URL-safe string
+func (tc *TokenCodec) Encode(t StreamToken) (string, error) {
+	payload := marshalToken(t)
+
+	if tc.aead != nil {
+		nonce := make([]byte, tc.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", fmt.Errorf("failed to generate token nonce: %w", err)
+		}
+		sealed := tc.aead.Seal(nonce, nonce, payload, nil)
+		return base64.RawURLEncoding.EncodeToString(sealed), nil
+	}
+
+	if len(tc.macKey) > 0 {
+		payload = append(payload, tc.mac(payload)...)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload), nil
+}
+
+// Decode unpacks and authenticates a token and checks its expiry
+func (tc *TokenCodec) Decode(s string) (StreamToken, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return StreamToken{}, ErrTokenInvalid
+	}
+
+	var payload []byte
+	switch {
+	case tc.aead != nil:
+		nonceSize := tc.aead.NonceSize()
+		if len(raw) < nonceSize {
+			return StreamToken{}, ErrTokenInvalid
+		}
+		payload, err = tc.aead.Open(nil, raw[:nonceSize], raw[nonceSize:], nil)
+		if err != nil {
+			return StreamToken{}, ErrTokenInvalid
+		}
+	case len(tc.macKey) > 0:
+		if len(raw) < tokenMACSize {
+			return StreamToken{}, ErrTokenInvalid
+		}
+		payload = raw[:len(raw)-tokenMACSize]
+		if !hmac.Equal(raw[len(raw)-tokenMACSize:], tc.mac(payload)) {
+			return StreamToken{}, ErrTokenInvalid
+		}
+	default:
+		payload = raw
+	}
+
+	t, err := unmarshalToken(payload)
+	if err != nil {
+		return StreamToken{}, ErrTokenInvalid
+	}
+	if t.Expires > 0 && time.Now().Unix() > t.Expires {
+		return StreamToken{}, ErrTokenExpired
+	}
+	return t, nil
+}
+
+func (tc *TokenCodec) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, tc.macKey)
+	h.Write([]byte("token\n"))
+	h.Write(payload)
+	return h.Sum(nil)[:tokenMACSize]
+}
+
+// marshalToken lays out a token as a header byte, the expiry as a varint and the
+// string fields as length-prefixed bytes, mirrors last. The fields are deflated
+// when that is shorter.
+func marshalToken(t StreamToken) []byte {
+	var fields []byte
+	fields = binary.AppendUvarint(fields, uint64(max(t.Expires, 0)))
+	for _, field := range append([]string{t.URL, t.Referer, t.Session, t.Profile}, t.Mirrors...) {
+		fields = binary.AppendUvarint(fields, uint64(len(field)))
+		fields = append(fields, field...)
+	}
+
+	header := byte(tokenVersion)
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	w.Write(fields)
+	w.Close()
+	if compressed.Len() < len(fields) {
+		header |= tokenFlagDeflate
+		fields = compressed.Bytes()
+	}
+
+	return append([]byte{header}, fields...)
+}
+
+func unmarshalToken(payload []byte) (StreamToken, error) {
+	if len(payload) == 0 || payload[0]&0x0f != tokenVersion {
+		return StreamToken{}, ErrTokenInvalid
+	}
+
+	fields := payload[1:]
+	if payload[0]&tokenFlagDeflate != 0 {
+		// Bound the inflated size, tokens are never large
+		inflated, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(fields)), 64<<10))
+		if err != nil {
+			return StreamToken{}, err
+		}
+		fields = inflated
+	}
+
+	r := bytes.NewReader(fields)
+	expires, err := binary.ReadUvarint(r)
+	if err != nil {
+		return StreamToken{}, err
+	}
+
+	var values []string
+	for r.Len() > 0 {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return StreamToken{}, ErrTokenInvalid
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return StreamToken{}, err
+		}
+		values = append(values, string(buf))
+	}
+	if len(values) < 4 {
+		return StreamToken{}, ErrTokenInvalid
+	}
+
+	return StreamToken{
+		URL:     values[0],
+		Referer: values[1],
+		Session: values[2],
+		Profile: values[3],
+		Mirrors: values[4:],
+		Expires: int64(expires),
+	}, nil
+}
@@ -0,0 +1,123 @@
+package security
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCodecRoundTrip(t *testing.T) {
+	token := StreamToken{
+		URL:     "https://cdn.example.com/hls/" + strings.Repeat("segment/", 20) + "master.m3u8",
+		Referer: "https://example.com/",
+		Session: "abc",
+		Profile: "default",
+		Mirrors: []string{"https://cdn2.example.com", "https://cdn3.example.com"},
+		Expires: time.Now().Add(time.Hour).Unix(),
+	}
+
+	tests := []struct {
+		name          string
+		encKey        []byte
+		macKey        []byte
+		token         StreamToken
+		authenticated bool
+	}{
+		{name: "plain", token: token},
+		{name: "mac", macKey: []byte("mac"), token: token, authenticated: true},
+		{name: "encrypted", encKey: []byte("enc"), token: token, authenticated: true},
+		{name: "no expiry or mirrors", encKey: []byte("enc"), token: StreamToken{URL: "https://cdn.example.com/a.ts"}, authenticated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, err := NewTokenCodec(tt.encKey, tt.macKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec.Authenticated() != tt.authenticated {
+				t.Errorf("Authenticated = %v, want %v", codec.Authenticated(), tt.authenticated)
+			}
+
+			encoded, err := codec.Encode(tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := codec.Decode(encoded)
+			if err != nil {
+				t.Fatalf("Decode = %v", err)
+			}
+			if len(decoded.Mirrors) == 0 {
+				decoded.Mirrors = nil
+			}
+			if !reflect.DeepEqual(decoded, tt.token) {
+				t.Errorf("Decode = %+v, want %+v", decoded, tt.token)
+			}
+		})
+	}
+}
+
+func TestTokenCodecRejects(t *testing.T) {
+	token := StreamToken{URL: "https://cdn.example.com/master.m3u8", Referer: "https://example.com/"}
+	expired := token
+	expired.Expires = time.Now().Add(-time.Minute).Unix()
+
+	// flipLast changes the last byte of an encoded token, which holds the MAC or GCM tag
+	flipLast := func(s string) string {
+		raw, _ := base64.RawURLEncoding.DecodeString(s)
+		raw[len(raw)-1] ^= 1
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	tests := []struct {
+		name   string
+		encKey []byte
+		macKey []byte
+		// decode* select the codec decoding the token, defaulting to the encoding one
+		decodeEncKey []byte
+		decodeMACKey []byte
+		token        StreamToken
+		edit         func(string) string
+		want         error
+	}{
+		{name: "mac tampered", macKey: []byte("mac"), token: token, edit: flipLast, want: ErrTokenInvalid},
+		{name: "mac wrong key", macKey: []byte("mac"), decodeMACKey: []byte("other"), token: token, want: ErrTokenInvalid},
+		{name: "mac expired", macKey: []byte("mac"), token: expired, want: ErrTokenExpired},
+		{name: "encrypted tampered", encKey: []byte("enc"), token: token, edit: flipLast, want: ErrTokenInvalid},
+		{name: "encrypted wrong key", encKey: []byte("enc"), decodeEncKey: []byte("other"), token: token, want: ErrTokenInvalid},
+		{name: "encrypted expired", encKey: []byte("enc"), token: expired, want: ErrTokenExpired},
+		{name: "unsigned token to mac codec", decodeMACKey: []byte("mac"), token: token, want: ErrTokenInvalid},
+		{name: "plain expired", token: expired, want: ErrTokenExpired},
+		{name: "not base64", token: token, edit: func(string) string { return "!!" }, want: ErrTokenInvalid},
+		{name: "truncated", encKey: []byte("enc"), token: token, edit: func(s string) string { return s[:8] }, want: ErrTokenInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder, err := NewTokenCodec(tt.encKey, tt.macKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder := encoder
+			if tt.decodeEncKey != nil || tt.decodeMACKey != nil {
+				if decoder, err = NewTokenCodec(tt.decodeEncKey, tt.decodeMACKey); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			encoded, err := encoder.Encode(tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.edit != nil {
+				encoded = tt.edit(encoded)
+			}
+			if _, err := decoder.Decode(encoded); !errors.Is(err, tt.want) {
+				t.Errorf("Decode = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
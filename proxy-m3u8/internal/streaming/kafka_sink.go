@@ -0,0 +1,143 @@
+//go:build !nokafka
+
+package streaming
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// kafkaQueueFullWait bounds how long Write waits for room in the producer's queue
+const kafkaQueueFullWait = time.Second
+
+// KafkaConfig configures the Redpanda/Kafka sink
+type KafkaConfig struct {
+	Brokers       string
+	Topic         string
+	BatchMessages int
+	Linger        time.Duration
+	Compression   string // none, gzip, snappy, lz4 or zstd
+}
+
+// KafkaSink produces events to a Redpanda/Kafka topic and counts the delivery
+// reports as they arrive
+type KafkaSink struct {
+	producer   *kafka.Producer
+	topic      string
+	eventsDone chan struct{}
+
+	delivered atomic.Uint64
+	failed    atomic.Uint64
+	failures  logLimiter
+	health    sinkHealth
+}
+
+// NewKafkaSink connects a producer to the brokers
+func NewKafkaSink(cfg KafkaConfig) (*KafkaSink, error) {
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers":  cfg.Brokers,
+		"client.id":          "proxy-m3u8",
+		"acks":               "all",
+		"retries":            3,
+		"retry.backoff.ms":   100,
+		"linger.ms":          int(cfg.Linger.Milliseconds()),
+		"batch.num.messages": max(cfg.BatchMessages, 1),
+		"compression.type":   cfg.Compression,
+		// Delivery reports only need to say whether a message made it
+		"go.delivery.report.fields": "none",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
+	}
+
+	ks := &KafkaSink{
+		producer:   producer,
+		topic:      cfg.Topic,
+		eventsDone: make(chan struct{}),
+	}
+	go ks.deliveryReports()
+	return ks, nil
+}
+
+func (ks *KafkaSink) Name() string {
+	return SinkKafka
+}
+
+func (ks *KafkaSink) Write(key, value []byte) error {
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{
+			Topic:     &ks.topic,
+			Partition: kafka.PartitionAny,
+		},
+		Value: value,
+		Key:   key,
+	}
+
+	deadline := time.Now().Add(kafkaQueueFullWait)
+	for {
+		err := ks.producer.Produce(msg, nil)
+		if err == nil {
+			return nil
+		}
+
+		// The producer's own queue is full, wait for deliveries to make room
+		var kafkaErr kafka.Error
+		if !errors.As(err, &kafkaErr) || kafkaErr.Code() != kafka.ErrQueueFull || time.Now().After(deadline) {
+			return fmt.Errorf("failed to produce message: %w", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// deliveryReports counts the outcome of every produced message
+func (ks *KafkaSink) deliveryReports() {
+	defer close(ks.eventsDone)
+
+	for e := range ks.producer.Events() {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			ks.health.set(ev.TopicPartition.Error)
+			if ev.TopicPartition.Error != nil {
+				failed := ks.failed.Add(1)
+				if ks.failures.allow() {
+					slog.Warn("Kafka delivery failed", "error", ev.TopicPartition.Error, "failed_total", failed)
+				}
+			} else {
+				ks.delivered.Add(1)
+			}
+		case kafka.Error:
+			slog.Warn("Kafka producer error", "error", ev, "code", ev.Code().String())
+			// Other errors are retried by the producer and show up in delivery reports if they persist
+			if ev.IsFatal() || ev.Code() == kafka.ErrAllBrokersDown {
+				ks.health.set(ev)
+			}
+		}
+	}
+}
+
+func (ks *KafkaSink) Deliveries() (delivered, failed uint64) {
+	return ks.delivered.Load(), ks.failed.Load()
+}
+
+// Health reports the last delivery failure, or the brokers being unreachable, until
+// a message is delivered again
+func (ks *KafkaSink) Health() error {
+	return ks.health.get()
+}
+
+func (ks *KafkaSink) Close(timeout time.Duration) error {
+	remaining := ks.producer.Flush(int(timeout.Milliseconds()))
+	ks.producer.Close()
+	<-ks.eventsDone
+
+	if remaining > 0 {
+		ks.failed.Add(uint64(remaining))
+		return fmt.Errorf("%d events not delivered before the flush timeout", remaining)
+	}
+	return nil
+}
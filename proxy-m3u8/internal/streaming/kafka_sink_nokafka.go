@@ -0,0 +1,22 @@
+//go:build nokafka
+
+package streaming
+
+import (
+	"errors"
+	"time"
+)
+
+// KafkaConfig configures the Redpanda/Kafka sink
+type KafkaConfig struct {
+	Brokers       string
+	Topic         string
+	BatchMessages int
+	Linger        time.Duration
+	Compression   string
+}
+
+// NewKafkaSink is unavailable in builds without librdkafka (the nokafka tag)
+func NewKafkaSink(cfg KafkaConfig) (EventSink, error) {
+	return nil, errors.New("kafka event sink not included in this build (built with the nokafka tag)")
+}
@@ -2,16 +2,20 @@ package streaming
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
 )
 
 // ProxyRequestEvent represents a proxy request event
 type ProxyRequestEvent struct {
 	Timestamp    time.Time `json:"timestamp"`
+	Event        string    `json:"event"` // Always "proxy_request"
 	SessionID    string    `json:"session_id"`
 	TargetURL    string    `json:"target_url"`
 	Referer      string    `json:"referer"`
@@ -21,91 +25,284 @@ type ProxyRequestEvent struct {
 	ContentSize  int64     `json:"content_size"`
 	UserAgent    string    `json:"user_agent"`
 	Success      bool      `json:"success"`
+
+	Kind           string  `json:"kind"` // playlist, segment or static
+	UpstreamHost   string  `json:"upstream_host"`
+	CacheStatus    string  `json:"cache_status"` // hit or miss
+	TTFB           int64   `json:"ttfb_ms"`      // Until upstream response headers, 0 for cache hits
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ClientIPHash   string  `json:"client_ip_hash"`
+
+	// Where the request sits in its stream, when the playlists leading to it were served by this proxy
+	MasterURL         string  `json:"master_url,omitempty"`
+	PlaylistURL       string  `json:"playlist_url,omitempty"`
+	VariantBandwidth  int64   `json:"variant_bandwidth,omitempty"`
+	VariantResolution string  `json:"variant_resolution,omitempty"`
+	MediaSequence     *int64  `json:"media_sequence,omitempty"`
+	SegmentDuration   float64 `json:"segment_duration_s,omitempty"`
+	// The segment took longer to fetch than to play, the viewer is likely to stall
+	SlowDownload bool `json:"slow_download,omitempty"`
 }
 
-// StreamingMetrics handles Redpanda/Kafka integration
+// BreakerStateEvent records an upstream host's circuit breaker changing state
+type BreakerStateEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"` // Always "circuit_breaker"
+	Host      string    `json:"host"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+}
+
+// Overflow policies, applied when the event buffer is full
+const (
+	OverflowDrop  = "drop"  // Discard the event, requests are never slowed down
+	OverflowBlock = "block" // Wait up to BlockTimeout for room, then discard
+)
+
+// Config configures the event pipeline in front of a sink
+type Config struct {
+	BufferSize   int // Events held between the request path and the sink
+	Overflow     string
+	BlockTimeout time.Duration
+	FlushTimeout time.Duration // How long Close waits for buffered events to be delivered
+}
+
+// PipelineStats counts events passing through the pipeline since start
+type PipelineStats struct {
+	Sink      string `json:"sink"`
+	Enqueued  uint64 `json:"enqueued"`
+	Dropped   uint64 `json:"dropped"` // Buffer full or pipeline closed
+	Delivered uint64 `json:"delivered"`
+	Failed    uint64 `json:"failed"` // Rejected or not acknowledged by the sink
+	Buffered  int    `json:"buffered"`
+}
+
+// queuedEvent is a serialized event waiting for the sink
+type queuedEvent struct {
+	key   []byte
+	value []byte
+}
+
+// StreamingMetrics sends proxy events to an EventSink. Events are serialized on
+// the request path and handed to a bounded buffer; a background worker writes
+// them to the sink so a slow or unavailable sink never holds up requests.
 type StreamingMetrics struct {
-	producer *kafka.Producer
-	topic    string
-	enabled  bool
-}
-
-// NewStreamingMetrics creates a new streaming metrics client
-func NewStreamingMetrics(brokers, topic string) (*StreamingMetrics, error) {
-	producer, err := kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers": brokers,
-		"client.id":         "proxy-m3u8",
-		"acks":              "all",
-		"retries":           3,
-		"retry.backoff.ms":  100,
-	})
-	
-	if err != nil {
-		log.Printf("Failed to create Kafka producer: %v", err)
-		return &StreamingMetrics{enabled: false}, nil
-	}
-
-	// Delivery channel for events (optional, for debugging)
-	// deliveryChan := make(chan kafka.Event, 10000)
-	// producer.Events(deliveryChan)
-
-	// Optional: Uncomment for delivery event logging
-	// go func() {
-	// 	for e := range deliveryChan {
-	// 		switch ev := e.(type) {
-	// 		case *kafka.Message:
-	// 			if ev.TopicPartition.Error != nil {
-	// 				log.Printf("Delivery failed: %v", ev.TopicPartition.Error)
-	// 			}
-	// 		}
-	// 	}
-	// }()
-
-	return &StreamingMetrics{
-		producer: producer,
-		topic:    topic,
-		enabled:  true,
-	}, nil
-}
-
-// LogProxyRequest sends a proxy request event to Redpanda
+	sink    EventSink
+	enabled bool
+
+	overflow     string
+	blockTimeout time.Duration
+	flushTimeout time.Duration
+
+	// mu guards queue against being closed while events are added
+	mu         sync.RWMutex
+	closed     bool
+	queue      chan queuedEvent
+	stop       chan struct{} // Closed when buffered events are no longer worth waiting for
+	workerDone chan struct{}
+
+	enqueued atomic.Uint64
+	dropped  atomic.Uint64
+	written  atomic.Uint64
+	failed   atomic.Uint64
+	failures logLimiter
+}
+
+// NewStreamingMetrics starts a pipeline delivering events to sink
+func NewStreamingMetrics(sink EventSink, cfg Config) *StreamingMetrics {
+	switch cfg.Overflow {
+	case OverflowDrop, OverflowBlock:
+	default:
+		cfg.Overflow = OverflowDrop
+	}
+
+	sm := &StreamingMetrics{
+		sink:         sink,
+		enabled:      true,
+		overflow:     cfg.Overflow,
+		blockTimeout: cfg.BlockTimeout,
+		flushTimeout: cfg.FlushTimeout,
+		queue:        make(chan queuedEvent, max(cfg.BufferSize, 1)),
+		stop:         make(chan struct{}),
+		workerDone:   make(chan struct{}),
+	}
+	go sm.worker()
+	return sm
+}
+
+// LogProxyRequest sends a proxy request event to the sink
 func (sm *StreamingMetrics) LogProxyRequest(event *ProxyRequestEvent) error {
-	if !sm.enabled {
+	if !sm.IsEnabled() {
 		return nil
 	}
 
+	event.Event = "proxy_request"
+	return sm.produce([]byte(event.SessionID), event)
+}
+
+// LogSession sends a viewing session start or end to the sink
+func (sm *StreamingMetrics) LogSession(event *SessionEvent) error {
+	if !sm.IsEnabled() {
+		return nil
+	}
+	return sm.produce([]byte(event.SessionID), event)
+}
+
+// LogBreakerState sends a circuit breaker state change to the sink
+func (sm *StreamingMetrics) LogBreakerState(event *BreakerStateEvent) error {
+	if !sm.IsEnabled() {
+		return nil
+	}
+	event.Event = "circuit_breaker"
+	return sm.produce([]byte(event.Host), event)
+}
+
+// produce serializes an event and queues it for the sink. A full buffer
+// drops the event rather than failing the request it describes.
+func (sm *StreamingMetrics) produce(key []byte, event any) error {
 	// Serialize event to JSON
 	data, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("failed to marshal event: %w", err)
 	}
 
-	// Send to Redpanda
-	err = sm.producer.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{
-			Topic:     &sm.topic,
-			Partition: kafka.PartitionAny,
-		},
-		Value: data,
-		Key:   []byte(event.SessionID),
-	}, nil)
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if sm.closed {
+		sm.drop("pipeline closed")
+		return nil
+	}
 
-	if err != nil {
-		return fmt.Errorf("failed to produce message: %w", err)
+	queued := queuedEvent{key: key, value: data}
+	select {
+	case sm.queue <- queued:
+		sm.enqueued.Add(1)
+		return nil
+	default:
+	}
+
+	if sm.overflow == OverflowBlock && sm.blockTimeout > 0 {
+		timer := time.NewTimer(sm.blockTimeout)
+		defer timer.Stop()
+		select {
+		case sm.queue <- queued:
+			sm.enqueued.Add(1)
+			return nil
+		case <-timer.C:
+		}
 	}
 
+	sm.drop("buffer full")
 	return nil
 }
 
-// Close shuts down the streaming metrics client
+// worker hands buffered events to the sink until the buffer is closed
+func (sm *StreamingMetrics) worker() {
+	defer close(sm.workerDone)
+
+	for event := range sm.queue {
+		select {
+		case <-sm.stop:
+			sm.drop("flush timeout")
+			continue
+		default:
+		}
+
+		if err := sm.sink.Write(event.key, event.value); err != nil {
+			sm.failed.Add(1)
+			if sm.failures.allow() {
+				slog.Warn("Streaming metrics event not delivered", "sink", sm.sink.Name(), logging.ErrorAttr(err),
+					"failed_total", sm.failed.Load())
+			}
+			continue
+		}
+		sm.written.Add(1)
+	}
+}
+
+func (sm *StreamingMetrics) drop(reason string) {
+	dropped := sm.dropped.Add(1)
+	if sm.failures.allow() {
+		slog.Warn("Dropping streaming metrics events", "sink", sm.sink.Name(), "reason", reason, "dropped_total", dropped)
+	}
+}
+
+// Stats reports how many events were queued, dropped, delivered and lost
+func (sm *StreamingMetrics) Stats() PipelineStats {
+	if !sm.IsEnabled() {
+		return PipelineStats{}
+	}
+
+	stats := PipelineStats{
+		Sink:      sm.sink.Name(),
+		Enqueued:  sm.enqueued.Load(),
+		Dropped:   sm.dropped.Load(),
+		Delivered: sm.written.Load(),
+		Failed:    sm.failed.Load(),
+		Buffered:  len(sm.queue),
+	}
+	// Accepted is not delivered for sinks that confirm asynchronously
+	if reporter, ok := sm.sink.(DeliveryReporter); ok {
+		delivered, failed := reporter.Deliveries()
+		stats.Delivered = delivered
+		stats.Failed += failed
+	}
+	return stats
+}
+
+// Close stops accepting events, delivers the buffered ones within the flush
+// timeout and closes the sink
 func (sm *StreamingMetrics) Close() {
-	if sm.producer != nil {
-		sm.producer.Flush(15 * 1000) // 15 second timeout
-		sm.producer.Close()
+	if !sm.IsEnabled() {
+		return
+	}
+
+	sm.mu.Lock()
+	if sm.closed {
+		sm.mu.Unlock()
+		return
+	}
+	sm.closed = true
+	close(sm.queue)
+	sm.mu.Unlock()
+
+	// Let the worker hand over what is buffered, bounded by the flush timeout
+	deadline := time.Now().Add(sm.flushTimeout)
+	select {
+	case <-sm.workerDone:
+	case <-time.After(sm.flushTimeout):
+		slog.Warn("Streaming metrics buffer not drained before the flush timeout", "buffered", len(sm.queue))
+		close(sm.stop)
+		<-sm.workerDone
+	}
+
+	if err := sm.sink.Close(max(time.Until(deadline), 0)); err != nil {
+		slog.Warn("Failed to close event sink", "sink", sm.sink.Name(), "error", err)
 	}
+
+	stats := sm.Stats()
+	slog.Info("Streaming metrics closed", "sink", stats.Sink, "delivered", stats.Delivered,
+		"failed", stats.Failed, "dropped", stats.Dropped)
+}
+
+// Health reports why events can't currently be delivered, nil if they can
+func (sm *StreamingMetrics) Health() error {
+	if !sm.IsEnabled() {
+		return errors.New("streaming metrics are disabled")
+	}
+	sm.mu.RLock()
+	closed := sm.closed
+	sm.mu.RUnlock()
+	if closed {
+		return errors.New("streaming metrics are closed")
+	}
+	if err := sm.sink.Health(); err != nil {
+		return fmt.Errorf("%s sink: %w", sm.sink.Name(), err)
+	}
+	return nil
 }
 
 // IsEnabled returns whether streaming metrics are enabled
 func (sm *StreamingMetrics) IsEnabled() bool {
-	return sm.enabled
-}
\ No newline at end of file
+	return sm != nil && sm.enabled
+}
@@ -0,0 +1,196 @@
+package streaming
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// gatedSink holds every Write until release is closed, failing it with err
+type gatedSink struct {
+	MemorySink
+	release chan struct{}
+	writing atomic.Int64 // Writes started
+	err     error
+}
+
+func newGatedSink() *gatedSink {
+	return &gatedSink{release: make(chan struct{})}
+}
+
+func (gs *gatedSink) Write(key, value []byte) error {
+	gs.writing.Add(1)
+	<-gs.release
+	if gs.err != nil {
+		return gs.err
+	}
+	return gs.MemorySink.Write(key, value)
+}
+
+func testEvent(session string) *ProxyRequestEvent {
+	return &ProxyRequestEvent{SessionID: session, TargetURL: "https://cdn.example.com/seg-1.ts", StatusCode: 200}
+}
+
+func TestStreamingMetricsDelivers(t *testing.T) {
+	sink := NewMemorySink()
+	sm := NewStreamingMetrics(sink, Config{BufferSize: 10, FlushTimeout: time.Second})
+	for _, session := range []string{"a", "b", "c"} {
+		sm.LogProxyRequest(testEvent(session))
+	}
+	sm.LogBreakerState(&BreakerStateEvent{Host: "cdn.example.com", From: "closed", To: "open"})
+	sm.Close()
+
+	events := sink.Events()
+	var got []string
+	for _, event := range events {
+		var fields struct{ Event string }
+		json.Unmarshal(event.Value, &fields)
+		got = append(got, event.Key+" "+fields.Event)
+	}
+	want := []string{"a proxy_request", "b proxy_request", "c proxy_request", "cdn.example.com circuit_breaker"}
+	if len(got) != len(want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+	if stats := sm.Stats(); stats.Enqueued != 4 || stats.Delivered != 4 || stats.Dropped != 0 || stats.Failed != 0 {
+		t.Errorf("Stats = %+v", stats)
+	}
+}
+
+func TestStreamingMetricsOverflow(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          Config
+		releaseAfter time.Duration // Sink unblocks this long after the buffer filled up, 0 at the end
+		wantDropped  uint64
+		minWait      time.Duration // Least time the overflowing event spends in LogProxyRequest
+	}{
+		{name: "drop", cfg: Config{BufferSize: 2, Overflow: OverflowDrop}, wantDropped: 1},
+		{name: "unknown policy drops", cfg: Config{BufferSize: 2, Overflow: "wait"}, wantDropped: 1},
+		{name: "block times out", cfg: Config{BufferSize: 2, Overflow: OverflowBlock, BlockTimeout: 30 * time.Millisecond}, wantDropped: 1, minWait: 30 * time.Millisecond},
+		{name: "block finds room", cfg: Config{BufferSize: 2, Overflow: OverflowBlock, BlockTimeout: time.Second}, releaseAfter: 20 * time.Millisecond, minWait: 20 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := newGatedSink()
+			tt.cfg.FlushTimeout = time.Second
+			sm := NewStreamingMetrics(sink, tt.cfg)
+
+			// One event is held by the sink, two fill the buffer
+			sm.LogProxyRequest(testEvent("held"))
+			waitFor(t, "sink write", func() bool { return sink.writing.Load() == 1 })
+			sm.LogProxyRequest(testEvent("queued-1"))
+			sm.LogProxyRequest(testEvent("queued-2"))
+
+			if tt.releaseAfter > 0 {
+				time.AfterFunc(tt.releaseAfter, func() { close(sink.release) })
+			}
+			start := time.Now()
+			sm.LogProxyRequest(testEvent("overflow"))
+			if waited := time.Since(start); waited < tt.minWait || waited > tt.minWait+time.Second {
+				t.Errorf("request held for %v, want about %v", waited, tt.minWait)
+			}
+			if tt.releaseAfter == 0 {
+				close(sink.release)
+			}
+			sm.Close()
+
+			stats := sm.Stats()
+			if stats.Dropped != tt.wantDropped || stats.Delivered != 4-tt.wantDropped || stats.Enqueued != 4-tt.wantDropped {
+				t.Errorf("Stats = %+v, want %d dropped", stats, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestStreamingMetricsFlushTimeout(t *testing.T) {
+	sink := newGatedSink()
+	sm := NewStreamingMetrics(sink, Config{BufferSize: 10, FlushTimeout: 20 * time.Millisecond})
+	for _, session := range []string{"a", "b", "c"} {
+		sm.LogProxyRequest(testEvent(session))
+	}
+	waitFor(t, "sink write", func() bool { return sink.writing.Load() == 1 })
+
+	// The sink only gets going again after the flush timeout, the rest isn't waited for
+	time.AfterFunc(50*time.Millisecond, func() { close(sink.release) })
+	sm.Close()
+
+	stats := sm.Stats()
+	if stats.Delivered != 1 || stats.Dropped != 2 || stats.Buffered != 0 {
+		t.Errorf("Stats = %+v, want 1 delivered and 2 dropped", stats)
+	}
+
+	// Events after Close are dropped rather than panicking on the closed buffer
+	sm.LogProxyRequest(testEvent("late"))
+	if stats := sm.Stats(); stats.Dropped != 3 {
+		t.Errorf("dropped = %d after Close, want 3", stats.Dropped)
+	}
+	if sm.Health() == nil {
+		t.Error("Health = nil after Close")
+	}
+}
+
+func TestStreamingMetricsSinkFailures(t *testing.T) {
+	sink := newGatedSink()
+	sink.err = errors.New("broker unavailable")
+	close(sink.release)
+	sm := NewStreamingMetrics(sink, Config{BufferSize: 10, FlushTimeout: time.Second})
+	sm.LogProxyRequest(testEvent("a"))
+	sm.LogProxyRequest(testEvent("b"))
+	sm.Close()
+
+	if stats := sm.Stats(); stats.Failed != 2 || stats.Delivered != 0 || stats.Dropped != 0 {
+		t.Errorf("Stats = %+v, want 2 failed", stats)
+	}
+}
+
+// reportingSink confirms deliveries asynchronously, like the Kafka and webhook sinks
+type reportingSink struct {
+	MemorySink
+	mu                sync.Mutex
+	delivered, failed uint64
+}
+
+func (rs *reportingSink) Deliveries() (delivered, failed uint64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.delivered, rs.failed
+}
+
+func TestStreamingMetricsDeliveryReports(t *testing.T) {
+	sink := &reportingSink{}
+	sm := NewStreamingMetrics(sink, Config{BufferSize: 10, FlushTimeout: time.Second})
+	for _, session := range []string{"a", "b", "c"} {
+		sm.LogProxyRequest(testEvent(session))
+	}
+	waitFor(t, "events to reach the sink", func() bool { return len(sink.Events()) == 3 })
+
+	// Accepted by the sink is not delivered until the sink says so
+	sink.mu.Lock()
+	sink.delivered, sink.failed = 2, 1
+	sink.mu.Unlock()
+	if stats := sm.Stats(); stats.Delivered != 2 || stats.Failed != 1 {
+		t.Errorf("Stats = %+v, want the sink's 2 delivered and 1 failed", stats)
+	}
+	sm.Close()
+}
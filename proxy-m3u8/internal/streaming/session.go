@@ -0,0 +1,210 @@
+package streaming
+
+import (
+	"sync"
+	"time"
+)
+
+// Session event types
+const (
+	SessionStart = "session_start"
+	SessionEnd   = "session_end"
+)
+
+// SessionEvent marks the start or end of a viewing session. A session starts
+// with a viewer's first segment request and ends once no segment has been
+// requested for the idle timeout.
+type SessionEvent struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Event        string    `json:"event"` // session_start or session_end
+	SessionID    string    `json:"session_id"`
+	ClientIPHash string    `json:"client_ip_hash"`
+	MasterURL    string    `json:"master_url,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+
+	// Totals, set on session_end
+	DurationMs      int64   `json:"duration_ms,omitempty"`
+	Segments        int64   `json:"segments,omitempty"`
+	Bytes           int64   `json:"bytes,omitempty"`
+	AvgBitrate      float64 `json:"avg_bitrate_bps,omitempty"` // Bits delivered per second watched
+	FailedSegments  int64   `json:"failed_segments,omitempty"`
+	SlowSegments    int64   `json:"slow_segments,omitempty"`    // Fetched slower than real time
+	RequestGaps     int64   `json:"request_gaps,omitempty"`     // Pauses between segments longer than two segment durations
+	VariantSwitches int64   `json:"variant_switches,omitempty"` // Changes of the requested variant bandwidth
+	LastBandwidth   int64   `json:"last_variant_bandwidth,omitempty"`
+}
+
+// segmentKind is the request kind sessions are derived from, as labelled in metrics
+const segmentKind = "segment"
+
+// SessionTracker derives viewing sessions from segment request events
+type SessionTracker struct {
+	idleTimeout time.Duration
+	emit        func(*SessionEvent)
+
+	mu       sync.Mutex
+	sessions map[string]*viewerSession
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// viewerSession accumulates one viewer's segment requests
+type viewerSession struct {
+	id           string
+	clientIPHash string
+	masterURL    string
+	start        time.Time
+	lastSeen     time.Time
+	lastDuration time.Duration
+	bandwidth    int64
+
+	segments int64
+	bytes    int64
+	failed   int64
+	slow     int64
+	gaps     int64
+	switches int64
+}
+
+// NewSessionTracker ends sessions after idleTimeout without segment requests
+// and hands start and end events to emit
+func NewSessionTracker(idleTimeout time.Duration, emit func(*SessionEvent)) *SessionTracker {
+	t := &SessionTracker{
+		idleTimeout: idleTimeout,
+		emit:        emit,
+		sessions:    make(map[string]*viewerSession),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.reapLoop()
+	return t
+}
+
+// Observe accounts a request event to the viewer's session, starting one if needed
+func (t *SessionTracker) Observe(sessionKey string, event *ProxyRequestEvent) {
+	if event.Kind != segmentKind {
+		return
+	}
+
+	t.mu.Lock()
+	session, ok := t.sessions[sessionKey]
+	if !ok {
+		session = &viewerSession{
+			id:           sessionKey,
+			clientIPHash: event.ClientIPHash,
+			masterURL:    event.MasterURL,
+			start:        event.Timestamp,
+			bandwidth:    event.VariantBandwidth,
+		}
+		t.sessions[sessionKey] = session
+	} else {
+		// A viewer falling this far behind the segment cadence paused or stalled
+		if gap := event.Timestamp.Sub(session.lastSeen); session.lastDuration > 0 && gap > 2*session.lastDuration {
+			session.gaps++
+		}
+		if event.VariantBandwidth > 0 && session.bandwidth > 0 && event.VariantBandwidth != session.bandwidth {
+			session.switches++
+		}
+		if event.VariantBandwidth > 0 {
+			session.bandwidth = event.VariantBandwidth
+		}
+		if session.masterURL == "" {
+			session.masterURL = event.MasterURL
+		}
+	}
+
+	session.lastSeen = event.Timestamp
+	session.lastDuration = time.Duration(event.SegmentDuration * float64(time.Second))
+	session.segments++
+	session.bytes += event.ContentSize
+	if !event.Success {
+		session.failed++
+	}
+	if event.SlowDownload {
+		session.slow++
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		t.emit(&SessionEvent{
+			Timestamp:    event.Timestamp,
+			Event:        SessionStart,
+			SessionID:    sessionKey,
+			ClientIPHash: event.ClientIPHash,
+			MasterURL:    event.MasterURL,
+			StartedAt:    event.Timestamp,
+		})
+	}
+}
+
+func (t *SessionTracker) reapLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(max(t.idleTimeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.endIdle(time.Now())
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// endIdle ends the sessions without a segment request for the idle timeout
+func (t *SessionTracker) endIdle(now time.Time) {
+	var ended []*viewerSession
+	t.mu.Lock()
+	for key, session := range t.sessions {
+		if now.Sub(session.lastSeen) > t.idleTimeout {
+			ended = append(ended, session)
+			delete(t.sessions, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, session := range ended {
+		t.emit(session.endEvent())
+	}
+}
+
+func (s *viewerSession) endEvent() *SessionEvent {
+	// The last segment plays on after it was requested
+	watched := s.lastSeen.Add(s.lastDuration).Sub(s.start)
+	event := &SessionEvent{
+		Timestamp:       s.lastSeen.Add(s.lastDuration),
+		Event:           SessionEnd,
+		SessionID:       s.id,
+		ClientIPHash:    s.clientIPHash,
+		MasterURL:       s.masterURL,
+		StartedAt:       s.start,
+		DurationMs:      watched.Milliseconds(),
+		Segments:        s.segments,
+		Bytes:           s.bytes,
+		FailedSegments:  s.failed,
+		SlowSegments:    s.slow,
+		RequestGaps:     s.gaps,
+		VariantSwitches: s.switches,
+		LastBandwidth:   s.bandwidth,
+	}
+	if watched > 0 {
+		event.AvgBitrate = float64(s.bytes*8) / watched.Seconds()
+	}
+	return event
+}
+
+// Close ends every open session, e.g. on shutdown
+func (t *SessionTracker) Close() {
+	close(t.stop)
+	<-t.done
+
+	t.mu.Lock()
+	sessions := t.sessions
+	t.sessions = make(map[string]*viewerSession)
+	t.mu.Unlock()
+
+	for _, session := range sessions {
+		t.emit(session.endEvent())
+	}
+}
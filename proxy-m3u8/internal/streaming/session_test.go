@@ -0,0 +1,133 @@
+package streaming
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionRecorder collects the events a SessionTracker emits
+type sessionRecorder struct {
+	mu     sync.Mutex
+	events []*SessionEvent
+}
+
+func (sr *sessionRecorder) emit(event *SessionEvent) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.events = append(sr.events, event)
+}
+
+func (sr *sessionRecorder) Events() []*SessionEvent {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return slices.Clone(sr.events)
+}
+
+func segmentEvent(at time.Time, bandwidth int64, duration float64, size int64) *ProxyRequestEvent {
+	return &ProxyRequestEvent{
+		Timestamp:        at,
+		ClientIPHash:     "client-hash",
+		Kind:             segmentKind,
+		MasterURL:        "https://cdn.example.com/master.m3u8",
+		VariantBandwidth: bandwidth,
+		SegmentDuration:  duration,
+		ContentSize:      size,
+		Success:          true,
+	}
+}
+
+func TestSessionTrackerQoE(t *testing.T) {
+	recorder := &sessionRecorder{}
+	tracker := NewSessionTracker(30*time.Second, recorder.emit)
+	defer tracker.Close()
+
+	start := time.Now()
+	tracker.Observe("viewer", segmentEvent(start, 800000, 4, 1000))
+	if events := recorder.Events(); len(events) != 1 || events[0].Event != SessionStart || !events[0].StartedAt.Equal(start) {
+		t.Fatalf("events after the first segment = %+v, want session_start", events)
+	}
+
+	// Playlist refreshes don't count towards the session
+	playlist := segmentEvent(start.Add(time.Second), 800000, 0, 500)
+	playlist.Kind = "playlist"
+	tracker.Observe("viewer", playlist)
+
+	slow := segmentEvent(start.Add(4*time.Second), 800000, 4, 1000)
+	slow.SlowDownload = true
+	tracker.Observe("viewer", slow)
+	// 16s after a 4s segment is a gap, and the viewer moved to another variant
+	failed := segmentEvent(start.Add(20*time.Second), 1600000, 4, 2000)
+	failed.Success = false
+	tracker.Observe("viewer", failed)
+	tracker.Observe("viewer", segmentEvent(start.Add(24*time.Second), 1600000, 2, 1000))
+
+	// Idle for exactly the timeout isn't over yet
+	tracker.endIdle(start.Add(54 * time.Second))
+	if events := recorder.Events(); len(events) != 1 {
+		t.Fatalf("%d events before the idle timeout passed, want 1", len(events))
+	}
+	tracker.endIdle(start.Add(55 * time.Second))
+
+	events := recorder.Events()
+	if len(events) != 2 {
+		t.Fatalf("%d events, want session_start and session_end", len(events))
+	}
+	end := events[1]
+	// The last segment requested at 24s plays for another 2s
+	want := SessionEvent{
+		Timestamp:       start.Add(26 * time.Second),
+		Event:           SessionEnd,
+		SessionID:       "viewer",
+		ClientIPHash:    "client-hash",
+		MasterURL:       "https://cdn.example.com/master.m3u8",
+		StartedAt:       start,
+		DurationMs:      26000,
+		Segments:        4,
+		Bytes:           5000,
+		AvgBitrate:      5000 * 8 / 26.0,
+		FailedSegments:  1,
+		SlowSegments:    1,
+		RequestGaps:     1,
+		VariantSwitches: 1,
+		LastBandwidth:   1600000,
+	}
+	if !end.Timestamp.Equal(want.Timestamp) || !end.StartedAt.Equal(want.StartedAt) {
+		t.Errorf("session_end at %v started %v, want %v started %v", end.Timestamp, end.StartedAt, want.Timestamp, want.StartedAt)
+	}
+	end.Timestamp, end.StartedAt = want.Timestamp, want.StartedAt
+	if *end != want {
+		t.Errorf("session_end = %+v, want %+v", *end, want)
+	}
+
+	// The next segment starts a new session
+	tracker.Observe("viewer", segmentEvent(start.Add(time.Minute), 800000, 4, 1000))
+	if events := recorder.Events(); len(events) != 3 || events[2].Event != SessionStart {
+		t.Errorf("events after returning = %+v, want a new session_start", events)
+	}
+}
+
+func TestSessionTrackerCloseEndsSessions(t *testing.T) {
+	recorder := &sessionRecorder{}
+	tracker := NewSessionTracker(time.Hour, recorder.emit)
+
+	start := time.Now()
+	tracker.Observe("a", segmentEvent(start, 800000, 4, 1000))
+	tracker.Observe("b", segmentEvent(start, 800000, 4, 1000))
+	tracker.Close()
+
+	var ended []string
+	for _, event := range recorder.Events() {
+		if event.Event == SessionEnd {
+			ended = append(ended, event.SessionID)
+			if event.DurationMs != 4000 || event.Segments != 1 {
+				t.Errorf("session_end = %+v, want one 4s segment", *event)
+			}
+		}
+	}
+	slices.Sort(ended)
+	if !slices.Equal(ended, []string{"a", "b"}) {
+		t.Errorf("ended sessions = %v, want a and b", ended)
+	}
+}
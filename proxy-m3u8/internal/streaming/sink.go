@@ -0,0 +1,248 @@
+package streaming
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sinks selectable in SinkConfig
+const (
+	SinkNone    = "none"
+	SinkKafka   = "kafka"   // Redpanda/Kafka topic
+	SinkFile    = "file"    // Newline-delimited JSON appended to a file
+	SinkStdout  = "stdout"  // Newline-delimited JSON on stdout
+	SinkWebhook = "webhook" // Batches of newline-delimited JSON POSTed to a URL
+	SinkMemory  = "memory"  // Kept in memory, for tests
+)
+
+// EventSink is where the pipeline delivers serialized events. Write is only
+// called from the pipeline's worker, one event at a time.
+type EventSink interface {
+	// Name identifies the sink in logs and stats
+	Name() string
+	// Write accepts one JSON event; key groups related events, e.g. by session
+	Write(key, value []byte) error
+	// Health reports why the sink can't currently deliver events, nil if it can
+	Health() error
+	// Close delivers what the sink still buffers within timeout and releases it
+	Close(timeout time.Duration) error
+}
+
+// DeliveryReporter is implemented by sinks that learn asynchronously whether the
+// events they accepted arrived
+type DeliveryReporter interface {
+	Deliveries() (delivered, failed uint64)
+}
+
+// SinkConfig selects and configures the event sink
+type SinkConfig struct {
+	Type    string
+	Kafka   KafkaConfig
+	File    string // Path of the file sink
+	Webhook WebhookConfig
+}
+
+// OpenSink creates the sink selected by cfg.Type
+func OpenSink(cfg SinkConfig) (EventSink, error) {
+	var sink EventSink
+	var err error
+	switch cfg.Type {
+	case SinkKafka:
+		sink, err = NewKafkaSink(cfg.Kafka)
+	case SinkFile:
+		sink, err = NewFileSink(cfg.File)
+	case SinkStdout:
+		sink = NewWriterSink(SinkStdout, os.Stdout)
+	case SinkWebhook:
+		sink, err = NewWebhookSink(cfg.Webhook)
+	case SinkMemory:
+		sink = NewMemorySink()
+	default:
+		return nil, fmt.Errorf("unknown event sink %q", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// writerFlushInterval bounds how long events sit in a writer sink's buffer
+const writerFlushInterval = time.Second
+
+// WriterSink writes events as newline-delimited JSON to an io.Writer, buffered
+// and flushed every second
+type WriterSink struct {
+	name   string
+	mu     sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	stop   chan struct{}
+	done   chan struct{}
+	health sinkHealth
+}
+
+// NewWriterSink writes events to w, which is not closed by Close
+func NewWriterSink(name string, w io.Writer) *WriterSink {
+	ws := &WriterSink{
+		name: name,
+		w:    bufio.NewWriterSize(w, 64<<10),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go ws.flushLoop()
+	return ws
+}
+
+// NewFileSink appends events to the file at path, creating it if needed
+func NewFileSink(path string) (*WriterSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("event sink file path is empty")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event sink file: %w", err)
+	}
+	ws := NewWriterSink(SinkFile, file)
+	ws.closer = file
+	return ws, nil
+}
+
+func (ws *WriterSink) Name() string {
+	return ws.name
+}
+
+func (ws *WriterSink) Write(key, value []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, err := ws.w.Write(value); err != nil {
+		ws.health.set(err)
+		return err
+	}
+	return ws.w.WriteByte('\n')
+}
+
+func (ws *WriterSink) flushLoop() {
+	defer close(ws.done)
+	ticker := time.NewTicker(writerFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ws.mu.Lock()
+			err := ws.w.Flush()
+			ws.mu.Unlock()
+			ws.health.set(err)
+		case <-ws.stop:
+			return
+		}
+	}
+}
+
+func (ws *WriterSink) Health() error {
+	return ws.health.get()
+}
+
+func (ws *WriterSink) Close(timeout time.Duration) error {
+	close(ws.stop)
+	<-ws.done
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	err := ws.w.Flush()
+	if ws.closer != nil {
+		if closeErr := ws.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// MemoryEvent is an event held by a MemorySink
+type MemoryEvent struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// MemorySink keeps every event in memory so tests can assert on them
+type MemorySink struct {
+	mu     sync.Mutex
+	events []MemoryEvent
+}
+
+// NewMemorySink creates an empty in-memory sink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (ms *MemorySink) Name() string {
+	return SinkMemory
+}
+
+func (ms *MemorySink) Write(key, value []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.events = append(ms.events, MemoryEvent{Key: string(key), Value: append(json.RawMessage(nil), value...)})
+	return nil
+}
+
+func (ms *MemorySink) Health() error {
+	return nil
+}
+
+func (ms *MemorySink) Close(timeout time.Duration) error {
+	return nil
+}
+
+// Events returns a copy of the events written so far
+func (ms *MemorySink) Events() []MemoryEvent {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append([]MemoryEvent(nil), ms.events...)
+}
+
+// Reset forgets the events written so far
+func (ms *MemorySink) Reset() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.events = nil
+}
+
+// sinkHealth holds the last error that kept a sink from delivering, until it delivers again
+type sinkHealth struct {
+	mu  sync.Mutex
+	err error
+}
+
+// set records the outcome of the latest delivery, nil clearing a previous failure
+func (h *sinkHealth) set(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.err = err
+}
+
+func (h *sinkHealth) get() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// failureLogInterval rate limits logging of dropped and undelivered events
+const failureLogInterval = 10 * time.Second
+
+// logLimiter lets through one log line per failureLogInterval
+type logLimiter struct {
+	last atomic.Int64
+}
+
+func (l *logLimiter) allow() bool {
+	now := time.Now().UnixNano()
+	last := l.last.Load()
+	return now-last >= int64(failureLogInterval) && l.last.CompareAndSwap(last, now)
+}
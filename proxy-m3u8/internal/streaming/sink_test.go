@@ -0,0 +1,48 @@
+package streaming
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+
+	// A second sink on the same file appends to it
+	for _, events := range [][]string{{`{"n":1}`, `{"n":2}`}, {`{"n":3}`}} {
+		sink, err := NewFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range events {
+			if err := sink.Write([]byte("key"), []byte(event)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sink.Close(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Health(); err != nil {
+			t.Errorf("Health = %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"; string(data) != want {
+		t.Errorf("file = %q, want %q", data, want)
+	}
+}
+
+func TestFileSinkErrors(t *testing.T) {
+	if _, err := NewFileSink(""); err == nil {
+		t.Error("NewFileSink accepted an empty path")
+	}
+	if _, err := NewFileSink(filepath.Join(t.TempDir(), "missing", "events.ndjson")); err == nil {
+		t.Error("NewFileSink accepted a path in a missing directory")
+	}
+}
@@ -0,0 +1,229 @@
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
+)
+
+// webhookAttempts is how often a batch is sent before it is given up on
+const webhookAttempts = 3
+
+// webhookDefaultTimeout bounds each request when the config leaves it unset
+const webhookDefaultTimeout = 5 * time.Second
+
+// webhookMaxPendingBatches bounds how many full batches wait while the webhook is
+// slow; further events are refused rather than buffered without limit
+const webhookMaxPendingBatches = 10
+
+// WebhookConfig configures the HTTP webhook sink
+type WebhookConfig struct {
+	URL           string
+	BatchMessages int           // Events per POST
+	FlushInterval time.Duration // Longest an event waits for its batch to fill
+	Timeout       time.Duration // Per request, defaults to 5s
+}
+
+// WebhookSink POSTs batches of newline-delimited JSON events to a URL. Batches
+// are only sent from its own goroutine, so a slow webhook never holds up Write.
+type WebhookSink struct {
+	cfg    WebhookConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	events [][]byte
+
+	full   chan struct{} // Signals flushLoop that a batch is ready
+	stop   chan struct{}
+	done   chan struct{}
+	ctx    context.Context // Cancelled when Close runs out of time
+	cancel context.CancelFunc
+
+	closeErr  error // Outcome of the final flush, set before done is closed
+	delivered atomic.Uint64
+	failed    atomic.Uint64
+	failures  logLimiter
+	health    sinkHealth
+}
+
+// NewWebhookSink creates a sink posting to cfg.URL
+func NewWebhookSink(cfg WebhookConfig) (*WebhookSink, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("event sink webhook URL is empty")
+	}
+	if cfg.BatchMessages < 1 {
+		cfg.BatchMessages = 1
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = webhookDefaultTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ws := &WebhookSink{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		full:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go ws.flushLoop()
+	return ws, nil
+}
+
+func (ws *WebhookSink) Name() string {
+	return SinkWebhook
+}
+
+// Write adds an event to the current batch and wakes the sender once it is full.
+// It fails when the webhook has fallen too far behind.
+func (ws *WebhookSink) Write(key, value []byte) error {
+	ws.mu.Lock()
+	if len(ws.events) >= webhookMaxPendingBatches*ws.cfg.BatchMessages {
+		ws.mu.Unlock()
+		return errors.New("webhook backlog is full")
+	}
+	ws.events = append(ws.events, bytes.Clone(value))
+	full := len(ws.events) >= ws.cfg.BatchMessages
+	ws.mu.Unlock()
+
+	if full {
+		select {
+		case ws.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (ws *WebhookSink) flushLoop() {
+	defer close(ws.done)
+	ticker := time.NewTicker(ws.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ws.full:
+			ws.flush(false)
+		case <-ticker.C:
+			ws.flush(true)
+		case <-ws.stop:
+			ws.closeErr = ws.flush(true)
+			return
+		}
+	}
+}
+
+// flush sends the buffered events in batches, counting them as delivered or
+// failed. Without partial only full batches are sent, and sending stops once the
+// sink is closing so the final flush reports on the rest. It returns the last error.
+func (ws *WebhookSink) flush(partial bool) error {
+	var lastErr error
+	for {
+		if !partial {
+			select {
+			case <-ws.stop:
+				return lastErr
+			default:
+			}
+		}
+
+		ws.mu.Lock()
+		count := min(len(ws.events), ws.cfg.BatchMessages)
+		if count == 0 || (!partial && count < ws.cfg.BatchMessages) {
+			ws.mu.Unlock()
+			return lastErr
+		}
+		var body bytes.Buffer
+		for _, event := range ws.events[:count] {
+			body.Write(event)
+			body.WriteByte('\n')
+		}
+		ws.events = slices.Delete(ws.events, 0, count)
+		ws.mu.Unlock()
+
+		err := ws.send(ws.ctx, body.Bytes())
+		ws.health.set(err)
+		if err != nil {
+			lastErr = err
+			failed := ws.failed.Add(uint64(count))
+			if ws.failures.allow() {
+				slog.Warn("Webhook delivery failed", logging.ErrorAttr(err), "events", count, "failed_total", failed)
+			}
+			continue
+		}
+		ws.delivered.Add(uint64(count))
+	}
+}
+
+func (ws *WebhookSink) send(ctx context.Context, body []byte) error {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(time.Duration(attempt-1) * 200 * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, ws.cfg.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+
+		var resp *http.Response
+		resp, err = ws.client.Do(req)
+		if err != nil {
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+		// Client errors won't go away by sending the batch again
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return err
+		}
+	}
+	return err
+}
+
+func (ws *WebhookSink) Deliveries() (delivered, failed uint64) {
+	return ws.delivered.Load(), ws.failed.Load()
+}
+
+// Health reports the error of the last batch that couldn't be sent
+func (ws *WebhookSink) Health() error {
+	return ws.health.get()
+}
+
+// Close sends what is still buffered within timeout, returning the error if it couldn't be sent
+func (ws *WebhookSink) Close(timeout time.Duration) error {
+	deadline := time.AfterFunc(timeout, ws.cancel)
+	defer deadline.Stop()
+	defer ws.cancel()
+
+	close(ws.stop)
+	<-ws.done
+	return ws.closeErr
+}
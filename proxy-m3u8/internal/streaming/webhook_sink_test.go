@@ -0,0 +1,153 @@
+package streaming
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder answers webhook requests with statuses in turn, repeating the
+// last one, and keeps the bodies it received
+type webhookRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	status := wr.statuses[min(len(wr.bodies), len(wr.statuses)-1)]
+	wr.bodies = append(wr.bodies, string(body))
+	wr.mu.Unlock()
+	w.WriteHeader(status)
+}
+
+func (wr *webhookRecorder) received() []string {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return slices.Clone(wr.bodies)
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+		wantFailed   bool
+	}{
+		{name: "delivered", statuses: []int{http.StatusNoContent}, wantAttempts: 1},
+		{name: "server error retried", statuses: []int{http.StatusInternalServerError, http.StatusOK}, wantAttempts: 2},
+		{name: "rate limit retried", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, wantAttempts: 2},
+		{name: "client error not retried", statuses: []int{http.StatusBadRequest}, wantAttempts: 1, wantFailed: true},
+		{name: "unauthorized not retried", statuses: []int{http.StatusUnauthorized, http.StatusOK}, wantAttempts: 1, wantFailed: true},
+		{name: "gives up after three attempts", statuses: []int{http.StatusServiceUnavailable}, wantAttempts: webhookAttempts, wantFailed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &webhookRecorder{statuses: tt.statuses}
+			srv := httptest.NewServer(recorder)
+			defer srv.Close()
+
+			ws, err := NewWebhookSink(WebhookConfig{URL: srv.URL, BatchMessages: 1, FlushInterval: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws.Write(nil, []byte(`{"event":"proxy_request"}`))
+			ws.Close(5 * time.Second)
+
+			if got := len(recorder.received()); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+			delivered, failed := ws.Deliveries()
+			if want := map[bool][2]uint64{false: {1, 0}, true: {0, 1}}[tt.wantFailed]; [2]uint64{delivered, failed} != want {
+				t.Errorf("delivered, failed = %d, %d, want %v", delivered, failed, want)
+			}
+			if (ws.Health() != nil) != tt.wantFailed {
+				t.Errorf("Health = %v, want failure %v", ws.Health(), tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestWebhookSinkBatches(t *testing.T) {
+	recorder := &webhookRecorder{statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(recorder)
+	defer srv.Close()
+
+	ws, err := NewWebhookSink(WebhookConfig{URL: srv.URL, BatchMessages: 2, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		ws.Write(nil, []byte(`{"n":`+string(rune('0'+i))+`}`))
+	}
+	if err := ws.Close(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Full batches go out as they fill, the partial one on Close
+	want := []string{"{\"n\":0}\n{\"n\":1}\n", "{\"n\":2}\n{\"n\":3}\n", "{\"n\":4}\n"}
+	if got := recorder.received(); !slices.Equal(got, want) {
+		t.Errorf("batches = %q, want %q", got, want)
+	}
+	if delivered, _ := ws.Deliveries(); delivered != 5 {
+		t.Errorf("delivered = %d, want 5", delivered)
+	}
+}
+
+func TestWebhookSinkSlowWebhook(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ws, err := NewWebhookSink(WebhookConfig{URL: srv.URL, BatchMessages: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.client.Timeout != webhookDefaultTimeout {
+		t.Errorf("request timeout = %v, want the %v default", ws.client.Timeout, webhookDefaultTimeout)
+	}
+
+	// Writes return right away while a batch is stuck, until the backlog is full
+	start := time.Now()
+	var refused int
+	for range webhookMaxPendingBatches + 5 {
+		if err := ws.Write(nil, []byte(`{}`)); err != nil {
+			if !strings.Contains(err.Error(), "backlog") {
+				t.Errorf("Write = %v, want a full backlog", err)
+			}
+			refused++
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writes took %v while the webhook was stuck", elapsed)
+	}
+	if refused == 0 {
+		t.Error("no write refused with a stuck webhook")
+	}
+
+	// Close gives up on the stuck batch after its timeout
+	start = time.Now()
+	if err := ws.Close(50 * time.Millisecond); err == nil {
+		t.Error("Close succeeded with a stuck webhook")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close took %v, want it bounded by its timeout", elapsed)
+	}
+	if delivered, failed := ws.Deliveries(); delivered != 0 || failed == 0 {
+		t.Errorf("delivered, failed = %d, %d, want the stuck events failed", delivered, failed)
+	}
+}
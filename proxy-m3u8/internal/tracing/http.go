@@ -0,0 +1,206 @@
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span for every request, continuing the caller's
+// trace when it sent a traceparent header
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+			route := c.Path()
+			if route == "" {
+				route = req.URL.Path
+			}
+			ctx, span := Tracer().Start(ctx, req.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", req.Method),
+					attribute.String("http.route", route),
+					attribute.String("client.address", c.RealIP()),
+				),
+			)
+			defer span.End()
+
+			c.SetRequest(req.WithContext(ctx))
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			span.SetAttributes(
+				attribute.Int("http.response.status_code", status),
+				attribute.Int64("http.response.body.size", c.Response().Size),
+			)
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			// The error was handled above, don't let Echo write a second response
+			return nil
+		}
+	}
+}
+
+// Transport wraps an http.RoundTripper with a client span per request and spans
+// for the DNS, connect and TLS phases. With propagate set the trace context is
+// sent along, which is only wanted for our own services, not third-party origins.
+func Transport(next http.RoundTripper, propagate bool) http.RoundTripper {
+	return &transport{next: next, propagate: propagate}
+}
+
+type transport struct {
+	next      http.RoundTripper
+	propagate bool
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := Tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Hostname()),
+			// Query strings carry tokens and signatures, keep them out of traces
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+
+	if span.IsRecording() {
+		ctx = httptrace.WithClientTrace(ctx, newClientTrace(ctx))
+	}
+	req = req.WithContext(ctx)
+	if t.propagate {
+		req = req.Clone(ctx)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	// The span covers the body too, so slow transfers show up
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the wrapped transport
+func (t *transport) CloseIdleConnections() {
+	if closer, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// spanBody ends a client span once the body is closed
+type spanBody struct {
+	io.ReadCloser
+	span trace.Span
+	once sync.Once
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.span.End() })
+	return err
+}
+
+// newClientTrace records the connection phases of a request as child spans,
+// and the first response byte as an event
+func newClientTrace(ctx context.Context) *httptrace.ClientTrace {
+	var mu sync.Mutex
+	var dnsSpan, tlsSpan trace.Span
+	connectSpans := make(map[string]trace.Span)
+	parent := trace.SpanFromContext(ctx)
+
+	start := func(name string, attrs ...attribute.KeyValue) trace.Span {
+		_, span := Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+		return span
+	}
+	end := func(span trace.Span, err error) {
+		if span == nil {
+			return
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			parent.AddEvent("get_conn", trace.WithAttributes(attribute.String("host_port", hostPort)))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			parent.AddEvent("got_conn", trace.WithAttributes(
+				attribute.Bool("reused", info.Reused),
+				attribute.Bool("was_idle", info.WasIdle),
+			))
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dnsSpan = start("dns", attribute.String("host", info.Host))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			end(dnsSpan, info.Err)
+			dnsSpan = nil
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			connectSpans[network+addr] = start("connect", attribute.String("network", network), attribute.String("address", addr))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			end(connectSpans[network+addr], err)
+			delete(connectSpans, network+addr)
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsSpan = start("tls")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if tlsSpan != nil {
+				tlsSpan.SetAttributes(attribute.String("tls.protocol", state.NegotiatedProtocol))
+			}
+			end(tlsSpan, err)
+			tlsSpan = nil
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			parent.AddEvent("wrote_request")
+		},
+		GotFirstResponseByte: func() {
+			parent.AddEvent("first_response_byte")
+		},
+	}
+}
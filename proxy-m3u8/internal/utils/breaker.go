@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/security"
+)
+
+// ErrCircuitOpen is wrapped by every error returned for a host whose breaker is open
+var ErrCircuitOpen = errors.New("upstream circuit open")
+
+// BreakerState is the state of a host's circuit breaker
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // Requests flow normally
+	BreakerOpen     BreakerState = "open"      // Requests fail fast
+	BreakerHalfOpen BreakerState = "half-open" // A few probes decide whether to close again
+)
+
+// BreakerConfig configures the per-host circuit breakers
+type BreakerConfig struct {
+	FailureThreshold int           // Consecutive failures that open a breaker, 0 disables breakers
+	SlowThreshold    time.Duration // Responses slower than this count as failures, 0 ignores latency
+	OpenDuration     time.Duration // Time a breaker stays open before probing
+	HalfOpenProbes   int           // Concurrent probe requests while half-open
+}
+
+// CircuitOpenError is returned while a host is ejected
+type CircuitOpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v for %s, retry in %s", ErrCircuitOpen, e.Host, e.RetryAfter.Round(time.Second))
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// BreakerListener is told about every breaker state change, in the order they happen
+type BreakerListener func(host string, from, to BreakerState)
+
+// HostBreakers keeps one circuit breaker per upstream host. A host is ejected
+// after consecutive failures (transport errors, 5xx responses or slow responses),
+// fails fast while open, and is probed again after the open duration.
+type HostBreakers struct {
+	config BreakerConfig
+
+	mu       sync.Mutex
+	hosts    map[string]*hostBreaker
+	listener BreakerListener
+
+	// Transitions waiting for the listener, delivered in order by notifyLoop,
+	// which runs while notifying is set
+	pending   []breakerTransition
+	notifying bool
+}
+
+type breakerTransition struct {
+	listener BreakerListener
+	host     string
+	from, to BreakerState
+}
+
+type hostBreaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+// breakerResult is the verdict on one request
+type breakerResult int
+
+const (
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	breakerIgnored // Cancelled by the client or denied by policy, says nothing about the host
+)
+
+// upstreamBreakers is read by every upstream request and may be replaced at any time
+var upstreamBreakers atomic.Pointer[HostBreakers]
+
+func init() {
+	upstreamBreakers.Store(NewHostBreakers(BreakerConfig{}))
+}
+
+// NewHostBreakers creates a breaker set
+func NewHostBreakers(config BreakerConfig) *HostBreakers {
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = 30 * time.Second
+	}
+	if config.HalfOpenProbes < 1 {
+		config.HalfOpenProbes = 1
+	}
+	return &HostBreakers{
+		config: config,
+		hosts:  make(map[string]*hostBreaker),
+	}
+}
+
+// ConfigureCircuitBreakers replaces the breakers guarding upstream hosts
+func ConfigureCircuitBreakers(config BreakerConfig) {
+	breakers := NewHostBreakers(config)
+	previous := upstreamBreakers.Load()
+	previous.mu.Lock()
+	breakers.listener = previous.listener
+	previous.mu.Unlock()
+	upstreamBreakers.Store(breakers)
+}
+
+// GetCircuitBreakers returns the breakers guarding upstream hosts
+func GetCircuitBreakers() *HostBreakers {
+	return upstreamBreakers.Load()
+}
+
+// Enabled reports whether breakers ever open
+func (hb *HostBreakers) Enabled() bool {
+	return hb.config.FailureThreshold > 0
+}
+
+// SetListener registers the function told about state changes
+func (hb *HostBreakers) SetListener(listener BreakerListener) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	hb.listener = listener
+}
+
+// States returns the hosts whose breakers aren't closed
+func (hb *HostBreakers) States() map[string]BreakerState {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	states := make(map[string]BreakerState)
+	for host, b := range hb.hosts {
+		if b.state != BreakerClosed {
+			states[host] = b.state
+		}
+	}
+	return states
+}
+
+// allow admits a request to host, returning the function recording its outcome
+func (hb *HostBreakers) allow(host string) (func(breakerResult), error) {
+	if !hb.Enabled() {
+		return func(breakerResult) {}, nil
+	}
+
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	b, exists := hb.hosts[host]
+	if !exists {
+		b = &hostBreaker{state: BreakerClosed}
+		hb.hosts[host] = b
+	}
+
+	probe := false
+	switch b.state {
+	case BreakerOpen:
+		if wait := hb.config.OpenDuration - time.Since(b.openedAt); wait > 0 {
+			return nil, &CircuitOpenError{Host: host, RetryAfter: wait}
+		}
+		hb.setStateLocked(host, b, BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probes >= hb.config.HalfOpenProbes {
+			return nil, &CircuitOpenError{Host: host, RetryAfter: time.Second}
+		}
+		b.probes++
+		probe = true
+	}
+
+	var once sync.Once
+	return func(result breakerResult) {
+		once.Do(func() { hb.record(host, b, probe, result) })
+	}, nil
+}
+
+func (hb *HostBreakers) record(host string, b *hostBreaker, probe bool, result breakerResult) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	// The entry may have been dropped while the request was in flight
+	if current, exists := hb.hosts[host]; !exists {
+		hb.hosts[host] = b
+	} else if current != b {
+		b = current
+		probe = false
+	}
+
+	if probe {
+		b.probes--
+	}
+
+	switch result {
+	case breakerSuccess:
+		b.failures = 0
+		if b.state == BreakerHalfOpen && probe {
+			hb.setStateLocked(host, b, BreakerClosed)
+		}
+	case breakerFailure:
+		b.failures++
+		if (b.state == BreakerHalfOpen && probe) || (b.state == BreakerClosed && b.failures >= hb.config.FailureThreshold) {
+			b.openedAt = time.Now()
+			hb.setStateLocked(host, b, BreakerOpen)
+		}
+	}
+
+	// Healthy hosts don't need an entry
+	if b.state == BreakerClosed && b.failures == 0 && b.probes == 0 {
+		delete(hb.hosts, host)
+	}
+}
+
+// setStateLocked changes a breaker's state; the caller must hold the lock
+func (hb *HostBreakers) setStateLocked(host string, b *hostBreaker, state BreakerState) {
+	from := b.state
+	b.state = state
+	slog.Warn("Circuit breaker changed state", "upstream_host", host, "from", from, "to", state)
+	if hb.listener == nil {
+		return
+	}
+
+	// The listener may be slow (it publishes events), so it runs outside the lock,
+	// on a single goroutine that keeps transitions in order
+	hb.pending = append(hb.pending, breakerTransition{listener: hb.listener, host: host, from: from, to: state})
+	if !hb.notifying {
+		hb.notifying = true
+		go hb.notifyLoop()
+	}
+}
+
+// notifyLoop delivers queued transitions to the listener and exits once none are
+// left; the next transition starts a new loop
+func (hb *HostBreakers) notifyLoop() {
+	for {
+		hb.mu.Lock()
+		transitions := hb.pending
+		hb.pending = nil
+		if len(transitions) == 0 {
+			hb.notifying = false
+			hb.mu.Unlock()
+			return
+		}
+		hb.mu.Unlock()
+
+		for _, t := range transitions {
+			t.listener(t.host, t.from, t.to)
+		}
+	}
+}
+
+// breakerTransport applies the upstream breakers to every request, including
+// redirects and prefetches
+type breakerTransport struct {
+	next http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	breakers := upstreamBreakers.Load()
+	host := strings.ToLower(req.URL.Hostname())
+
+	done, err := breakers.allow(host)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && (req.Context().Err() != nil || errors.Is(err, security.ErrDestinationDenied)):
+		done(breakerIgnored)
+	case err != nil:
+		done(breakerFailure)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		done(breakerFailure)
+	case breakers.config.SlowThreshold > 0 && time.Since(start) > breakers.config.SlowThreshold:
+		done(breakerFailure)
+	default:
+		done(breakerSuccess)
+	}
+	return resp, err
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the wrapped transport
+func (t *breakerTransport) CloseIdleConnections() {
+	if closer, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
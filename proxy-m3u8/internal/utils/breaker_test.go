@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/security"
+)
+
+const testOpenDuration = 20 * time.Millisecond
+
+func TestHostBreakerTransitions(t *testing.T) {
+	// A step either sends a request with the given outcome, or waits out the open duration.
+	// denied is whether the breaker should reject the request before it is sent.
+	type step struct {
+		result breakerResult
+		denied bool
+		wait   bool
+	}
+	ok := step{result: breakerSuccess}
+	fail := step{result: breakerFailure}
+	ignored := step{result: breakerIgnored}
+	denied := step{denied: true}
+	wait := step{wait: true}
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  BreakerState
+	}{
+		{name: "stays closed below the threshold", steps: []step{fail, fail}, want: BreakerClosed},
+		{name: "success resets the failure count", steps: []step{fail, fail, ok, fail, fail}, want: BreakerClosed},
+		{name: "ignored results don't count", steps: []step{fail, fail, ignored, ignored}, want: BreakerClosed},
+		{name: "opens at the threshold", steps: []step{fail, fail, fail, denied}, want: BreakerOpen},
+		{name: "stays open until the next request probes", steps: []step{fail, fail, fail, wait}, want: BreakerOpen},
+		{name: "probe success closes", steps: []step{fail, fail, fail, wait, ok, ok}, want: BreakerClosed},
+		{name: "probe failure reopens", steps: []step{fail, fail, fail, wait, fail, denied}, want: BreakerOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hb := NewHostBreakers(BreakerConfig{FailureThreshold: 3, OpenDuration: testOpenDuration})
+			for i, s := range tt.steps {
+				if s.wait {
+					time.Sleep(testOpenDuration + 5*time.Millisecond)
+					continue
+				}
+				done, err := hb.allow("cdn.example.com")
+				if (err != nil) != s.denied {
+					t.Fatalf("step %d: allow error = %v, want denied %v", i, err, s.denied)
+				}
+				if err != nil {
+					if !errors.Is(err, ErrCircuitOpen) {
+						t.Fatalf("step %d: allow error = %v, want ErrCircuitOpen", i, err)
+					}
+					continue
+				}
+				done(s.result)
+			}
+
+			got, exists := hb.States()["cdn.example.com"]
+			if !exists {
+				got = BreakerClosed
+			}
+			if got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostBreakerHalfOpenProbes(t *testing.T) {
+	hb := NewHostBreakers(BreakerConfig{FailureThreshold: 1, OpenDuration: testOpenDuration, HalfOpenProbes: 1})
+	done, _ := hb.allow("cdn.example.com")
+	done(breakerFailure)
+	time.Sleep(testOpenDuration + 5*time.Millisecond)
+
+	probe, err := hb.allow("cdn.example.com")
+	if err != nil {
+		t.Fatalf("probe allow = %v", err)
+	}
+	if state := hb.States()["cdn.example.com"]; state != BreakerHalfOpen {
+		t.Errorf("state while probing = %s, want %s", state, BreakerHalfOpen)
+	}
+	if _, err := hb.allow("cdn.example.com"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second request while probing = %v, want ErrCircuitOpen", err)
+	}
+	probe(breakerSuccess)
+	if _, exists := hb.States()["cdn.example.com"]; exists {
+		t.Error("breaker still tracked after a successful probe")
+	}
+}
+
+func TestHostBreakerListenerOrder(t *testing.T) {
+	hb := NewHostBreakers(BreakerConfig{FailureThreshold: 1, OpenDuration: testOpenDuration})
+
+	var mu sync.Mutex
+	var got []string
+	delivered := make(chan struct{}, 16)
+	hb.SetListener(func(host string, from, to BreakerState) {
+		mu.Lock()
+		got = append(got, fmt.Sprintf("%s %s->%s", host, from, to))
+		mu.Unlock()
+		delivered <- struct{}{}
+	})
+
+	done, _ := hb.allow("cdn.example.com")
+	done(breakerFailure)
+	time.Sleep(testOpenDuration + 5*time.Millisecond)
+	done, _ = hb.allow("cdn.example.com")
+	done(breakerFailure)
+	time.Sleep(testOpenDuration + 5*time.Millisecond)
+	done, _ = hb.allow("cdn.example.com")
+	done(breakerSuccess)
+
+	want := []string{
+		"cdn.example.com closed->open",
+		"cdn.example.com open->half-open",
+		"cdn.example.com half-open->open",
+		"cdn.example.com open->half-open",
+		"cdn.example.com half-open->closed",
+	}
+	for range want {
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatal("listener wasn't called for every transition")
+		}
+	}
+	mu.Lock()
+	if !slices.Equal(got, want) {
+		t.Errorf("transitions = %v, want %v", got, want)
+	}
+	mu.Unlock()
+
+	// The notifier exits once everything is delivered
+	waitFor(t, "notifier to exit", func() bool {
+		hb.mu.Lock()
+		defer hb.mu.Unlock()
+		return !hb.notifying
+	})
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestBreakerTransportResults(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		status   int
+		err      error
+		wantOpen bool
+	}{
+		{name: "server error", status: http.StatusBadGateway, wantOpen: true},
+		{name: "transport error", err: errors.New("connection reset"), wantOpen: true},
+		{name: "not found", status: http.StatusNotFound},
+		{name: "denied by policy", err: fmt.Errorf("dial: %w", security.ErrDestinationDenied)},
+		{name: "cancelled by client", ctx: cancelled, err: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := upstreamBreakers.Load()
+			upstreamBreakers.Store(NewHostBreakers(BreakerConfig{FailureThreshold: 1, OpenDuration: time.Minute}))
+			defer upstreamBreakers.Store(saved)
+
+			transport := &breakerTransport{next: roundTripFunc(func(*http.Request) (*http.Response, error) {
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return &http.Response{StatusCode: tt.status, Body: http.NoBody}, nil
+			})}
+
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://cdn.example.com/a.ts", nil)
+			transport.RoundTrip(req)
+
+			_, open := GetCircuitBreakers().States()["cdn.example.com"]
+			if open != tt.wantOpen {
+				t.Errorf("breaker open = %v, want %v", open, tt.wantOpen)
+			}
+		})
+	}
+}
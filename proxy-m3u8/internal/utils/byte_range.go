@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrRangeNotSatisfiable is returned when a Range header lies entirely outside the object.
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// ByteRange is an inclusive byte range of an object, as used by Range and Content-Range.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// Length returns the number of bytes covered by the range.
+func (r ByteRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+// ContentRange formats the range as a Content-Range header value.
+func (r ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+// ParseByteRange parses a single-range Range header ("bytes=0-499", "bytes=500-",
+// "bytes=-500") against an object of the given size. ok is false when the header
+// is absent, malformed or asks for multiple ranges, in which case the whole object
+// should be served. ErrRangeNotSatisfiable is returned for ranges past the end.
+func ParseByteRange(header string, size int64) (r ByteRange, ok bool, err error) {
+	if header == "" || !strings.HasPrefix(header, "bytes=") {
+		return ByteRange{}, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		// Multipart ranges are not worth supporting for media segments
+		return ByteRange{}, false, nil
+	}
+
+	startStr, endStr, found := strings.Cut(spec, "-")
+	if !found {
+		return ByteRange{}, false, nil
+	}
+	startStr = strings.TrimSpace(startStr)
+	endStr = strings.TrimSpace(endStr)
+
+	if startStr == "" {
+		// Suffix range: the last N bytes
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n < 0 {
+			return ByteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return ByteRange{}, false, ErrRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return ByteRange{Start: size - n, End: size - 1}, true, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return ByteRange{}, false, nil
+	}
+	if start >= size {
+		return ByteRange{}, false, ErrRangeNotSatisfiable
+	}
+
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return ByteRange{}, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return ByteRange{Start: start, End: end}, true, nil
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		size    int64
+		want    ByteRange
+		wantOK  bool
+		wantErr error
+	}{
+		{name: "no header", header: "", size: 1000},
+		{name: "closed range", header: "bytes=0-499", size: 1000, want: ByteRange{0, 499}, wantOK: true},
+		{name: "open range", header: "bytes=500-", size: 1000, want: ByteRange{500, 999}, wantOK: true},
+		{name: "suffix range", header: "bytes=-200", size: 1000, want: ByteRange{800, 999}, wantOK: true},
+		{name: "suffix longer than object", header: "bytes=-5000", size: 1000, want: ByteRange{0, 999}, wantOK: true},
+		{name: "end clamped to size", header: "bytes=900-5000", size: 1000, want: ByteRange{900, 999}, wantOK: true},
+		{name: "single last byte", header: "bytes=999-999", size: 1000, want: ByteRange{999, 999}, wantOK: true},
+		{name: "spaces", header: "bytes= 10 - 19 ", size: 1000, want: ByteRange{10, 19}, wantOK: true},
+		{name: "start past end", header: "bytes=1000-", size: 1000, wantErr: ErrRangeNotSatisfiable},
+		{name: "empty suffix", header: "bytes=-0", size: 1000, wantErr: ErrRangeNotSatisfiable},
+		{name: "empty object", header: "bytes=-10", size: 0, wantErr: ErrRangeNotSatisfiable},
+		{name: "other unit", header: "items=0-1", size: 1000},
+		{name: "multiple ranges", header: "bytes=0-1,5-6", size: 1000},
+		{name: "end before start", header: "bytes=500-100", size: 1000},
+		{name: "no dash", header: "bytes=500", size: 1000},
+		{name: "not a number", header: "bytes=a-b", size: 1000},
+		{name: "negative start", header: "bytes=--5", size: 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := ParseByteRange(tt.header, tt.size)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseByteRange(%q, %d) error = %v, want %v", tt.header, tt.size, err, tt.wantErr)
+			}
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("ParseByteRange(%q, %d) = %+v, %v, want %+v, %v", tt.header, tt.size, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCacheEntryRange(t *testing.T) {
+	entry := &CacheEntry{Data: []byte("0123456789")}
+
+	tests := []struct {
+		name         string
+		header       string
+		want         string
+		wantPartial  bool
+		contentRange string
+		wantErr      error
+	}{
+		{name: "whole object", header: "", want: "0123456789"},
+		{name: "head", header: "bytes=0-3", want: "0123", wantPartial: true, contentRange: "bytes 0-3/10"},
+		{name: "middle", header: "bytes=4-6", want: "456", wantPartial: true, contentRange: "bytes 4-6/10"},
+		{name: "tail", header: "bytes=7-", want: "789", wantPartial: true, contentRange: "bytes 7-9/10"},
+		{name: "suffix", header: "bytes=-2", want: "89", wantPartial: true, contentRange: "bytes 8-9/10"},
+		{name: "malformed serves everything", header: "bytes=x-", want: "0123456789"},
+		{name: "unsatisfiable", header: "bytes=10-", want: "0123456789", wantErr: ErrRangeNotSatisfiable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, r, partial, err := entry.Range(tt.header)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Range(%q) error = %v, want %v", tt.header, err, tt.wantErr)
+			}
+			if string(data) != tt.want || partial != tt.wantPartial {
+				t.Errorf("Range(%q) = %q, partial %v, want %q, partial %v", tt.header, data, partial, tt.want, tt.wantPartial)
+			}
+			if partial {
+				if got := r.ContentRange(int64(len(entry.Data))); got != tt.contentRange {
+					t.Errorf("ContentRange = %q, want %q", got, tt.contentRange)
+				}
+				if r.Length() != int64(len(data)) {
+					t.Errorf("Length = %d, want %d", r.Length(), len(data))
+				}
+			}
+		})
+	}
+}
@@ -1,53 +1,227 @@
 package utils
 
 import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Simple in-memory cache for static segments
+// EvictionPolicy selects which entry is dropped when the cache is over its byte budget
+type EvictionPolicy string
+
+const (
+	// EvictLRU drops the least recently used entry
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU drops the least frequently used entry, oldest first on ties
+	EvictLFU EvictionPolicy = "lfu"
+)
+
+// SegmentStore is the cache interface used by the proxy handler, implemented by
+// the memory cache, the disk cache and the two-tier combination of both
+type SegmentStore interface {
+	Enabled() bool
+	MaxEntryBytes() int64
+	GetEntry(key string) (*CacheEntry, bool)
+	// Contains reports whether an unexpired entry exists, without counting a hit or miss
+	Contains(key string) bool
+	SetEntry(key string, entry *CacheEntry, ttl time.Duration)
+	Delete(key string)
+	Cleanup()
+	Stats() CacheStats
+	// Health reports why the cache can't currently store entries, nil if it can
+	Health() error
+}
+
+// In-memory cache for segments and playlists, bounded by a total byte budget
 type SegmentCache struct {
-	cache map[string]*CacheEntry
-	mu    sync.RWMutex
+	cache map[string]*list.Element
+	order *list.List // front is the most recently used item
+	mu    sync.Mutex
+
+	maxBytes      int64
+	maxEntryBytes int64
+	policy        EvictionPolicy
+	size          int64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
 }
 
 type CacheEntry struct {
-	Data      []byte
-	ExpiresAt time.Time
+	Data         []byte
+	ContentType  string
+	ETag         string
+	LastModified string
+	Playlist     bool // Data is the raw upstream playlist, rewritten on every hit
+	ExpiresAt    time.Time
+}
+
+// CacheStats is a point-in-time snapshot of the cache counters
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+	Policy    string `json:"policy"`
+	Hits      int64  `json:"hits"`
+	Misses    int64  `json:"misses"`
+	Evictions int64  `json:"evictions"`
+
+	// DroppedWrites counts entries skipped because the disk tier's write queue was full
+	DroppedWrites int64 `json:"dropped_writes,omitempty"`
+
+	Disk *CacheStats `json:"disk,omitempty"` // Second tier, when enabled
+}
+
+type cacheItem struct {
+	key   string
+	entry *CacheEntry
+	hits  int64
+}
+
+// NewCacheEntry builds a cache entry carrying the upstream validators
+func NewCacheEntry(header http.Header, data []byte, playlist bool) *CacheEntry {
+	return &CacheEntry{
+		Data:         data,
+		ContentType:  header.Get("Content-Type"),
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Playlist:     playlist,
+	}
+}
+
+// Range returns the part of the cached object selected by a Range header.
+// partial is false when the whole object should be served.
+func (e *CacheEntry) Range(rangeHeader string) (data []byte, r ByteRange, partial bool, err error) {
+	r, partial, err = ParseByteRange(rangeHeader, int64(len(e.Data)))
+	if err != nil || !partial {
+		return e.Data, r, false, err
+	}
+	return e.Data[r.Start : r.End+1], r, true, nil
+}
+
+var segmentCache SegmentStore = NewSegmentCache(0, 0, EvictLRU)
+
+// NewSegmentCache creates a cache holding at most maxBytes of data. Objects larger
+// than maxEntryBytes are never stored. A zero maxBytes disables the cache.
+func NewSegmentCache(maxBytes, maxEntryBytes int64, policy EvictionPolicy) *SegmentCache {
+	if policy != EvictLFU {
+		policy = EvictLRU
+	}
+	if maxEntryBytes <= 0 || maxEntryBytes > maxBytes {
+		maxEntryBytes = maxBytes
+	}
+	return &SegmentCache{
+		cache:         make(map[string]*list.Element),
+		order:         list.New(),
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		policy:        policy,
+	}
 }
 
-var segmentCache = &SegmentCache{
-	cache: make(map[string]*CacheEntry),
+// Enabled reports whether the cache stores anything at all
+func (sc *SegmentCache) Enabled() bool {
+	return sc.maxBytes > 0
+}
+
+// MaxEntryBytes returns the size of the largest object the cache accepts
+func (sc *SegmentCache) MaxEntryBytes() int64 {
+	return sc.maxEntryBytes
 }
 
 // Get retrieves data from cache if it exists and hasn't expired
 func (sc *SegmentCache) Get(key string) ([]byte, bool) {
-	sc.mu.RLock()
-	defer sc.mu.RUnlock()
-	
-	if entry, exists := sc.cache[key]; exists {
-		if time.Now().Before(entry.ExpiresAt) {
-			return entry.Data, true
-		}
-		// Clean up expired entry
-		sc.mu.RUnlock()
-		sc.mu.Lock()
-		delete(sc.cache, key)
-		sc.mu.Unlock()
-		sc.mu.RLock()
+	entry, ok := sc.GetEntry(key)
+	if !ok {
+		return nil, false
 	}
-	
-	return nil, false
+	return entry.Data, true
+}
+
+// GetEntry retrieves the full cache entry if it exists and hasn't expired
+func (sc *SegmentCache) GetEntry(key string) (*CacheEntry, bool) {
+	if !sc.Enabled() {
+		return nil, false
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	elem, exists := sc.cache[key]
+	if !exists {
+		sc.misses.Add(1)
+		return nil, false
+	}
+
+	item := elem.Value.(*cacheItem)
+	if time.Now().After(item.entry.ExpiresAt) {
+		sc.removeElement(elem)
+		sc.misses.Add(1)
+		return nil, false
+	}
+
+	item.hits++
+	sc.order.MoveToFront(elem)
+	sc.hits.Add(1)
+	return item.entry, true
+}
+
+// Contains reports whether an unexpired entry exists, leaving the counters and the LRU order alone
+func (sc *SegmentCache) Contains(key string) bool {
+	if !sc.Enabled() {
+		return false
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	elem, exists := sc.cache[key]
+	return exists && time.Now().Before(elem.Value.(*cacheItem).entry.ExpiresAt)
 }
 
 // Set stores data in cache with expiration
 func (sc *SegmentCache) Set(key string, data []byte, ttl time.Duration) {
+	sc.SetEntry(key, &CacheEntry{Data: data}, ttl)
+}
+
+// SetEntry stores an entry in cache with expiration, evicting other entries
+// until the byte budget is respected
+func (sc *SegmentCache) SetEntry(key string, entry *CacheEntry, ttl time.Duration) {
+	entrySize := int64(len(entry.Data))
+	if !sc.Enabled() || ttl <= 0 || entrySize > sc.maxEntryBytes {
+		return
+	}
+	entry.ExpiresAt = time.Now().Add(ttl)
+
 	sc.mu.Lock()
 	defer sc.mu.Unlock()
-	
-	sc.cache[key] = &CacheEntry{
-		Data:      data,
-		ExpiresAt: time.Now().Add(ttl),
+
+	if elem, exists := sc.cache[key]; exists {
+		sc.removeElement(elem)
+	}
+
+	for sc.size+entrySize > sc.maxBytes && sc.order.Len() > 0 {
+		sc.removeElement(sc.victim())
+		sc.evictions.Add(1)
+	}
+
+	sc.cache[key] = sc.order.PushFront(&cacheItem{key: key, entry: entry})
+	sc.size += entrySize
+}
+
+// Delete removes a key from the cache
+func (sc *SegmentCache) Delete(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if elem, exists := sc.cache[key]; exists {
+		sc.removeElement(elem)
 	}
 }
 
@@ -55,16 +229,130 @@ func (sc *SegmentCache) Set(key string, data []byte, ttl time.Duration) {
 func (sc *SegmentCache) Cleanup() {
 	sc.mu.Lock()
 	defer sc.mu.Unlock()
-	
-	for key, entry := range sc.cache {
-		if time.Now().After(entry.ExpiresAt) {
-			delete(sc.cache, key)
+
+	now := time.Now()
+	for _, elem := range sc.cache {
+		if now.After(elem.Value.(*cacheItem).entry.ExpiresAt) {
+			sc.removeElement(elem)
 		}
 	}
 }
 
+// Stats returns the current size and hit/miss counters
+func (sc *SegmentCache) Stats() CacheStats {
+	sc.mu.Lock()
+	entries, size := len(sc.cache), sc.size
+	sc.mu.Unlock()
+
+	return CacheStats{
+		Entries:   entries,
+		Bytes:     size,
+		MaxBytes:  sc.maxBytes,
+		Policy:    string(sc.policy),
+		Hits:      sc.hits.Load(),
+		Misses:    sc.misses.Load(),
+		Evictions: sc.evictions.Load(),
+	}
+}
+
+// Health always succeeds, memory can't fail
+func (sc *SegmentCache) Health() error {
+	return nil
+}
+
+// victim picks the entry to evict. LFU scans the whole list, which is fine for
+// the few thousand multi-megabyte segments a byte budget allows.
+func (sc *SegmentCache) victim() *list.Element {
+	oldest := sc.order.Back()
+	if sc.policy != EvictLFU {
+		return oldest
+	}
+
+	victim := oldest
+	for elem := oldest; elem != nil; elem = elem.Prev() {
+		if elem.Value.(*cacheItem).hits < victim.Value.(*cacheItem).hits {
+			victim = elem
+		}
+	}
+	return victim
+}
+
+// removeElement drops an element; the caller must hold the lock
+func (sc *SegmentCache) removeElement(elem *list.Element) {
+	item := sc.order.Remove(elem).(*cacheItem)
+	delete(sc.cache, item.key)
+	sc.size -= int64(len(item.entry.Data))
+}
+
+// IsCacheableResponse checks the origin's Cache-Control for directives forbidding shared caching
+func IsCacheableResponse(header http.Header) bool {
+	cacheControl := strings.ToLower(header.Get("Cache-Control"))
+	return !strings.Contains(cacheControl, "no-store") && !strings.Contains(cacheControl, "private")
+}
+
+// CaptureBuffer keeps a copy of a streamed body for the cache. It never fails a
+// write so it can sit in an io.MultiWriter next to the client connection; once the
+// body outgrows the limit the copy is dropped.
+type CaptureBuffer struct {
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+// NewCaptureBuffer creates a capture buffer, pre-sized when the body length is known
+func NewCaptureBuffer(contentLength, limit int64) *CaptureBuffer {
+	b := &CaptureBuffer{limit: limit}
+	if contentLength > limit {
+		b.overflow = true
+	} else if contentLength > 0 {
+		b.buf.Grow(int(contentLength))
+	}
+	return b
+}
+
+func (b *CaptureBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if int64(b.buf.Len()+len(p)) > b.limit {
+		b.overflow = true
+		b.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// Complete reports whether the whole body was captured
+func (b *CaptureBuffer) Complete(contentLength int64) bool {
+	return !b.overflow && (contentLength < 0 || int64(b.buf.Len()) == contentLength)
+}
+
+// Bytes returns the captured body
+func (b *CaptureBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// ConfigureSegmentCache replaces the singleton segment cache with one using the given limits
+func ConfigureSegmentCache(maxBytes, maxEntryBytes int64, policy EvictionPolicy) {
+	segmentCache = NewSegmentCache(maxBytes, maxEntryBytes, policy)
+}
+
+// EnableDiskCache puts a disk tier behind the configured memory cache
+func EnableDiskCache(dir string, maxBytes, maxEntryBytes, promoteHits int64, minDiskTTL time.Duration) error {
+	memory, ok := segmentCache.(*SegmentCache)
+	if !ok {
+		return fmt.Errorf("disk cache already enabled")
+	}
+	disk, err := OpenDiskCache(dir, maxBytes, maxEntryBytes)
+	if err != nil {
+		return err
+	}
+	segmentCache = NewTieredCache(memory, disk, promoteHits, minDiskTTL)
+	return nil
+}
+
 // GetSegmentCache returns the singleton segment cache
-func GetSegmentCache() *SegmentCache {
+func GetSegmentCache() SegmentStore {
 	return segmentCache
 }
 
@@ -73,9 +361,9 @@ func StartCacheCleanup() {
 	go func() {
 		ticker := time.NewTicker(5 * time.Minute)
 		defer ticker.Stop()
-		
+
 		for range ticker.C {
 			segmentCache.Cleanup()
 		}
 	}()
-}
\ No newline at end of file
+}
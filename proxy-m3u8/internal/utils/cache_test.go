@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSegmentCacheEviction(t *testing.T) {
+	type op struct {
+		get  bool
+		key  string
+		size int
+	}
+	set := func(key string, size int) op { return op{key: key, size: size} }
+	get := func(key string) op { return op{get: true, key: key} }
+
+	tests := []struct {
+		name          string
+		maxBytes      int64
+		maxEntryBytes int64
+		policy        EvictionPolicy
+		ops           []op
+		wantKeys      []string
+		wantBytes     int64
+		wantEvictions int64
+	}{
+		{
+			name:      "fits in budget",
+			maxBytes:  100,
+			ops:       []op{set("a", 40), set("b", 60)},
+			wantKeys:  []string{"a", "b"},
+			wantBytes: 100,
+		},
+		{
+			name:          "lru evicts least recently used",
+			maxBytes:      100,
+			ops:           []op{set("a", 40), set("b", 40), get("a"), set("c", 40)},
+			wantKeys:      []string{"a", "c"},
+			wantBytes:     80,
+			wantEvictions: 1,
+		},
+		{
+			name:          "lfu evicts least frequently used",
+			maxBytes:      100,
+			policy:        EvictLFU,
+			ops:           []op{set("a", 40), set("b", 40), get("a"), get("a"), get("b"), set("c", 40)},
+			wantKeys:      []string{"a", "c"},
+			wantBytes:     80,
+			wantEvictions: 1,
+		},
+		{
+			name:          "lfu breaks ties by age",
+			maxBytes:      100,
+			policy:        EvictLFU,
+			ops:           []op{set("a", 40), set("b", 40), set("c", 40)},
+			wantKeys:      []string{"b", "c"},
+			wantBytes:     80,
+			wantEvictions: 1,
+		},
+		{
+			name:          "large entry evicts several",
+			maxBytes:      100,
+			ops:           []op{set("a", 30), set("b", 30), set("c", 30), set("d", 90)},
+			wantKeys:      []string{"d"},
+			wantBytes:     90,
+			wantEvictions: 3,
+		},
+		{
+			name:      "replacing a key updates its size",
+			maxBytes:  100,
+			ops:       []op{set("a", 40), set("a", 10), set("b", 50)},
+			wantKeys:  []string{"a", "b"},
+			wantBytes: 60,
+		},
+		{
+			name:          "entry over the entry limit is skipped",
+			maxBytes:      100,
+			maxEntryBytes: 50,
+			ops:           []op{set("a", 40), set("b", 60)},
+			wantKeys:      []string{"a"},
+			wantBytes:     40,
+		},
+		{
+			name:     "disabled",
+			maxBytes: 0,
+			ops:      []op{set("a", 1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := NewSegmentCache(tt.maxBytes, tt.maxEntryBytes, tt.policy)
+			for _, o := range tt.ops {
+				if o.get {
+					sc.GetEntry(o.key)
+					continue
+				}
+				sc.SetEntry(o.key, &CacheEntry{Data: bytes.Repeat([]byte{'x'}, o.size)}, time.Minute)
+			}
+
+			var keys []string
+			for key := range sc.cache {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+			if !slices.Equal(keys, tt.wantKeys) {
+				t.Errorf("cached keys = %v, want %v", keys, tt.wantKeys)
+			}
+
+			stats := sc.Stats()
+			if stats.Bytes != tt.wantBytes || stats.Entries != len(tt.wantKeys) {
+				t.Errorf("stats = %d entries, %d bytes, want %d entries, %d bytes",
+					stats.Entries, stats.Bytes, len(tt.wantKeys), tt.wantBytes)
+			}
+			if stats.Evictions != tt.wantEvictions {
+				t.Errorf("evictions = %d, want %d", stats.Evictions, tt.wantEvictions)
+			}
+		})
+	}
+}
+
+func TestSegmentCacheExpiry(t *testing.T) {
+	sc := NewSegmentCache(100, 0, EvictLRU)
+	sc.SetEntry("live", &CacheEntry{Data: []byte("0123456789")}, time.Minute)
+	sc.SetEntry("stale", &CacheEntry{Data: []byte("0123456789")}, time.Minute)
+	sc.cache["stale"].Value.(*cacheItem).entry.ExpiresAt = time.Now().Add(-time.Second)
+
+	if _, ok := sc.GetEntry("stale"); ok {
+		t.Error("expired entry was returned")
+	}
+	if _, ok := sc.GetEntry("live"); !ok {
+		t.Error("live entry was not returned")
+	}
+
+	stats := sc.Stats()
+	if stats.Entries != 1 || stats.Bytes != 10 {
+		t.Errorf("stats = %d entries, %d bytes, want 1 entry, 10 bytes", stats.Entries, stats.Bytes)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("hits = %d, misses = %d, want 1 and 1", stats.Hits, stats.Misses)
+	}
+}
+
+func TestCaptureBuffer(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength int64
+		limit         int64
+		writes        []string
+		wantComplete  bool
+		want          string
+	}{
+		{name: "known length", contentLength: 6, limit: 10, writes: []string{"abc", "def"}, wantComplete: true, want: "abcdef"},
+		{name: "chunked", contentLength: -1, limit: 10, writes: []string{"abc", "def"}, wantComplete: true, want: "abcdef"},
+		{name: "declared too large", contentLength: 20, limit: 10, writes: []string{"abc"}},
+		{name: "grows too large", contentLength: -1, limit: 5, writes: []string{"abc", "def"}},
+		{name: "truncated body", contentLength: 10, limit: 10, writes: []string{"abc"}, want: "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewCaptureBuffer(tt.contentLength, tt.limit)
+			for _, w := range tt.writes {
+				if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v, capture buffers must never fail a write", w, n, err)
+				}
+			}
+			if got := b.Complete(tt.contentLength); got != tt.wantComplete {
+				t.Errorf("Complete = %v, want %v", got, tt.wantComplete)
+			}
+			if got := string(b.Bytes()); got != tt.want {
+				t.Errorf("Bytes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,29 +1,83 @@
 package utils
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/security"
+	"github.com/dovakiin0/proxy-m3u8/internal/tracing"
 )
 
+// maxRedirects mirrors the default limit of net/http
+const maxRedirects = 10
+
+// destinationPolicy guards every upstream connection against SSRF
+var destinationPolicy = security.NewDestinationPolicy(security.DestinationConfig{})
+
+var upstreamDialer = &net.Dialer{
+	Timeout:   10 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// ConfigureDestinationPolicy replaces the policy applied to upstream URLs, redirects and dials
+func ConfigureDestinationPolicy(cfg security.DestinationConfig) {
+	destinationPolicy = security.NewDestinationPolicy(cfg)
+}
+
+// CheckDestination validates an upstream URL before it is fetched
+func CheckDestination(u *url.URL) error {
+	return destinationPolicy.CheckURL(u)
+}
+
+// dialUpstream resolves, checks and connects in one step so a DNS answer can't change in between
+func dialUpstream(ctx context.Context, network, address string) (net.Conn, error) {
+	return destinationPolicy.DialContext(upstreamDialer)(ctx, network, address)
+}
+
+// checkRedirect re-validates every redirect target; addresses are checked again on dial
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+	return destinationPolicy.CheckURL(req.URL)
+}
+
+var upstreamTransport = &http.Transport{
+	// Every connection goes through the destination policy
+	DialContext: dialUpstream,
+
+	// Connection pooling - aggressive for high throughput
+	MaxIdleConns:          1000,         // Increased from 500
+	MaxIdleConnsPerHost:   200,          // Increased from 100
+	MaxConnsPerHost:       400,          // Increased from 200
+	IdleConnTimeout:       90 * time.Second, // Reduced from 300s
+
+	// Timeouts - tuned for fast streaming
+	TLSHandshakeTimeout:   5 * time.Second,  // Reduced from 10s
+	ResponseHeaderTimeout: 10 * time.Second, // Reduced from 15s
+	ExpectContinueTimeout: 1 * time.Second,
+
+	// Performance optimizations
+	DisableKeepAlives:      false,
+	DisableCompression:     false, // Let upstream handle compression
+	ForceAttemptHTTP2:      true,  // Use HTTP/2 when possible
+	WriteBufferSize:        64 << 10, // 64KB (increased from 32KB)
+	ReadBufferSize:         64 << 10, // 64KB (increased from 32KB)
+}
+
 var ProxyHTTPClient = &http.Client{
-	Transport: &http.Transport{
-		// Connection pooling - aggressive for high throughput
-		MaxIdleConns:          1000,         // Increased from 500
-		MaxIdleConnsPerHost:   200,          // Increased from 100
-		MaxConnsPerHost:       400,          // Increased from 200
-		IdleConnTimeout:       90 * time.Second, // Reduced from 300s
-
-		// Timeouts - tuned for fast streaming
-		TLSHandshakeTimeout:   5 * time.Second,  // Reduced from 10s
-		ResponseHeaderTimeout: 10 * time.Second, // Reduced from 15s
-		ExpectContinueTimeout: 1 * time.Second,
-
-		// Performance optimizations
-		DisableKeepAlives:      false,
-		DisableCompression:     false, // Let upstream handle compression
-		ForceAttemptHTTP2:      true,  // Use HTTP/2 when possible
-		WriteBufferSize:        64 << 10, // 64KB (increased from 32KB)
-		ReadBufferSize:         64 << 10, // 64KB (increased from 32KB)
-	},
+	CheckRedirect: checkRedirect,
+	// Failing hosts are ejected by their circuit breaker; origins don't get our trace context
+	Transport: tracing.Transport(&breakerTransport{next: upstreamTransport}, false),
 	Timeout: 0, // No global timeout - handled per request
 }
+
+// CloseUpstream stops prefetching and closes the idle upstream connections, once the server has drained
+func CloseUpstream() {
+	GetPrefetcher().Stop()
+	upstreamTransport.CloseIdleConnections()
+}
@@ -0,0 +1,445 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// coalesceJoinWindow is how much of a body a lone reader keeps for requests that may
+// still join its fetch; past it the reader streams straight from the origin
+const coalesceJoinWindow = 1 << 20
+
+// Coalescer deduplicates concurrent GETs of the same upstream URL sent with the same
+// content-relevant headers. Requests arriving while a fetch is in flight share its response: the body
+// is read from the origin by whichever reader is furthest ahead and kept for the
+// others, up to maxBytes. A reader that exceeds the limit, or the join window while
+// it reads alone, takes over the origin body and the others fetch the remainder
+// themselves. The fetch is cancelled once no request is waiting for or reading it.
+type Coalescer struct {
+	client   *http.Client
+	maxBytes int64
+
+	mu       sync.Mutex
+	inflight map[string]*flight
+
+	fetches atomic.Int64
+	shared  atomic.Int64
+}
+
+// CoalescerStats counts upstream fetches and the requests that piggybacked on them
+type CoalescerStats struct {
+	Fetches  int64 `json:"fetches"`
+	Shared   int64 `json:"shared"`
+	InFlight int   `json:"in_flight"`
+}
+
+// flight is one upstream fetch shared by several requests
+type flight struct {
+	co     *Coalescer
+	key    string
+	ctx    context.Context // Of the upstream fetch, detached from every single request
+	cancel context.CancelFunc
+
+	ready chan struct{} // closed once status and headers are known
+	resp  *http.Response
+	err   error
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	participants int  // Requests waiting for or reading the response
+	joinable     bool // Still in co.inflight, new requests may join
+	owner        *flightReader
+	buf          []byte // Body read so far, while shared
+	chunk        []byte // Read buffer of the reader pulling from the origin
+	pulling      bool
+	done         bool
+	readErr      error
+}
+
+// flightReader is one request's view of a shared body
+type flightReader struct {
+	f    *flight
+	req  *http.Request
+	stop func() bool // Unregisters the close on request cancellation
+
+	off     int           // Position in f.buf
+	pending []byte        // Read from the origin when this reader took it over
+	direct  io.ReadCloser // The origin body once owned, or this reader's own fetch of the rest
+	closed  bool
+	once    sync.Once
+}
+
+// UpstreamCoalescer is the coalescer used by the proxy handler
+var UpstreamCoalescer = NewCoalescer(ProxyHTTPClient, 64<<20)
+
+// NewCoalescer creates a coalescer sharing bodies of at most maxBytes.
+// A zero maxBytes disables coalescing.
+func NewCoalescer(client *http.Client, maxBytes int64) *Coalescer {
+	return &Coalescer{
+		client:   client,
+		maxBytes: maxBytes,
+		inflight: make(map[string]*flight),
+	}
+}
+
+// ConfigureCoalescer replaces the handler's coalescer
+func ConfigureCoalescer(maxBytes int64) {
+	UpstreamCoalescer = NewCoalescer(ProxyHTTPClient, maxBytes)
+}
+
+// Do performs req, sharing the upstream fetch with concurrent identical requests.
+// Range and conditional requests are never shared and go straight to the client.
+func (co *Coalescer) Do(req *http.Request) (*http.Response, error) {
+	if co.maxBytes <= 0 || !isCoalescable(req) {
+		return co.client.Do(req)
+	}
+
+	key := coalesceKey(req)
+	co.mu.Lock()
+	f, joined := co.inflight[key]
+	if joined {
+		joined = f.join()
+	}
+	if !joined {
+		f = newFlight(co, key, req)
+		co.inflight[key] = f
+	}
+	co.mu.Unlock()
+
+	if joined {
+		co.shared.Add(1)
+	} else {
+		co.fetches.Add(1)
+		go f.fetch(req)
+	}
+	return f.await(req)
+}
+
+// coalesceKeyHeaders are the upstream headers that can change what an origin sends
+// back. The User-Agent is left out: it is picked at random per request or session and
+// would keep viewers of the same segment from ever sharing a fetch. The header profile
+// is covered by Origin and Accept-Encoding, which only the browser profile sends.
+var coalesceKeyHeaders = []string{"Accept-Encoding", "Authorization", "Cookie", "Origin", "Referer"}
+
+// coalesceKey identifies requests that can share a response: the URL and the
+// headers the content depends on
+func coalesceKey(req *http.Request) string {
+	var key strings.Builder
+	key.WriteString(req.URL.String())
+	for _, name := range coalesceKeyHeaders {
+		key.WriteString("\n")
+		key.WriteString(name)
+		key.WriteString(": ")
+		key.WriteString(strings.Join(req.Header.Values(name), ", "))
+	}
+	return key.String()
+}
+
+// Stats returns the coalescer counters
+func (co *Coalescer) Stats() CoalescerStats {
+	co.mu.Lock()
+	inFlight := len(co.inflight)
+	co.mu.Unlock()
+
+	return CoalescerStats{
+		Fetches:  co.fetches.Load(),
+		Shared:   co.shared.Load(),
+		InFlight: inFlight,
+	}
+}
+
+// finish removes a flight so later requests start a fresh fetch
+func (co *Coalescer) finish(key string, f *flight) {
+	co.mu.Lock()
+	if co.inflight[key] == f {
+		delete(co.inflight, key)
+	}
+	co.mu.Unlock()
+}
+
+func newFlight(co *Coalescer, key string, req *http.Request) *flight {
+	// The fetch may outlive the request that started it, as long as others are waiting
+	ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+	f := &flight{
+		co:           co,
+		key:          key,
+		ctx:          ctx,
+		cancel:       cancel,
+		ready:        make(chan struct{}),
+		participants: 1,
+		joinable:     true,
+	}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// join adds a request to the flight, false if it no longer takes new ones.
+// Called with co.mu held.
+func (f *flight) join() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.joinable {
+		return false
+	}
+	f.participants++
+	return true
+}
+
+// fetch performs the upstream request on behalf of every participant
+func (f *flight) fetch(req *http.Request) {
+	resp, err := f.co.client.Do(req.WithContext(f.ctx))
+
+	f.mu.Lock()
+	f.resp, f.err = resp, err
+	abandoned := f.participants == 0
+	stopSharing := err != nil || abandoned || resp.ContentLength > f.co.maxBytes
+	if stopSharing {
+		f.joinable = false
+	}
+	f.mu.Unlock()
+
+	if stopSharing {
+		f.co.finish(f.key, f)
+	}
+	if abandoned {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		f.cancel()
+	}
+	close(f.ready)
+}
+
+// await waits for the response headers and gives the caller its own view of the response
+func (f *flight) await(req *http.Request) (*http.Response, error) {
+	select {
+	case <-f.ready:
+	case <-req.Context().Done():
+		f.leave()
+		return nil, req.Context().Err()
+	}
+	if f.err != nil {
+		f.leave()
+		return nil, f.err
+	}
+
+	r := &flightReader{f: f, req: req}
+	if f.resp.ContentLength > f.co.maxBytes {
+		// Too large to keep for others: the first reader takes the body, the rest fetch on their own
+		f.mu.Lock()
+		claimed := f.owner != nil
+		if !claimed {
+			f.owner = r
+			r.direct = f.resp.Body
+		}
+		f.mu.Unlock()
+		if claimed {
+			f.leave()
+			return f.co.client.Do(req)
+		}
+	}
+
+	r.stop = context.AfterFunc(req.Context(), func() { r.Close() })
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Body = r
+	return &resp, nil
+}
+
+// leave drops a participant, cancelling the fetch when it was the last one
+func (f *flight) leave() {
+	f.mu.Lock()
+	f.participants--
+	last := f.participants == 0
+	if last {
+		f.joinable = false
+	}
+	// Before the response arrived fetch closes its body itself
+	resp := f.resp
+	f.mu.Unlock()
+
+	if last {
+		f.co.finish(f.key, f)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		f.cancel()
+	}
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	if r.direct != nil {
+		return r.direct.Read(p)
+	}
+
+	f := r.f
+	f.mu.Lock()
+	for {
+		if r.closed {
+			f.mu.Unlock()
+			return 0, http.ErrBodyReadAfterClose
+		}
+		if r.off < len(f.buf) {
+			n := copy(p, f.buf[r.off:])
+			r.off += n
+			f.mu.Unlock()
+			return n, nil
+		}
+		if f.done {
+			err := f.readErr
+			f.mu.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		if f.owner != nil {
+			// Another reader took over the origin body, continue with a fetch of our own
+			f.mu.Unlock()
+			if err := r.fetchRest(); err != nil {
+				return 0, err
+			}
+			return r.direct.Read(p)
+		}
+		if f.pulling {
+			f.cond.Wait()
+			continue
+		}
+		if r.pull() {
+			f.mu.Unlock()
+			return r.Read(p)
+		}
+	}
+}
+
+// pull reads the next chunk from the origin for every reader, f.mu held. It returns
+// true if this reader took over the origin body instead of sharing it.
+func (r *flightReader) pull() bool {
+	f := r.f
+	f.pulling = true
+	if f.chunk == nil {
+		f.chunk = make([]byte, 64<<10)
+	}
+	f.mu.Unlock()
+	n, err := f.resp.Body.Read(f.chunk)
+	f.mu.Lock()
+	f.pulling = false
+	defer f.cond.Broadcast()
+
+	owned := false
+	size := len(f.buf) + n
+	if n > 0 && (int64(size) > f.co.maxBytes || (f.participants == 1 && size > coalesceJoinWindow)) {
+		// Stop sharing: this reader streams the rest straight from the origin, readers
+		// still behind finish the buffer and fetch the remainder themselves
+		owned = true
+		f.owner = r
+		r.pending = slices.Clone(f.chunk[:n])
+		r.direct = f.resp.Body
+		if f.participants == 1 {
+			f.buf = nil
+		}
+	} else {
+		f.buf = append(f.buf, f.chunk[:n]...)
+		if err != nil {
+			f.done = true
+			if err != io.EOF {
+				f.readErr = err
+			}
+			f.resp.Body.Close()
+		}
+	}
+
+	if (owned || f.done) && f.joinable {
+		f.joinable = false
+		// co.mu is taken before f.mu
+		f.mu.Unlock()
+		f.co.finish(f.key, f)
+		f.mu.Lock()
+	}
+	return owned
+}
+
+// fetchRest requests the part of the body this reader hasn't read yet
+func (r *flightReader) fetchRest() error {
+	req := r.req.Clone(r.req.Context())
+	req.Header.Set("Range", "bytes="+strconv.Itoa(r.off)+"-")
+	if etag := r.f.resp.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-Range", etag)
+	}
+
+	resp, err := r.f.co.client.Do(req)
+	if err != nil {
+		return err
+	}
+	first, _, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && ok && first == int64(r.off):
+	case resp.StatusCode == http.StatusOK:
+		// The origin ignores ranges, skip what was already read
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(r.off)); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	default:
+		resp.Body.Close()
+		return errors.New("upstream can't continue coalesced body at byte " + strconv.Itoa(r.off))
+	}
+
+	r.f.mu.Lock()
+	closed := r.closed
+	if !closed {
+		r.direct = resp.Body
+	}
+	r.f.mu.Unlock()
+	if closed {
+		resp.Body.Close()
+		return http.ErrBodyReadAfterClose
+	}
+	return nil
+}
+
+// Close detaches the reader; a shared fetch carries on for the other readers
+func (r *flightReader) Close() error {
+	r.once.Do(func() {
+		if r.stop != nil {
+			r.stop()
+		}
+		f := r.f
+		f.mu.Lock()
+		r.closed = true
+		direct := r.direct
+		f.cond.Broadcast()
+		f.mu.Unlock()
+
+		if direct != nil {
+			direct.Close()
+		}
+		f.leave()
+	})
+	return nil
+}
+
+// isCoalescable checks that a request asks for a whole, unconditional response
+func isCoalescable(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	for _, hName := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if req.Header.Get(hName) != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,312 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	browser := func(ua, referer string) map[string]string {
+		headers := GenerateDynamicHeaders(referer, "")
+		headers["User-Agent"] = ua
+		return headers
+	}
+	minimal := func(ua, referer string) map[string]string {
+		return ApplyHeaderProfile(browser(ua, referer), HeaderProfileMinimal)
+	}
+
+	tests := []struct {
+		name     string
+		url1     string
+		headers1 map[string]string
+		url2     string
+		headers2 map[string]string
+		same     bool
+	}{
+		{
+			name: "different user agents share",
+			url1: "https://cdn.example.com/seg-1.ts", headers1: browser("Firefox", "https://a.example/"),
+			url2: "https://cdn.example.com/seg-1.ts", headers2: browser("Chrome", "https://a.example/"),
+			same: true,
+		},
+		{
+			name: "different urls",
+			url1: "https://cdn.example.com/seg-1.ts", headers1: browser("Firefox", "https://a.example/"),
+			url2: "https://cdn.example.com/seg-2.ts", headers2: browser("Firefox", "https://a.example/"),
+		},
+		{
+			name: "different referers",
+			url1: "https://cdn.example.com/seg-1.ts", headers1: browser("Firefox", "https://a.example/"),
+			url2: "https://cdn.example.com/seg-1.ts", headers2: browser("Firefox", "https://b.example/"),
+		},
+		{
+			name: "different header profiles",
+			url1: "https://cdn.example.com/seg-1.ts", headers1: browser("Firefox", "https://a.example/"),
+			url2: "https://cdn.example.com/seg-1.ts", headers2: minimal("Firefox", "https://a.example/"),
+		},
+		{
+			name: "different cookies",
+			url1: "https://cdn.example.com/seg-1.ts", headers1: map[string]string{"Cookie": "a=1"},
+			url2: "https://cdn.example.com/seg-1.ts", headers2: map[string]string{"Cookie": "a=2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req1, _ := http.NewRequest(http.MethodGet, tt.url1, nil)
+			for k, v := range tt.headers1 {
+				req1.Header.Set(k, v)
+			}
+			req2, _ := http.NewRequest(http.MethodGet, tt.url2, nil)
+			for k, v := range tt.headers2 {
+				req2.Header.Set(k, v)
+			}
+			if same := coalesceKey(req1) == coalesceKey(req2); same != tt.same {
+				t.Errorf("keys equal = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestCoalescerSharesFetch(t *testing.T) {
+	body := strings.Repeat("segment ", 1000)
+	var hits atomic.Int64
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	co := NewCoalescer(srv.Client(), 1<<20)
+	const viewers = 5
+	bodies := make([]string, viewers)
+	var wg sync.WaitGroup
+	for i := range viewers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/seg-1.ts", nil)
+			req.Header.Set("User-Agent", "viewer-"+string(rune('a'+i)))
+			resp, err := co.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			data, _ := io.ReadAll(resp.Body)
+			bodies[i] = string(data)
+		}()
+	}
+	waitFor(t, "viewers to join", func() bool { return co.Stats().Shared == viewers-1 })
+	close(release)
+	wg.Wait()
+
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream fetches = %d, want 1", got)
+	}
+	for i, got := range bodies {
+		if got != body {
+			t.Errorf("viewer %d got %d bytes, want %d", i, len(got), len(body))
+		}
+	}
+	waitFor(t, "flight to finish", func() bool { return co.Stats().InFlight == 0 })
+}
+
+func TestCoalescerLeaveBeforeHeaders(t *testing.T) {
+	cancelled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer srv.Close()
+
+	co := NewCoalescer(srv.Client(), 1<<20)
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	for _, ctx := range []context.Context{ctx1, ctx2} {
+		go func() {
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/seg-1.ts", nil)
+			_, err := co.Do(req)
+			errs <- err
+		}()
+	}
+	waitFor(t, "second request to join", func() bool { return co.Stats().Shared == 1 })
+
+	// The request that started the fetch leaves, the other one still waits for it
+	cancel1()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("leaving request got %v, want context.Canceled", err)
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("upstream fetch cancelled while a request was still waiting")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The last one leaving cancels the fetch
+	cancel2()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("leaving request got %v, want context.Canceled", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream fetch not cancelled after every request left")
+	}
+	waitFor(t, "flight to finish", func() bool { return co.Stats().InFlight == 0 })
+}
+
+// chunkedBody writes body in small flushed chunks so it has no Content-Length
+func chunkedBody(w http.ResponseWriter, body []byte) {
+	for len(body) > 0 {
+		n := min(len(body), 16<<10)
+		w.Write(body[:n])
+		w.(http.Flusher).Flush()
+		body = body[n:]
+	}
+}
+
+func TestCoalescerTakeover(t *testing.T) {
+	body := make([]byte, 300<<10)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+
+	tests := []struct {
+		name     string
+		maxBytes int64
+		// origin answers requests for the rest of the body
+		ranges        bool
+		declaredSize  bool // Content-Length is sent with the full response
+		wantFetches   int64
+		wantRangeFrom string
+	}{
+		{name: "resumed with a range", maxBytes: 100 << 10, ranges: true, wantFetches: 2, wantRangeFrom: "bytes="},
+		{name: "origin ignores ranges", maxBytes: 100 << 10, wantFetches: 2, wantRangeFrom: "bytes="},
+		{name: "declared over the limit", maxBytes: 100 << 10, declaredSize: true, wantFetches: 2},
+		{name: "within the limit", maxBytes: 1 << 20, wantFetches: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int64
+			var rangeHeader atomic.Value
+			release := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("Range") != "" {
+					rangeHeader.Store(r.Header.Get("Range"))
+					if tt.ranges {
+						http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+						return
+					}
+				} else {
+					<-release
+				}
+				if tt.declaredSize {
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+					w.Write(body)
+					return
+				}
+				chunkedBody(w, body)
+			}))
+			defer srv.Close()
+
+			co := NewCoalescer(srv.Client(), tt.maxBytes)
+			responses := make(chan *http.Response, 2)
+			for range 2 {
+				go func() {
+					req, _ := http.NewRequest(http.MethodGet, srv.URL+"/seg-1.ts", nil)
+					resp, err := co.Do(req)
+					if err != nil {
+						t.Error(err)
+					}
+					responses <- resp
+				}()
+			}
+			waitFor(t, "second request to join", func() bool { return co.Stats().Shared == 1 })
+			close(release)
+
+			// The first reader runs ahead, the second one only starts once it is done
+			for range 2 {
+				resp := <-responses
+				if resp == nil {
+					t.FailNow()
+				}
+				data, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatalf("reading body: %v", err)
+				}
+				if !bytes.Equal(data, body) {
+					t.Fatalf("got %d bytes, want the %d byte body", len(data), len(body))
+				}
+			}
+
+			if got := fetches.Load(); got != tt.wantFetches {
+				t.Errorf("upstream fetches = %d, want %d", got, tt.wantFetches)
+			}
+			got, _ := rangeHeader.Load().(string)
+			if !strings.HasPrefix(got, tt.wantRangeFrom) || (tt.wantRangeFrom == "") != (got == "") {
+				t.Errorf("range request = %q, want one starting with %q", got, tt.wantRangeFrom)
+			}
+		})
+	}
+}
+
+func TestCoalescerLoneReaderLeavesJoinWindow(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 2*coalesceJoinWindow)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunkedBody(w, body)
+	}))
+	defer srv.Close()
+
+	co := NewCoalescer(srv.Client(), 64<<20)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/seg-1.ts", nil)
+	resp, err := co.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.CopyN(io.Discard, resp.Body, coalesceJoinWindow+1); err != nil {
+		t.Fatal(err)
+	}
+	// Past the join window the reader owns the body and later requests fetch their own
+	if got := co.Stats().InFlight; got != 0 {
+		t.Errorf("in-flight fetches = %d, want 0 once the reader left the join window", got)
+	}
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := coalesceJoinWindow + 1 + len(rest); got != len(body) {
+		t.Errorf("read %d bytes, want %d", got, len(body))
+	}
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ConditionalHeaders are the client request headers forwarded upstream for revalidation.
+var ConditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// IsNotModified evaluates a request's If-None-Match / If-Modified-Since headers
+// against an object's validators (RFC 9110 section 13.2.2). If-None-Match takes
+// precedence and uses the weak comparison.
+func IsNotModified(reqHeader http.Header, etag, lastModified string) bool {
+	if inm := reqHeader.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETag(candidate) == weakETag(etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := reqHeader.Get("If-Modified-Since"); ims != "" && lastModified != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(lastModified)
+		if err != nil {
+			return false
+		}
+		return !modified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// IfRangeMatches reports whether an If-Range value still matches the object,
+// meaning the requested range may be served. A strong ETag or the exact
+// Last-Modified date is required.
+func IfRangeMatches(ifRange, etag, lastModified string) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+	return lastModified != "" && ifRange == lastModified
+}
+
+func weakETag(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
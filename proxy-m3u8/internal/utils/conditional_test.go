@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsNotModified(t *testing.T) {
+	const (
+		etag         = `"v1"`
+		lastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
+	)
+
+	tests := []struct {
+		name         string
+		header       map[string]string
+		etag         string
+		lastModified string
+		want         bool
+	}{
+		{name: "no conditions", etag: etag, lastModified: lastModified, want: false},
+		{name: "etag matches", header: map[string]string{"If-None-Match": `"v1"`}, etag: etag, want: true},
+		{name: "etag differs", header: map[string]string{"If-None-Match": `"v2"`}, etag: etag, want: false},
+		{name: "one of several matches", header: map[string]string{"If-None-Match": `"v0", "v1"`}, etag: etag, want: true},
+		{name: "weak request matches strong etag", header: map[string]string{"If-None-Match": `W/"v1"`}, etag: etag, want: true},
+		{name: "strong request matches weak etag", header: map[string]string{"If-None-Match": `"v1"`}, etag: `W/"v1"`, want: true},
+		{name: "wildcard", header: map[string]string{"If-None-Match": "*"}, etag: etag, want: true},
+		{name: "object without etag", header: map[string]string{"If-None-Match": "*"}, lastModified: lastModified, want: false},
+		{
+			name:         "if-none-match takes precedence",
+			header:       map[string]string{"If-None-Match": `"v2"`, "If-Modified-Since": lastModified},
+			etag:         etag,
+			lastModified: lastModified,
+			want:         false,
+		},
+		{name: "not modified since", header: map[string]string{"If-Modified-Since": lastModified}, lastModified: lastModified, want: true},
+		{
+			name:         "modified later",
+			header:       map[string]string{"If-Modified-Since": "Tue, 20 Oct 2015 07:28:00 GMT"},
+			lastModified: lastModified,
+			want:         false,
+		},
+		{
+			name:         "client copy newer",
+			header:       map[string]string{"If-Modified-Since": "Thu, 22 Oct 2015 07:28:00 GMT"},
+			lastModified: lastModified,
+			want:         true,
+		},
+		{name: "invalid date", header: map[string]string{"If-Modified-Since": "yesterday"}, lastModified: lastModified, want: false},
+		{name: "object without last-modified", header: map[string]string{"If-Modified-Since": lastModified}, etag: etag, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range tt.header {
+				header.Set(name, value)
+			}
+			if got := IsNotModified(header, tt.etag, tt.lastModified); got != tt.want {
+				t.Errorf("IsNotModified(%v, %q, %q) = %v, want %v", tt.header, tt.etag, tt.lastModified, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	const lastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
+
+	tests := []struct {
+		name         string
+		ifRange      string
+		etag         string
+		lastModified string
+		want         bool
+	}{
+		{name: "no if-range", etag: `"v1"`, want: true},
+		{name: "strong etag matches", ifRange: `"v1"`, etag: `"v1"`, want: true},
+		{name: "strong etag differs", ifRange: `"v1"`, etag: `"v2"`, want: false},
+		{name: "weak etag never matches", ifRange: `"v1"`, etag: `W/"v1"`, want: false},
+		{name: "date matches", ifRange: lastModified, lastModified: lastModified, want: true},
+		{name: "date differs", ifRange: "Tue, 20 Oct 2015 07:28:00 GMT", lastModified: lastModified, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IfRangeMatches(tt.ifRange, tt.etag, tt.lastModified); got != tt.want {
+				t.Errorf("IfRangeMatches(%q, %q, %q) = %v, want %v", tt.ifRange, tt.etag, tt.lastModified, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+)
+
+// PlaylistContentTypes are the MIME types origins use for HLS playlists.
+var PlaylistContentTypes = []string{
+	"application/vnd.apple.mpegurl",
+	"application/x-mpegurl",
+	"audio/mpegurl",
+	"audio/x-mpegurl",
+}
+
+// PlaylistSniffLength is the number of bytes needed by SniffPlaylist.
+const PlaylistSniffLength = 512
+
+var (
+	playlistMagic = []byte("#EXTM3U")
+	utf8BOM       = []byte("\xEF\xBB\xBF")
+)
+
+// IsPlaylistContentType checks if a Content-Type header value denotes an HLS playlist.
+func IsPlaylistContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	}
+	mediaType = strings.ToLower(mediaType)
+
+	for _, ct := range PlaylistContentTypes {
+		if mediaType == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaContentTypePrefixes mark bodies that are known not to be playlists, so
+// they are streamed without waiting for a sniff buffer to fill
+var mediaContentTypePrefixes = []string{"video/", "audio/", "image/", "font/", "application/mp4"}
+
+// NeedsPlaylistSniff checks if a response's Content-Type leaves open whether the body
+// is a playlist: it is missing or generic, e.g. text/plain or application/octet-stream.
+func NeedsPlaylistSniff(contentType string) bool {
+	if IsPlaylistContentType(contentType) {
+		return false
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	for _, prefix := range mediaContentTypePrefixes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// SniffPlaylist checks if the beginning of a body looks like an HLS playlist,
+// i.e. starts with the #EXTM3U header after an optional BOM and whitespace.
+func SniffPlaylist(prefix []byte) bool {
+	prefix = bytes.TrimPrefix(prefix, utf8BOM)
+	prefix = bytes.TrimLeft(prefix, " \t\r\n")
+	return bytes.HasPrefix(prefix, playlistMagic)
+}
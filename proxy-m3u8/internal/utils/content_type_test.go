@@ -0,0 +1,85 @@
+package utils
+
+import "testing"
+
+func TestIsPlaylistContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/vnd.apple.mpegurl", true},
+		{"application/x-mpegURL", true},
+		{"audio/mpegurl", true},
+		{"audio/x-mpegurl", true},
+		{"application/vnd.apple.mpegurl; charset=utf-8", true},
+		{" Application/X-MpegURL ;charset=UTF-8", true},
+		{"application/vnd.apple.mpegurl; charset", true},
+		{"video/mp2t", false},
+		{"text/plain", false},
+		{"application/octet-stream", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := IsPlaylistContentType(tt.contentType); got != tt.want {
+				t.Errorf("IsPlaylistContentType(%q) = %v, want %v", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNeedsPlaylistSniff(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"", true},
+		{"text/plain", true},
+		{"text/plain; charset=utf-8", true},
+		{"application/octet-stream", true},
+		{"binary/octet-stream", true},
+		{"application/vnd.apple.mpegurl", false},
+		{"video/mp2t", false},
+		{"Video/MP2T", false},
+		{"audio/aac", false},
+		{"image/jpeg", false},
+		{"font/woff2", false},
+		{"application/mp4", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := NeedsPlaylistSniff(tt.contentType); got != tt.want {
+				t.Errorf("NeedsPlaylistSniff(%q) = %v, want %v", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniffPlaylist(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   bool
+	}{
+		{name: "playlist", prefix: "#EXTM3U\n#EXT-X-VERSION:3\n", want: true},
+		{name: "byte order mark", prefix: "\xEF\xBB\xBF#EXTM3U\n", want: true},
+		{name: "leading whitespace", prefix: "\r\n \t#EXTM3U\n", want: true},
+		{name: "bom and whitespace", prefix: "\xEF\xBB\xBF\n#EXTM3U", want: true},
+		{name: "header only", prefix: "#EXTM3U", want: true},
+		{name: "truncated header", prefix: "#EXTM3"},
+		{name: "lowercase", prefix: "#extm3u\n"},
+		{name: "transport stream", prefix: "G@\x11\x10\x00"},
+		{name: "html error page", prefix: "<html><body>#EXTM3U</body></html>"},
+		{name: "empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffPlaylist([]byte(tt.prefix)); got != tt.want {
+				t.Errorf("SniffPlaylist(%q) = %v, want %v", tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,424 @@
+package utils
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	diskDataSuffix = ".data"
+	diskMetaSuffix = ".meta"
+	diskTempSuffix = ".tmp"
+)
+
+// DiskCache is a size-capped on-disk cache. Every object is stored as a data file
+// plus a JSON sidecar; both are written to temp files and renamed into place, the
+// sidecar last, so a crash never leaves a half-written entry behind a valid sidecar.
+type DiskCache struct {
+	dir           string
+	maxBytes      int64
+	maxEntryBytes int64
+
+	mu    sync.Mutex
+	index map[string]*list.Element
+	order *list.List // front is the most recently used item
+	size  int64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+
+	// writeErr is the error of the last write, cleared by the next successful one
+	writeMu  sync.Mutex
+	writeErr error
+}
+
+// diskMeta is the sidecar describing a data file
+type diskMeta struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Playlist     bool      `json:"playlist,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type diskItem struct {
+	name string // file name without suffix
+	meta diskMeta
+	hits int64
+}
+
+// OpenDiskCache opens (creating if needed) a disk cache in dir and rebuilds its
+// index from the sidecar files, discarding leftovers of interrupted writes.
+func OpenDiskCache(dir string, maxBytes, maxEntryBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create disk cache directory: %w", err)
+	}
+	if maxEntryBytes <= 0 || maxEntryBytes > maxBytes {
+		maxEntryBytes = maxBytes
+	}
+
+	dc := &DiskCache{
+		dir:           dir,
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		index:         make(map[string]*list.Element),
+		order:         list.New(),
+	}
+	if err := dc.rebuildIndex(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// rebuildIndex scans the cache directory. Entries are ordered by the modification
+// time of their sidecar, which is refreshed on access, to restore the LRU order.
+func (dc *DiskCache) rebuildIndex() error {
+	dirEntries, err := os.ReadDir(dc.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read disk cache directory: %w", err)
+	}
+
+	type loaded struct {
+		item    *diskItem
+		touched time.Time
+	}
+	var items []loaded
+	metas := make(map[string]bool)
+	now := time.Now()
+
+	for _, de := range dirEntries {
+		name := de.Name()
+		switch {
+		case strings.HasSuffix(name, diskTempSuffix):
+			// Interrupted write
+			os.Remove(filepath.Join(dc.dir, name))
+		case strings.HasSuffix(name, diskMetaSuffix):
+			base := strings.TrimSuffix(name, diskMetaSuffix)
+			metas[base] = true
+
+			item, touched, ok := dc.loadItem(base)
+			if !ok || now.After(item.meta.ExpiresAt) {
+				dc.removeFiles(base)
+				continue
+			}
+			items = append(items, loaded{item: item, touched: touched})
+		}
+	}
+
+	// Data files without a sidecar were never committed
+	for _, de := range dirEntries {
+		name := de.Name()
+		if strings.HasSuffix(name, diskDataSuffix) && !metas[strings.TrimSuffix(name, diskDataSuffix)] {
+			os.Remove(filepath.Join(dc.dir, name))
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].touched.After(items[j].touched) })
+
+	dc.mu.Lock()
+	for _, l := range items {
+		dc.index[l.item.meta.Key] = dc.order.PushBack(l.item)
+		dc.size += l.item.meta.Size
+	}
+	evicted := dc.evictLocked(0)
+	entries, size := len(dc.index), dc.size
+	dc.mu.Unlock()
+	dc.removeFiles(evicted...)
+
+	slog.Info("Disk cache indexed", "entries", entries, "bytes", size, "dir", dc.dir)
+	return nil
+}
+
+// loadItem reads and validates a sidecar against its data file
+func (dc *DiskCache) loadItem(base string) (*diskItem, time.Time, bool) {
+	metaPath := filepath.Join(dc.dir, base+diskMetaSuffix)
+	raw, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(raw, &meta); err != nil || meta.Key == "" || fileName(meta.Key) != base {
+		return nil, time.Time{}, false
+	}
+
+	dataInfo, err := os.Stat(filepath.Join(dc.dir, base+diskDataSuffix))
+	if err != nil || dataInfo.Size() != meta.Size {
+		return nil, time.Time{}, false
+	}
+
+	metaInfo, err := os.Stat(metaPath)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return &diskItem{name: base, meta: meta}, metaInfo.ModTime(), true
+}
+
+// Enabled reports whether the cache stores anything at all
+func (dc *DiskCache) Enabled() bool {
+	return dc.maxBytes > 0
+}
+
+// MaxEntryBytes returns the size of the largest object the cache accepts
+func (dc *DiskCache) MaxEntryBytes() int64 {
+	return dc.maxEntryBytes
+}
+
+// GetEntry reads an entry from disk if it exists and hasn't expired
+func (dc *DiskCache) GetEntry(key string) (*CacheEntry, bool) {
+	dc.mu.Lock()
+	elem, exists := dc.index[key]
+	if !exists {
+		dc.mu.Unlock()
+		dc.misses.Add(1)
+		return nil, false
+	}
+	item := elem.Value.(*diskItem)
+	if time.Now().After(item.meta.ExpiresAt) {
+		dc.removeLocked(elem)
+		dc.mu.Unlock()
+		dc.removeFiles(item.name)
+		dc.misses.Add(1)
+		return nil, false
+	}
+	item.hits++
+	dc.order.MoveToFront(elem)
+	meta := item.meta
+	dc.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(dc.dir, item.name+diskDataSuffix))
+	if err != nil || int64(len(data)) != meta.Size {
+		// Removed or truncated behind our back
+		dc.Delete(key)
+		dc.misses.Add(1)
+		return nil, false
+	}
+
+	// Persist the access for the LRU order after a restart
+	now := time.Now()
+	os.Chtimes(filepath.Join(dc.dir, item.name+diskMetaSuffix), now, now)
+
+	dc.hits.Add(1)
+	return &CacheEntry{
+		Data:         data,
+		ContentType:  meta.ContentType,
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+		Playlist:     meta.Playlist,
+		ExpiresAt:    meta.ExpiresAt,
+	}, true
+}
+
+// Contains reports whether an unexpired entry exists, leaving the counters and the LRU order alone
+func (dc *DiskCache) Contains(key string) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	elem, exists := dc.index[key]
+	return exists && time.Now().Before(elem.Value.(*diskItem).meta.ExpiresAt)
+}
+
+// hitCount returns how often a key was read from disk
+func (dc *DiskCache) hitCount(key string) int64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if elem, exists := dc.index[key]; exists {
+		return elem.Value.(*diskItem).hits
+	}
+	return 0
+}
+
+// SetEntry writes an entry to disk atomically, evicting other entries until the
+// size cap is respected
+func (dc *DiskCache) SetEntry(key string, entry *CacheEntry, ttl time.Duration) {
+	size := int64(len(entry.Data))
+	if !dc.Enabled() || ttl <= 0 || size > dc.maxEntryBytes {
+		return
+	}
+
+	meta := diskMeta{
+		Key:          key,
+		Size:         size,
+		ContentType:  entry.ContentType,
+		ETag:         entry.ETag,
+		LastModified: entry.LastModified,
+		Playlist:     entry.Playlist,
+		ExpiresAt:    time.Now().Add(ttl),
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+
+	base := fileName(key)
+	if err := dc.writeAtomic(base+diskDataSuffix, entry.Data); err != nil {
+		slog.Warn("Disk cache write failed", "file", base, "error", err)
+		dc.setWriteErr(err)
+		return
+	}
+	if err := dc.writeAtomic(base+diskMetaSuffix, metaBytes); err != nil {
+		slog.Warn("Disk cache write failed", "file", base, "error", err)
+		dc.setWriteErr(err)
+		os.Remove(filepath.Join(dc.dir, base+diskDataSuffix))
+		return
+	}
+	dc.setWriteErr(nil)
+
+	dc.mu.Lock()
+	if elem, exists := dc.index[key]; exists {
+		// Files were replaced in place, only drop the index entry
+		dc.size -= elem.Value.(*diskItem).meta.Size
+		dc.order.Remove(elem)
+		delete(dc.index, key)
+	}
+	evicted := dc.evictLocked(size)
+	dc.index[key] = dc.order.PushFront(&diskItem{name: base, meta: meta})
+	dc.size += size
+	dc.mu.Unlock()
+
+	dc.removeFiles(evicted...)
+}
+
+func (dc *DiskCache) setWriteErr(err error) {
+	dc.writeMu.Lock()
+	defer dc.writeMu.Unlock()
+	dc.writeErr = err
+}
+
+// Health reports a missing cache directory or the last write having failed, e.g. on a full disk
+func (dc *DiskCache) Health() error {
+	if _, err := os.Stat(dc.dir); err != nil {
+		return fmt.Errorf("disk cache directory: %w", err)
+	}
+	dc.writeMu.Lock()
+	defer dc.writeMu.Unlock()
+	if dc.writeErr != nil {
+		return fmt.Errorf("disk cache write failed: %w", dc.writeErr)
+	}
+	return nil
+}
+
+// Delete removes a key and its files
+func (dc *DiskCache) Delete(key string) {
+	dc.mu.Lock()
+	elem, exists := dc.index[key]
+	if !exists {
+		dc.mu.Unlock()
+		return
+	}
+	name := dc.removeLocked(elem)
+	dc.mu.Unlock()
+
+	dc.removeFiles(name)
+}
+
+// Cleanup removes expired entries
+func (dc *DiskCache) Cleanup() {
+	var expired []string
+	now := time.Now()
+
+	dc.mu.Lock()
+	for _, elem := range dc.index {
+		if now.After(elem.Value.(*diskItem).meta.ExpiresAt) {
+			expired = append(expired, dc.removeLocked(elem))
+		}
+	}
+	dc.mu.Unlock()
+
+	dc.removeFiles(expired...)
+}
+
+// Stats returns the current size and hit/miss counters
+func (dc *DiskCache) Stats() CacheStats {
+	dc.mu.Lock()
+	entries, size := len(dc.index), dc.size
+	dc.mu.Unlock()
+
+	return CacheStats{
+		Entries:   entries,
+		Bytes:     size,
+		MaxBytes:  dc.maxBytes,
+		Policy:    string(EvictLRU),
+		Hits:      dc.hits.Load(),
+		Misses:    dc.misses.Load(),
+		Evictions: dc.evictions.Load(),
+	}
+}
+
+// evictLocked drops least recently used entries until incoming bytes fit and
+// returns the file names to remove once the lock is released
+func (dc *DiskCache) evictLocked(incoming int64) []string {
+	var evicted []string
+	for dc.size+incoming > dc.maxBytes && dc.order.Len() > 0 {
+		evicted = append(evicted, dc.removeLocked(dc.order.Back()))
+		dc.evictions.Add(1)
+	}
+	return evicted
+}
+
+// removeLocked drops an element from the index and returns its file name; the
+// caller must hold the lock and remove the files after releasing it
+func (dc *DiskCache) removeLocked(elem *list.Element) string {
+	item := dc.order.Remove(elem).(*diskItem)
+	delete(dc.index, item.meta.Key)
+	dc.size -= item.meta.Size
+	return item.name
+}
+
+// removeFiles unlinks entries' files, without holding the lock so lookups aren't
+// stalled behind the disk
+func (dc *DiskCache) removeFiles(bases ...string) {
+	for _, base := range bases {
+		// Sidecar first so a crash in between leaves an orphaned data file, not a dangling entry
+		os.Remove(filepath.Join(dc.dir, base+diskMetaSuffix))
+		os.Remove(filepath.Join(dc.dir, base+diskDataSuffix))
+	}
+}
+
+// writeAtomic writes a file through a synced temp file and a rename
+func (dc *DiskCache) writeAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(dc.dir, name+".*"+diskTempSuffix)
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(dc.dir, name)); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// fileName maps a cache key (an upstream URL) to a safe file name
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
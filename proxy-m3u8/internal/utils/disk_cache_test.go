@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// diskFiles lists the file names in a cache directory
+func diskFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func testEntry(data string) *CacheEntry {
+	return &CacheEntry{Data: []byte(data), ContentType: "video/mp2t", ETag: `"v1"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+}
+
+func TestDiskCacheRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	dc, err := OpenDiskCache(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc.SetEntry("https://cdn.example.com/seg-1.ts", testEntry("segment one"), time.Hour)
+	entry, ok := dc.GetEntry("https://cdn.example.com/seg-1.ts")
+	if !ok {
+		t.Fatal("entry not found after SetEntry")
+	}
+	want := testEntry("segment one")
+	if string(entry.Data) != string(want.Data) || entry.ContentType != want.ContentType ||
+		entry.ETag != want.ETag || entry.LastModified != want.LastModified {
+		t.Errorf("GetEntry = %+v, want %+v", entry, want)
+	}
+
+	// One data file and one sidecar, no temp files left behind
+	files := diskFiles(t, dir)
+	base := fileName("https://cdn.example.com/seg-1.ts")
+	if want := []string{base + diskDataSuffix, base + diskMetaSuffix}; !slices.Equal(files, want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+
+	if _, ok := dc.GetEntry("https://cdn.example.com/seg-2.ts"); ok {
+		t.Error("GetEntry found a key that was never set")
+	}
+	if stats := dc.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes != int64(len("segment one")) {
+		t.Errorf("Stats = %+v", stats)
+	}
+}
+
+func TestDiskCacheRejects(t *testing.T) {
+	dc, err := OpenDiskCache(t.TempDir(), 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc.SetEntry("too-large", testEntry("more than ten bytes"), time.Hour)
+	dc.SetEntry("no-ttl", testEntry("short"), 0)
+	if stats := dc.Stats(); stats.Entries != 0 {
+		t.Errorf("stored %d entries, want oversized and TTL-less entries skipped", stats.Entries)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	dc, err := OpenDiskCache(dir, 30, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		dc.SetEntry(key, testEntry("0123456789"), time.Hour)
+	}
+	// Reading a makes b the least recently used entry
+	dc.GetEntry("a")
+	dc.SetEntry("d", testEntry("0123456789"), time.Hour)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if got := dc.Contains(key); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", key, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileName("b")+diskDataSuffix)); !os.IsNotExist(err) {
+		t.Errorf("evicted entry's data file still exists: %v", err)
+	}
+	if stats := dc.Stats(); stats.Evictions != 1 || stats.Bytes != 30 {
+		t.Errorf("Stats = %+v, want 1 eviction and 30 bytes", stats)
+	}
+
+	// Replacing an entry doesn't count its old size twice
+	dc.SetEntry("a", testEntry("0123456789"), time.Hour)
+	if stats := dc.Stats(); stats.Evictions != 1 || stats.Bytes != 30 {
+		t.Errorf("Stats after replacing = %+v, want 1 eviction and 30 bytes", stats)
+	}
+}
+
+func TestDiskCacheExpiry(t *testing.T) {
+	dc, err := OpenDiskCache(t.TempDir(), 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc.SetEntry("short", testEntry("segment"), 10*time.Millisecond)
+	dc.SetEntry("long", testEntry("segment"), time.Hour)
+	time.Sleep(20 * time.Millisecond)
+
+	if dc.Contains("short") {
+		t.Error("Contains reported an expired entry")
+	}
+	dc.Cleanup()
+	if stats := dc.Stats(); stats.Entries != 1 {
+		t.Errorf("%d entries after Cleanup, want 1", stats.Entries)
+	}
+}
+
+func TestDiskCacheRebuild(t *testing.T) {
+	dir := t.TempDir()
+	dc, err := OpenDiskCache(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "truncated", "corrupt"} {
+		dc.SetEntry(key, testEntry("0123456789"), time.Hour)
+	}
+	dc.SetEntry("expired", testEntry("0123456789"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	// Sidecar times carry the LRU order across restarts: a newest, then c, then b
+	now := time.Now()
+	for key, age := range map[string]time.Duration{"a": time.Minute, "c": 2 * time.Minute, "b": 3 * time.Minute} {
+		touched := now.Add(-age)
+		os.Chtimes(filepath.Join(dir, fileName(key)+diskMetaSuffix), touched, touched)
+	}
+
+	// Damage left by crashes and other processes
+	os.WriteFile(filepath.Join(dir, fileName("truncated")+diskDataSuffix), []byte("01234"), 0o644)
+	os.WriteFile(filepath.Join(dir, fileName("corrupt")+diskMetaSuffix), []byte("{not json"), 0o644)
+	os.WriteFile(filepath.Join(dir, fileName("orphan")+diskDataSuffix), []byte("never committed"), 0o644)
+	os.WriteFile(filepath.Join(dir, fileName("a")+diskDataSuffix+".123"+diskTempSuffix), []byte("half"), 0o644)
+
+	// Reopening with room for two entries keeps the two most recently used
+	reopened, err := OpenDiskCache(dir, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "truncated": false, "corrupt": false, "expired": false} {
+		if got := reopened.Contains(key); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", key, got, want)
+		}
+	}
+	if entry, ok := reopened.GetEntry("a"); !ok || string(entry.Data) != "0123456789" || entry.ETag != `"v1"` {
+		t.Errorf("GetEntry(a) = %+v, %v after reopening", entry, ok)
+	}
+
+	// Only the files of the surviving entries are left
+	var want []string
+	for _, key := range []string{"a", "c"} {
+		want = append(want, fileName(key)+diskDataSuffix, fileName(key)+diskMetaSuffix)
+	}
+	slices.Sort(want)
+	if got := diskFiles(t, dir); !slices.Equal(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	if stats := reopened.Stats(); stats.Entries != 2 || stats.Bytes != 20 {
+		t.Errorf("Stats = %+v, want 2 entries and 20 bytes", stats)
+	}
+}
+
+func TestDiskCacheDamagedEntry(t *testing.T) {
+	dir := t.TempDir()
+	dc, err := OpenDiskCache(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.SetEntry("a", testEntry("0123456789"), time.Hour)
+
+	// A data file truncated behind the cache's back is a miss and is dropped
+	os.WriteFile(filepath.Join(dir, fileName("a")+diskDataSuffix), []byte("01234"), 0o644)
+	if _, ok := dc.GetEntry("a"); ok {
+		t.Error("GetEntry returned a truncated entry")
+	}
+	if dc.Contains("a") {
+		t.Error("truncated entry still indexed")
+	}
+}
+
+func TestDiskCacheWriteFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	dc, err := OpenDiskCache(dir, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Health(); err != nil {
+		t.Fatalf("Health = %v", err)
+	}
+
+	// Writes to a vanished directory fail without indexing anything
+	os.RemoveAll(dir)
+	dc.SetEntry("a", testEntry("0123456789"), time.Hour)
+	if dc.Contains("a") {
+		t.Error("failed write was indexed")
+	}
+	if err := dc.Health(); err == nil {
+		t.Error("Health = nil after a failed write")
+	}
+
+	// The next successful write clears the error
+	os.MkdirAll(dir, 0o755)
+	dc.SetEntry("a", testEntry("0123456789"), time.Hour)
+	if err := dc.Health(); err != nil {
+		t.Errorf("Health = %v after a successful write", err)
+	}
+	for _, name := range diskFiles(t, dir) {
+		if strings.HasSuffix(name, diskTempSuffix) {
+			t.Errorf("temp file %s left behind", name)
+		}
+	}
+}
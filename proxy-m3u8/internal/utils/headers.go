@@ -2,6 +2,7 @@ package utils
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -20,7 +21,16 @@ var userAgents = []string{
 }
 
 // Session store for consistent headers
-var sessionStore = make(map[string]string)
+var (
+	sessionMu    sync.Mutex
+	sessionStore = make(map[string]string)
+)
+
+// Header profiles select how much of the browser disguise is sent upstream
+const (
+	HeaderProfileBrowser = "browser" // Full browser-like headers (default)
+	HeaderProfileMinimal = "minimal" // Only User-Agent, Accept and Referer
+)
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
@@ -33,6 +43,9 @@ func GetRandomUserAgent() string {
 
 // GetSessionUserAgent returns a consistent User-Agent for a session
 func GetSessionUserAgent(sessionID string) string {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+
 	if ua, exists := sessionStore[sessionID]; exists {
 		return ua
 	}
@@ -78,6 +91,22 @@ func GenerateDynamicHeaders(referer, sessionID string) map[string]string {
 	return headers
 }
 
+// ApplyHeaderProfile trims generated headers down to a header profile.
+// Unknown profiles keep the full browser headers.
+func ApplyHeaderProfile(headers map[string]string, profile string) map[string]string {
+	if profile != HeaderProfileMinimal {
+		return headers
+	}
+	for key := range headers {
+		switch key {
+		case "User-Agent", "Accept", "Referer":
+		default:
+			delete(headers, key)
+		}
+	}
+	return headers
+}
+
 // Cleanup old sessions (optional, for memory management)
 func CleanupOldSessions() {
 	// This could be called periodically to clean up old sessions
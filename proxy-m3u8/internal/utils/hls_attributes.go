@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"strings"
+)
+
+// URIAttributeTags lists the HLS tags whose attribute lists may carry a URI attribute
+// that has to be routed through the proxy.
+var URIAttributeTags = []string{
+	"#EXT-X-KEY",
+	"#EXT-X-MAP",
+	"#EXT-X-MEDIA",
+	"#EXT-X-I-FRAME-STREAM-INF",
+	"#EXT-X-SESSION-KEY",
+	"#EXT-X-SESSION-DATA",
+	"#EXT-X-PRELOAD-HINT",
+	"#EXT-X-PART",
+	"#EXT-X-RENDITION-REPORT",
+}
+
+// HLSAttribute is a single NAME=VALUE pair of an HLS attribute list.
+type HLSAttribute struct {
+	Name   string
+	Value  string // Value without surrounding quotes
+	Quoted bool
+
+	// Byte offsets of the raw value (including quotes) inside the attribute list
+	valueStart int
+	valueEnd   int
+}
+
+// ParseAttributeList parses an HLS attribute list (RFC 8216 section 4.2), e.g.
+// METHOD=AES-128,URI="key.bin",IV=0x1234. Quoted values may contain commas.
+// Malformed trailing input is ignored rather than rejected.
+func ParseAttributeList(list string) []HLSAttribute {
+	var attrs []HLSAttribute
+	i := 0
+	n := len(list)
+
+	for i < n {
+		// Skip separators and whitespace before the attribute name
+		for i < n && (list[i] == ',' || list[i] == ' ' || list[i] == '\t') {
+			i++
+		}
+		if i >= n {
+			break
+		}
+
+		nameStart := i
+		for i < n && list[i] != '=' && list[i] != ',' {
+			i++
+		}
+		name := strings.TrimSpace(list[nameStart:i])
+		if i >= n || list[i] != '=' {
+			// Attribute without a value, skip it
+			continue
+		}
+		i++ // skip '='
+
+		attr := HLSAttribute{Name: name, valueStart: i}
+		if i < n && list[i] == '"' {
+			closing := strings.IndexByte(list[i+1:], '"')
+			if closing < 0 {
+				// Unterminated quoted string, take the rest of the line
+				attr.Value = list[i+1:]
+				attr.Quoted = true
+				attr.valueEnd = n
+				attrs = append(attrs, attr)
+				break
+			}
+			attr.Value = list[i+1 : i+1+closing]
+			attr.Quoted = true
+			i = i + 1 + closing + 1
+		} else {
+			valueStart := i
+			for i < n && list[i] != ',' {
+				i++
+			}
+			attr.Value = strings.TrimSpace(list[valueStart:i])
+		}
+		attr.valueEnd = i
+		attrs = append(attrs, attr)
+	}
+
+	return attrs
+}
+
+// splitTag splits a tag line into the tag name and its attribute list.
+// ok is false when the line carries no attribute list.
+func splitTag(line string) (tag, attributes string, ok bool) {
+	idx := strings.IndexByte(line, ':')
+	if idx < 0 {
+		return line, "", false
+	}
+	return line[:idx], line[idx+1:], true
+}
+
+// HasURIAttributes reports whether the tag line belongs to a tag that may carry URI attributes.
+func HasURIAttributes(line string) bool {
+	tag, _, ok := splitTag(line)
+	if !ok {
+		return false
+	}
+	for _, t := range URIAttributeTags {
+		if tag == t {
+			return true
+		}
+	}
+	return false
+}
+
+// RewriteURIAttributes replaces the value of every URI attribute on a tag line
+// with the result of rewrite. Everything else on the line is kept byte-identical.
+// If rewrite returns the value unchanged the attribute is left as-is.
+func RewriteURIAttributes(line string, rewrite func(uri string) string) string {
+	tag, list, ok := splitTag(line)
+	if !ok {
+		return line
+	}
+
+	attrs := ParseAttributeList(list)
+	var out strings.Builder
+	last := 0
+	changed := false
+
+	for _, attr := range attrs {
+		if attr.Name != "URI" {
+			continue
+		}
+		rewritten := rewrite(attr.Value)
+		if rewritten == attr.Value {
+			continue
+		}
+		out.WriteString(list[last:attr.valueStart])
+		// URI attributes are always quoted-strings per the spec
+		out.WriteByte('"')
+		out.WriteString(rewritten)
+		out.WriteByte('"')
+		last = attr.valueEnd
+		changed = true
+	}
+
+	if !changed {
+		return line
+	}
+	out.WriteString(list[last:])
+
+	return tag + ":" + out.String()
+}
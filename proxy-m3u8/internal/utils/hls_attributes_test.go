@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAttributeList(t *testing.T) {
+	type attr struct {
+		name, value string
+		quoted      bool
+	}
+	tests := []struct {
+		name string
+		list string
+		want []attr
+	}{
+		{
+			name: "key",
+			list: `METHOD=AES-128,URI="key.bin",IV=0x1234`,
+			want: []attr{{"METHOD", "AES-128", false}, {"URI", "key.bin", true}, {"IV", "0x1234", false}},
+		},
+		{
+			name: "comma inside quotes",
+			list: `TYPE=AUDIO,NAME="English, US",URI="a,b.m3u8"`,
+			want: []attr{{"TYPE", "AUDIO", false}, {"NAME", "English, US", true}, {"URI", "a,b.m3u8", true}},
+		},
+		{
+			name: "whitespace around attributes",
+			list: ` BANDWIDTH=1280000 , RESOLUTION=1280x720`,
+			want: []attr{{"BANDWIDTH", "1280000", false}, {"RESOLUTION", "1280x720", false}},
+		},
+		{
+			name: "empty quoted value",
+			list: `URI="",METHOD=NONE`,
+			want: []attr{{"URI", "", true}, {"METHOD", "NONE", false}},
+		},
+		{
+			name: "attribute without value is skipped",
+			list: `INDEPENDENT,URI="part.ts"`,
+			want: []attr{{"URI", "part.ts", true}},
+		},
+		{
+			name: "unterminated quote takes the rest",
+			list: `METHOD=AES-128,URI="key.bin,IV=0x1`,
+			want: []attr{{"METHOD", "AES-128", false}, {"URI", "key.bin,IV=0x1", true}},
+		},
+		{
+			name: "empty list",
+			list: ``,
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseAttributeList(tt.list)
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseAttributeList(%q) returned %d attributes, want %d: %+v", tt.list, len(got), len(tt.want), got)
+			}
+			for i, want := range tt.want {
+				if got[i].Name != want.name || got[i].Value != want.value || got[i].Quoted != want.quoted {
+					t.Errorf("attribute %d = {%q %q %v}, want {%q %q %v}", i,
+						got[i].Name, got[i].Value, got[i].Quoted, want.name, want.value, want.quoted)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteURIAttributes(t *testing.T) {
+	proxied := func(uri string) string { return "/proxy?url=" + uri }
+
+	tests := []struct {
+		name    string
+		line    string
+		rewrite func(string) string
+		want    string
+	}{
+		{
+			name:    "key",
+			line:    `#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x1234`,
+			rewrite: proxied,
+			want:    `#EXT-X-KEY:METHOD=AES-128,URI="/proxy?url=key.bin",IV=0x1234`,
+		},
+		{
+			name:    "map with byte range",
+			line:    `#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"`,
+			rewrite: proxied,
+			want:    `#EXT-X-MAP:URI="/proxy?url=init.mp4",BYTERANGE="720@0"`,
+		},
+		{
+			name:    "unquoted uri is quoted",
+			line:    `#EXT-X-PRELOAD-HINT:TYPE=PART,URI=part1.ts`,
+			rewrite: proxied,
+			want:    `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="/proxy?url=part1.ts"`,
+		},
+		{
+			name:    "other attributes kept byte for byte",
+			line:    `#EXT-X-MEDIA:TYPE=AUDIO, NAME="English, US" ,URI="en.m3u8",DEFAULT=YES`,
+			rewrite: proxied,
+			want:    `#EXT-X-MEDIA:TYPE=AUDIO, NAME="English, US" ,URI="/proxy?url=en.m3u8",DEFAULT=YES`,
+		},
+		{
+			name:    "unchanged uri leaves the line alone",
+			line:    `#EXT-X-KEY:METHOD=AES-128,URI=key.bin`,
+			rewrite: func(uri string) string { return uri },
+			want:    `#EXT-X-KEY:METHOD=AES-128,URI=key.bin`,
+		},
+		{
+			name:    "no uri attribute",
+			line:    `#EXT-X-KEY:METHOD=NONE`,
+			rewrite: proxied,
+			want:    `#EXT-X-KEY:METHOD=NONE`,
+		},
+		{
+			name:    "no attribute list",
+			line:    `#EXT-X-ENDLIST`,
+			rewrite: proxied,
+			want:    `#EXT-X-ENDLIST`,
+		},
+		{
+			name:    "uri lookalike in another value",
+			line:    `#EXT-X-SESSION-DATA:DATA-ID="com.example",VALUE="URI=x",URI="data.json"`,
+			rewrite: strings.ToUpper,
+			want:    `#EXT-X-SESSION-DATA:DATA-ID="com.example",VALUE="URI=x",URI="DATA.JSON"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RewriteURIAttributes(tt.line, tt.rewrite); got != tt.want {
+				t.Errorf("RewriteURIAttributes(%q) =\n%q\nwant\n%q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"net/url"
 	"path"
@@ -13,20 +14,28 @@ import (
 // These are files that, if not m3u8 or ts, are proxied as-is.
 var AllowedExtensions = []string{".png", ".jpg", ".webp", ".ico", ".html", ".js", ".css", ".txt"} // .ts and .m3u8 handled separately
 
-// IsAllowedStaticExtension checks if the line ends with one of the non-M3U8/TS static file extensions.
-func IsAllowedStaticExtension(line string) bool {
-	for _, ext := range AllowedExtensions {
-		if strings.HasSuffix(line, ext) {
-			return true
-		}
+// URLExtension returns the lower-cased file extension of a URL's path, ignoring
+// the query string and fragment, e.g. ".ts" for "seg-1.ts?st=abc&e=123".
+func URLExtension(rawURL string) string {
+	p := rawURL
+	if parsed, err := url.Parse(rawURL); err == nil {
+		p = parsed.Path
+	} else if idx := strings.IndexAny(rawURL, "?#"); idx >= 0 {
+		p = rawURL[:idx]
 	}
-	return false
+	return strings.ToLower(path.Ext(p))
+}
+
+// IsAllowedStaticExtension checks if the line's path ends with one of the non-M3U8/TS static file extensions.
+func IsAllowedStaticExtension(line string) bool {
+	return IsStaticFileExtension(line)
 }
 
-func IsStaticFileExtension(path string) bool {
-	lowerPath := strings.ToLower(path)
-	for _, ext := range AllowedExtensions {
-		if strings.HasSuffix(lowerPath, ext) {
+// IsStaticFileExtension checks the path of a URL (query string excluded) against AllowedExtensions.
+func IsStaticFileExtension(rawURL string) bool {
+	ext := URLExtension(rawURL)
+	for _, allowed := range AllowedExtensions {
+		if ext == allowed {
 			return true
 		}
 	}
@@ -37,26 +46,31 @@ func IsStaticFileExtension(path string) bool {
 // proxyPrefix is the prefix for rewritten URLs, e.g., "http://localhost:8080/m3u8-proxy?url={URL}&referer=..."
 // The {URL} placeholder will be replaced with the actual URL
 func ProcessM3U8Stream(reader io.Reader, writer io.Writer, originalM3U8URL, proxyPrefix string) error {
+	return RewriteM3U8Stream(reader, writer, originalM3U8URL, func(targetURL string) string {
+		return strings.Replace(proxyPrefix, "{URL}", url.QueryEscape(targetURL), 1)
+	})
+}
+
+// RewriteM3U8Stream works like ProcessM3U8Stream but lets the caller build each
+// rewritten URI from the absolute upstream URL, e.g. to sign every child URI.
+func RewriteM3U8Stream(reader io.Reader, writer io.Writer, originalM3U8URL string, rewrite func(targetURL string) string) error {
 	scanner := bufio.NewScanner(reader)
-	parsedBaseURL, err := url.Parse(originalM3U8URL)
-	if err != nil {
-		// If originalM3U8URL is not a valid URL, we might not be able to resolve relative paths correctly.
-		// For simplicity, we'll try to proceed, but this could be an issue for malformed original URLs.
-		// A robust solution might return an error here or have a fallback.
-		// For now, let's assume originalM3U8URL is well-formed for baseUrl calculation.
-	}
 
-	// Calculate baseUrl: scheme://host/path/to/
-	var baseUrlForRelativePaths string
-	if parsedBaseURL != nil {
-		// Get the directory part of the URL
-		parsedBaseURL.Path = path.Dir(parsedBaseURL.Path)
-		if !strings.HasSuffix(parsedBaseURL.Path, "/") {
-			parsedBaseURL.Path += "/"
+	// proxify resolves a URI found in the playlist and routes it through the proxy.
+	// Relative URIs are resolved against the playlist URL itself (RFC 3986), which
+	// handles directories, "../" and query-only references without touching the query.
+	// URIs that do not resolve to http(s), e.g. data: or skd:// keys, are left untouched.
+	proxify := func(uri string) string {
+		targetURL := resolveURL(originalM3U8URL, uri)
+		if !isAbsoluteURL(targetURL) {
+			return uri
 		}
-		baseUrlForRelativePaths = parsedBaseURL.String()
+		return rewrite(targetURL)
 	}
 
+	// Kind of the next URI line, announced by the tag preceding it
+	pendingKind := uriKindUnknown
+
 	for scanner.Scan() {
 		line := scanner.Text()
 		modifiedLine := line
@@ -64,29 +78,27 @@ func ProcessM3U8Stream(reader io.Reader, writer io.Writer, originalM3U8URL, prox
 		// Trim whitespace from the line for accurate suffix checking
 		trimmedLine := strings.TrimSpace(line)
 
-		if strings.HasPrefix(trimmedLine, "#") || trimmedLine == "" {
-			// It's a comment or empty line, pass through
+		if strings.HasPrefix(trimmedLine, "#") {
+			if kind := uriKindForTag(trimmedLine); kind != uriKindUnknown {
+				pendingKind = kind
+			}
+			// Tags such as EXT-X-KEY or EXT-X-MAP reference URIs inside their attribute list
+			if HasURIAttributes(trimmedLine) {
+				modifiedLine = RewriteURIAttributes(line, proxify)
+			}
+		} else if trimmedLine == "" {
+			// Empty line, pass through
 			modifiedLine = line
-		} else if strings.HasSuffix(trimmedLine, ".m3u8") || strings.HasSuffix(trimmedLine, ".ts") {
+		} else if pendingKind != uriKindUnknown {
+			// The URI line belongs to the preceding EXT-X-STREAM-INF or EXTINF tag,
+			// whatever extension (if any) it has
+			modifiedLine = proxify(trimmedLine)
+			pendingKind = uriKindUnknown
+		} else if ext := URLExtension(trimmedLine); ext == ".m3u8" || ext == ".ts" {
 			// These are segments or nested playlists, assumed relative to the M3U8's base URL
-			var targetURL string
-			if isAbsoluteURL(trimmedLine) {
-				targetURL = trimmedLine
-			} else {
-				// Construct absolute URL from baseUrlForRelativePaths and the relative line
-				targetURL = resolveURL(baseUrlForRelativePaths, trimmedLine)
-			}
-			// Replace {URL} placeholder with the actual URL
-			modifiedLine = strings.Replace(proxyPrefix, "{URL}", url.QueryEscape(targetURL), 1)
+			modifiedLine = proxify(trimmedLine)
 		} else if IsAllowedStaticExtension(trimmedLine) {
-			var targetURL string
-			if isAbsoluteURL(trimmedLine) {
-				targetURL = trimmedLine
-			} else {
-				targetURL = resolveURL(baseUrlForRelativePaths, trimmedLine)
-			}
-			// Replace {URL} placeholder with the actual URL
-			modifiedLine = strings.Replace(proxyPrefix, "{URL}", url.QueryEscape(targetURL), 1)
+			modifiedLine = proxify(trimmedLine)
 		}
 
 		if _, err := io.WriteString(writer, modifiedLine+"\n"); err != nil {
@@ -97,6 +109,33 @@ func ProcessM3U8Stream(reader io.Reader, writer io.Writer, originalM3U8URL, prox
 	return scanner.Err()
 }
 
+// IsLivePlaylist reports whether a playlist is a live media playlist, i.e. one that
+// lists segments but has no EXT-X-ENDLIST and will keep changing.
+func IsLivePlaylist(body []byte) bool {
+	return bytes.Contains(body, []byte("#EXTINF")) && !bytes.Contains(body, []byte("#EXT-X-ENDLIST"))
+}
+
+// uriKind classifies a URI line of a playlist
+type uriKind int
+
+const (
+	uriKindUnknown uriKind = iota
+	uriKindPlaylist
+	uriKindSegment
+)
+
+// uriKindForTag returns the kind of the URI line that follows the given tag.
+func uriKindForTag(line string) uriKind {
+	tag, _, _ := splitTag(line)
+	switch tag {
+	case "#EXT-X-STREAM-INF":
+		return uriKindPlaylist
+	case "#EXTINF":
+		return uriKindSegment
+	}
+	return uriKindUnknown
+}
+
 func isAbsoluteURL(line string) bool {
 	return strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://")
 }
@@ -118,5 +157,12 @@ func resolveURL(baseURLStr, relativePath string) string {
 		return relativePath
 	}
 
-	return base.ResolveReference(relative).String()
+	resolved := base.ResolveReference(relative)
+	// Keep signed query strings byte-for-byte as they appear in the playlist
+	if relative.RawQuery != "" || relative.ForceQuery {
+		resolved.RawQuery = relative.RawQuery
+		resolved.ForceQuery = relative.ForceQuery
+	}
+
+	return resolved.String()
 }
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestURLExtension(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://cdn.example.com/hls/seg-1.ts", ".ts"},
+		{"https://cdn.example.com/hls/seg-1.ts?st=abc&e=123", ".ts"},
+		{"https://cdn.example.com/hls/master.M3U8?token=a.b", ".m3u8"},
+		{"https://cdn.example.com/hls/master.m3u8#t=10", ".m3u8"},
+		{"https://cdn.example.com/get?file=seg-1.ts", ""},
+		{"https://cdn.example.com/hls.v2/segment", ""},
+		{"https://cdn.example.com/", ""},
+		{"seg-1.ts?st=abc", ".ts"},
+		{"../720p/index.m3u8", ".m3u8"},
+		{"%zz/seg-1.ts?x=1", ".ts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := URLExtension(tt.url); got != tt.want {
+				t.Errorf("URLExtension(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsStaticFileExtension(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://cdn.example.com/thumbs/1.jpg", true},
+		{"https://cdn.example.com/thumbs/1.JPG?w=320", true},
+		{"https://cdn.example.com/subs/en.txt?lang=en", true},
+		{"https://cdn.example.com/hls/seg-1.ts", false},
+		{"https://cdn.example.com/hls/master.m3u8", false},
+		{"https://cdn.example.com/image?format=.png", false},
+		{"https://cdn.example.com/video.mp4", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := IsStaticFileExtension(tt.url); got != tt.want {
+				t.Errorf("IsStaticFileExtension(%q) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteM3U8StreamClassifiesURIs(t *testing.T) {
+	playlist := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin?k=1\"",
+		"#EXTINF:4,",
+		"seg-1.ts?st=abc&e=123",
+		"#EXTINF:4,",
+		"https://other.example.com/chunk?id=2",
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000",
+		"../720p/index?format=m3u8",
+		"poster.jpg?w=320",
+		"notes",
+		"",
+		"#EXT-X-ENDLIST",
+	}, "\n")
+
+	var out bytes.Buffer
+	err := RewriteM3U8Stream(strings.NewReader(playlist), &out, "https://cdn.example.com/hls/1080p/index.m3u8?token=xyz",
+		func(targetURL string) string { return "PROXY(" + targetURL + ")" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"PROXY(https://cdn.example.com/hls/1080p/key.bin?k=1)\"",
+		"#EXTINF:4,",
+		// Query strings stay as they are, they often carry the CDN's signature
+		"PROXY(https://cdn.example.com/hls/1080p/seg-1.ts?st=abc&e=123)",
+		"#EXTINF:4,",
+		// URI lines after EXTINF and EXT-X-STREAM-INF are rewritten whatever their extension
+		"PROXY(https://other.example.com/chunk?id=2)",
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000",
+		"PROXY(https://cdn.example.com/hls/720p/index?format=m3u8)",
+		"PROXY(https://cdn.example.com/hls/1080p/poster.jpg?w=320)",
+		// Lines that aren't tied to a tag or a known extension are left alone
+		"notes",
+		"",
+		"#EXT-X-ENDLIST",
+		"",
+	}, "\n")
+	if got := out.String(); got != want {
+		t.Errorf("rewritten playlist:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
+)
+
+// MirrorPolicy controls failover between mirrors of a stream
+type MirrorPolicy struct {
+	FirstByteTimeout time.Duration // A mirror that hasn't sent headers by then is abandoned for the next one
+	HedgeDelay       time.Duration // Segments start a second mirror after this delay and take the first answer, 0 disables hedging
+}
+
+var mirrorPolicy = MirrorPolicy{}
+
+// ConfigureMirrors replaces the mirror failover policy
+func ConfigureMirrors(policy MirrorPolicy) {
+	mirrorPolicy = policy
+}
+
+// MirrorURLs returns targetURL followed by the same path and query on every
+// mirror origin. Mirrors that aren't valid http(s) origins are skipped.
+func MirrorURLs(targetURL string, mirrors []string) []string {
+	urls := []string{targetURL}
+	target, err := url.Parse(targetURL)
+	if err != nil || len(mirrors) == 0 {
+		return urls
+	}
+
+	seen := map[string]bool{originOf(target): true}
+	for _, mirror := range mirrors {
+		mirrorURL, err := url.Parse(strings.TrimSpace(mirror))
+		if err != nil || mirrorURL.Host == "" || (mirrorURL.Scheme != "http" && mirrorURL.Scheme != "https") {
+			continue
+		}
+		origin := originOf(mirrorURL)
+		if seen[origin] {
+			continue
+		}
+		seen[origin] = true
+
+		alternate := *target
+		alternate.Scheme = mirrorURL.Scheme
+		alternate.Host = mirrorURL.Host
+		urls = append(urls, alternate.String())
+	}
+	return urls
+}
+
+// MirrorsFor returns the mirrors that apply to a URI found in a playlist. The
+// playlist's origin and its mirrors form a group of equivalent origins; a child
+// on one of them gets the others as its mirrors, a child elsewhere gets none.
+func MirrorsFor(childURL, playlistURL string, playlistMirrors []string) []string {
+	if len(playlistMirrors) == 0 {
+		return nil
+	}
+	child, err := url.Parse(childURL)
+	if err != nil {
+		return nil
+	}
+
+	var group []string
+	for _, candidate := range MirrorURLs(playlistURL, playlistMirrors) {
+		if candidateURL, err := url.Parse(candidate); err == nil {
+			group = append(group, originOf(candidateURL))
+		}
+	}
+
+	childOrigin := originOf(child)
+	var mirrors []string
+	member := false
+	for _, origin := range group {
+		if origin == childOrigin {
+			member = true
+			continue
+		}
+		mirrors = append(mirrors, origin)
+	}
+	if !member {
+		return nil
+	}
+	return mirrors
+}
+
+func originOf(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// mirrorResult is the outcome of one mirror attempt
+type mirrorResult struct {
+	req  *http.Request
+	resp *http.Response
+	err  error
+}
+
+// FetchMirrored fetches req from the first of candidates that answers, where
+// candidates[0] is req's own URL. A mirror is abandoned for the next one on an
+// error, a 502/503/504 or a first byte slower than the policy allows; with hedge
+// set, a second mirror is raced against the first after the hedge delay.
+// The request that produced the response is returned alongside it.
+// Each candidate is retried according to the retry policy before it counts as
+// failed; a candidate still retrying when the first byte timeout or hedge delay
+// passes is raced against the next one.
+func FetchMirrored(req *http.Request, candidates []string, hedge bool) (*http.Response, *http.Request, error) {
+	var requests []*http.Request
+	for i, candidate := range candidates {
+		if i == 0 {
+			requests = append(requests, req)
+			continue
+		}
+		candidateURL, err := url.Parse(candidate)
+		if err != nil || CheckDestination(candidateURL) != nil {
+			continue
+		}
+		mirrorReq := req.Clone(req.Context())
+		mirrorReq.URL = candidateURL
+		mirrorReq.Host = ""
+		requests = append(requests, mirrorReq)
+	}
+
+	if len(requests) == 1 {
+		resp, err := retryPolicy.Do(req)
+		return resp, req, err
+	}
+
+	retries := retryPolicy
+	policy := mirrorPolicy
+	hedging := hedge && policy.HedgeDelay > 0
+	delay := policy.FirstByteTimeout
+	if hedging {
+		delay = policy.HedgeDelay
+	}
+
+	results := make(chan mirrorResult, len(requests))
+	launch := func(r *http.Request) {
+		go func() {
+			resp, err := retries.Do(r)
+			results <- mirrorResult{req: r, resp: resp, err: err}
+		}()
+	}
+
+	next, pending := 1, 1
+	launch(requests[0])
+
+	var timer <-chan time.Time
+	if delay > 0 {
+		timer = time.After(delay)
+	}
+
+	var last mirrorResult
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil && !isRetryableStatus(result.resp.StatusCode) {
+				go discardMirrorResults(results, pending)
+				return result.resp, result.req, nil
+			}
+
+			if last.resp != nil {
+				last.resp.Body.Close()
+			}
+			last = result
+			if result.err != nil && !isRetryableError(result.err) && !errors.Is(result.err, ErrCircuitOpen) {
+				continue
+			}
+			if next < len(requests) {
+				logging.FromContext(req.Context()).Info("Mirror failed, trying next",
+					"mirror_host", result.req.URL.Host, "next_host", requests[next].URL.Host)
+				launch(requests[next])
+				next++
+				pending++
+			}
+
+		case <-timer:
+			timer = nil
+			if next < len(requests) {
+				logging.FromContext(req.Context()).Info("Mirror is slow, trying next",
+					"mirror_host", requests[next-1].URL.Host, "next_host", requests[next].URL.Host)
+				launch(requests[next])
+				next++
+				pending++
+				// Hedging races two mirrors, failover keeps moving on from slow ones
+				if !hedging && next < len(requests) {
+					timer = time.After(delay)
+				}
+			}
+
+		case <-req.Context().Done():
+			go discardMirrorResults(results, pending)
+			if last.resp != nil {
+				last.resp.Body.Close()
+			}
+			return nil, req, req.Context().Err()
+		}
+	}
+
+	return last.resp, last.req, last.err
+}
+
+// discardMirrorResults closes the responses of attempts that lost the race
+func discardMirrorResults(results <-chan mirrorResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.resp != nil {
+			result.resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		mirrors []string
+		want    []string
+	}{
+		{
+			name:   "no mirrors",
+			target: "https://cdn1.example.com/hls/seg-1.ts?token=abc",
+			want:   []string{"https://cdn1.example.com/hls/seg-1.ts?token=abc"},
+		},
+		{
+			name:    "path and query kept on every origin",
+			target:  "https://cdn1.example.com/hls/seg-1.ts?token=abc",
+			mirrors: []string{"https://cdn2.example.com", "http://cdn3.example.com:8080/ignored"},
+			want: []string{
+				"https://cdn1.example.com/hls/seg-1.ts?token=abc",
+				"https://cdn2.example.com/hls/seg-1.ts?token=abc",
+				"http://cdn3.example.com:8080/hls/seg-1.ts?token=abc",
+			},
+		},
+		{
+			name:    "invalid and duplicate origins skipped",
+			target:  "https://cdn1.example.com/seg-1.ts",
+			mirrors: []string{"ftp://cdn2.example.com", "cdn3.example.com", "https://CDN1.example.com", "https://cdn4.example.com", "https://cdn4.example.com/"},
+			want:    []string{"https://cdn1.example.com/seg-1.ts", "https://cdn4.example.com/seg-1.ts"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MirrorURLs(tt.target, tt.mirrors); !slices.Equal(got, tt.want) {
+				t.Errorf("MirrorURLs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMirrorsFor(t *testing.T) {
+	playlist := "https://cdn1.example.com/hls/master.m3u8"
+	mirrors := []string{"https://cdn2.example.com"}
+
+	tests := []struct {
+		name  string
+		child string
+		want  []string
+	}{
+		{name: "child on the playlist origin", child: "https://cdn1.example.com/hls/720p.m3u8", want: []string{"https://cdn2.example.com"}},
+		{name: "child on a mirror", child: "https://cdn2.example.com/hls/720p.m3u8", want: []string{"https://cdn1.example.com"}},
+		{name: "child elsewhere", child: "https://keys.example.com/key.bin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MirrorsFor(tt.child, playlist, mirrors); !slices.Equal(got, tt.want) {
+				t.Errorf("MirrorsFor = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := MirrorsFor("https://cdn1.example.com/a.ts", playlist, nil); got != nil {
+		t.Errorf("MirrorsFor without mirrors = %v, want none", got)
+	}
+}
+
+// useMirrorPolicies sets the mirror and retry policies for a test, restoring them afterwards
+func useMirrorPolicies(t *testing.T, mirrors MirrorPolicy, retries RetryPolicy) {
+	t.Helper()
+	savedMirrors, savedRetries := mirrorPolicy, retryPolicy
+	t.Cleanup(func() { mirrorPolicy, retryPolicy = savedMirrors, savedRetries })
+	ConfigureMirrors(mirrors)
+	ConfigureRetries(retries)
+}
+
+// testOrigin answers with the status statuses returns for its nth request (from 1)
+// after delay, blocking until the test ends when the status is 0
+type testOrigin struct {
+	name     string
+	statuses func(n int64) int
+	delay    time.Duration
+	release  chan struct{}
+	hits     atomic.Int64
+	srv      *httptest.Server
+}
+
+func newTestOrigin(t *testing.T, name string, statuses func(n int64) int) *testOrigin {
+	o := &testOrigin{name: name, statuses: statuses, release: make(chan struct{})}
+	o.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := o.statuses(o.hits.Add(1))
+		time.Sleep(o.delay)
+		if status == 0 {
+			<-o.release
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, o.name)
+	}))
+	t.Cleanup(func() {
+		close(o.release)
+		o.srv.Close()
+	})
+	return o
+}
+
+func always(status int) func(int64) int {
+	return func(int64) int { return status }
+}
+
+func TestFetchMirroredFailover(t *testing.T) {
+	tests := []struct {
+		name       string
+		primary    func(n int64) int
+		mirror     func(n int64) int
+		policy     MirrorPolicy
+		attempts   int
+		wantStatus int
+		wantBody   string
+		wantHits   [2]int64 // Requests seen by the primary and the mirror
+	}{
+		{
+			name: "primary answers", primary: always(http.StatusOK), mirror: always(http.StatusOK),
+			wantStatus: http.StatusOK, wantBody: "primary", wantHits: [2]int64{1, 0},
+		},
+		{
+			name: "server error fails over", primary: always(http.StatusServiceUnavailable), mirror: always(http.StatusOK),
+			wantStatus: http.StatusOK, wantBody: "mirror", wantHits: [2]int64{1, 1},
+		},
+		{
+			name: "not found is final", primary: always(http.StatusNotFound), mirror: always(http.StatusOK),
+			wantStatus: http.StatusNotFound, wantBody: "primary", wantHits: [2]int64{1, 0},
+		},
+		{
+			name: "every mirror failing returns the last answer", primary: always(http.StatusBadGateway), mirror: always(http.StatusGatewayTimeout),
+			wantStatus: http.StatusGatewayTimeout, wantBody: "mirror", wantHits: [2]int64{1, 1},
+		},
+		{
+			name: "slow first byte fails over", primary: always(0), mirror: always(http.StatusOK),
+			policy:     MirrorPolicy{FirstByteTimeout: 20 * time.Millisecond},
+			wantStatus: http.StatusOK, wantBody: "mirror", wantHits: [2]int64{1, 1},
+		},
+		{
+			name: "primary retried before failing over",
+			primary: func(n int64) int {
+				if n == 1 {
+					return http.StatusServiceUnavailable
+				}
+				return http.StatusOK
+			},
+			mirror: always(http.StatusOK), attempts: 2,
+			wantStatus: http.StatusOK, wantBody: "primary", wantHits: [2]int64{2, 0},
+		},
+		{
+			name: "mirror retried after the primary gave up", primary: always(http.StatusServiceUnavailable),
+			mirror: func(n int64) int {
+				if n == 1 {
+					return http.StatusBadGateway
+				}
+				return http.StatusOK
+			},
+			attempts:   2,
+			wantStatus: http.StatusOK, wantBody: "mirror", wantHits: [2]int64{2, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newTestOrigin(t, "primary", tt.primary)
+			mirror := newTestOrigin(t, "mirror", tt.mirror)
+			useTestUpstream(t, primary.srv, mirror.srv)
+			useMirrorPolicies(t, tt.policy, RetryPolicy{MaxAttempts: max(tt.attempts, 1)})
+
+			req, _ := http.NewRequest(http.MethodGet, primary.srv.URL+"/seg-1.ts", nil)
+			resp, served, err := FetchMirrored(req, MirrorURLs(req.URL.String(), []string{mirror.srv.URL}), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus || string(body) != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+			if want := tt.wantBody == "mirror"; (served.URL.Host == mirror.srv.Listener.Addr().String()) != want {
+				t.Errorf("served by %s, want the %s", served.URL.Host, tt.wantBody)
+			}
+			if hits := [2]int64{primary.hits.Load(), mirror.hits.Load()}; hits != tt.wantHits {
+				t.Errorf("requests = %v, want %v", hits, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestFetchMirroredHedging(t *testing.T) {
+	tests := []struct {
+		name     string
+		hedge    bool
+		wantBody string
+		wantHits [3]int64
+	}{
+		// Hedging races exactly one more mirror against the slow primary
+		{name: "segment hedged", hedge: true, wantBody: "mirror", wantHits: [3]int64{1, 1, 0}},
+		// Without a first byte timeout, an unhedged request waits for the slow primary
+		{name: "playlist not hedged", wantBody: "primary", wantHits: [3]int64{1, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newTestOrigin(t, "primary", always(http.StatusOK))
+			primary.delay = 50 * time.Millisecond
+			mirror := newTestOrigin(t, "mirror", always(http.StatusOK))
+			spare := newTestOrigin(t, "spare", always(http.StatusOK))
+			useTestUpstream(t, primary.srv, mirror.srv, spare.srv)
+			useMirrorPolicies(t, MirrorPolicy{HedgeDelay: 10 * time.Millisecond}, RetryPolicy{MaxAttempts: 1})
+
+			req, _ := http.NewRequest(http.MethodGet, primary.srv.URL+"/seg-1.ts", nil)
+			resp, _, err := FetchMirrored(req, MirrorURLs(req.URL.String(), []string{mirror.srv.URL, spare.srv.URL}), tt.hedge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if string(body) != tt.wantBody {
+				t.Errorf("served %q, want %q", body, tt.wantBody)
+			}
+			if hits := [3]int64{primary.hits.Load(), mirror.hits.Load(), spare.hits.Load()}; hits != tt.wantHits {
+				t.Errorf("requests = %v, want %v", hits, tt.wantHits)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Playlist is the subset of an HLS playlist the proxy cares about
+type Playlist struct {
+	MediaSequence    int64
+	Segments         []string        // Absolute segment URLs, in playback order
+	SegmentDurations []time.Duration // From EXTINF, parallel to Segments
+	EndList          bool
+	Variants         []Variant // Renditions listed by a master playlist
+}
+
+// Variant is one EXT-X-STREAM-INF entry of a master playlist
+type Variant struct {
+	URL        string
+	Bandwidth  int64
+	Resolution string
+}
+
+// IsMedia reports whether the playlist lists media segments (as opposed to a master playlist)
+func (p *Playlist) IsMedia() bool {
+	return len(p.Segments) > 0
+}
+
+// ParsePlaylist extracts segment URLs and sequence information from a playlist,
+// resolving relative URIs against the playlist URL
+func ParsePlaylist(body []byte, playlistURL string) *Playlist {
+	playlist := &Playlist{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	pendingKind := uriKindUnknown
+	var pendingDuration time.Duration
+	var pendingVariant Variant
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			if kind := uriKindForTag(line); kind != uriKindUnknown {
+				pendingKind = kind
+			}
+			tag, value, _ := splitTag(line)
+			switch tag {
+			case "#EXT-X-MEDIA-SEQUENCE":
+				playlist.MediaSequence, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			case "#EXT-X-ENDLIST":
+				playlist.EndList = true
+			case "#EXTINF":
+				// #EXTINF:<duration>,[<title>]
+				duration, _, _ := strings.Cut(value, ",")
+				seconds, _ := strconv.ParseFloat(strings.TrimSpace(duration), 64)
+				pendingDuration = time.Duration(seconds * float64(time.Second))
+			case "#EXT-X-STREAM-INF":
+				pendingVariant = Variant{}
+				for _, attr := range ParseAttributeList(value) {
+					switch attr.Name {
+					case "BANDWIDTH":
+						pendingVariant.Bandwidth, _ = strconv.ParseInt(attr.Value, 10, 64)
+					case "RESOLUTION":
+						pendingVariant.Resolution = attr.Value
+					}
+				}
+			}
+		default:
+			switch pendingKind {
+			case uriKindSegment:
+				playlist.Segments = append(playlist.Segments, resolveURL(playlistURL, line))
+				playlist.SegmentDurations = append(playlist.SegmentDurations, pendingDuration)
+			case uriKindPlaylist:
+				pendingVariant.URL = resolveURL(playlistURL, line)
+				playlist.Variants = append(playlist.Variants, pendingVariant)
+			}
+			pendingKind = uriKindUnknown
+		}
+	}
+
+	return playlist
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// StreamInfo places a URL within its stream: the master playlist and variant it
+// belongs to and, for a segment, its position in the media playlist
+type StreamInfo struct {
+	MasterURL   string
+	PlaylistURL string // Media playlist listing the segment
+	Bandwidth   int64  // Of the variant, from EXT-X-STREAM-INF
+	Resolution  string
+	Sequence    int64 // Media sequence number of the segment
+	IsSegment   bool
+	Duration    time.Duration // Of the segment, from EXTINF
+}
+
+// PlaylistIndex remembers the playlists served recently so segment and media
+// playlist requests can be traced back to their variant and master playlist
+type PlaylistIndex struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu       sync.Mutex
+	variants map[string]indexedVariant // Media playlist URL -> variant of a master
+	segments map[string]indexedSegment // Segment URL -> position in a media playlist
+}
+
+type indexedVariant struct {
+	master     string
+	bandwidth  int64
+	resolution string
+	expires    time.Time
+}
+
+type indexedSegment struct {
+	playlist string
+	sequence int64
+	duration time.Duration
+	expires  time.Time
+}
+
+var playlistIndex = NewPlaylistIndex(30*time.Minute, 200000)
+
+// NewPlaylistIndex creates an index forgetting playlists not served for ttl and
+// holding at most maxEntries variants and segments each
+func NewPlaylistIndex(ttl time.Duration, maxEntries int) *PlaylistIndex {
+	idx := &PlaylistIndex{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		variants:   make(map[string]indexedVariant),
+		segments:   make(map[string]indexedSegment),
+	}
+	go idx.sweepLoop()
+	return idx
+}
+
+// GetPlaylistIndex returns the singleton playlist index
+func GetPlaylistIndex() *PlaylistIndex {
+	return playlistIndex
+}
+
+// OnPlaylist records the variants of a master playlist or the segments of a
+// media playlist served from playlistURL
+func (idx *PlaylistIndex) OnPlaylist(playlistURL string, playlist *Playlist) {
+	expires := time.Now().Add(idx.ttl)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, variant := range playlist.Variants {
+		if _, ok := idx.variants[variant.URL]; !ok && len(idx.variants) >= idx.maxEntries {
+			continue
+		}
+		idx.variants[variant.URL] = indexedVariant{
+			master:     playlistURL,
+			bandwidth:  variant.Bandwidth,
+			resolution: variant.Resolution,
+			expires:    expires,
+		}
+	}
+
+	if !playlist.IsMedia() {
+		return
+	}
+	// Live playlists are refreshed every few seconds, keep their variant alive too
+	if variant, ok := idx.variants[playlistURL]; ok {
+		variant.expires = expires
+		idx.variants[playlistURL] = variant
+	}
+	for i, segment := range playlist.Segments {
+		if _, ok := idx.segments[segment]; !ok && len(idx.segments) >= idx.maxEntries {
+			continue
+		}
+		var duration time.Duration
+		if i < len(playlist.SegmentDurations) {
+			duration = playlist.SegmentDurations[i]
+		}
+		idx.segments[segment] = indexedSegment{
+			playlist: playlistURL,
+			sequence: playlist.MediaSequence + int64(i),
+			duration: duration,
+			expires:  expires,
+		}
+	}
+}
+
+// Lookup returns what is known about a segment or media playlist URL
+func (idx *PlaylistIndex) Lookup(rawURL string) (StreamInfo, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var info StreamInfo
+	playlistURL := rawURL
+	segment, isSegment := idx.segments[rawURL]
+	if isSegment {
+		info.IsSegment = true
+		info.PlaylistURL = segment.playlist
+		info.Sequence = segment.sequence
+		info.Duration = segment.duration
+		playlistURL = segment.playlist
+	}
+
+	variant, isVariant := idx.variants[playlistURL]
+	if isVariant {
+		info.MasterURL = variant.master
+		info.Bandwidth = variant.bandwidth
+		info.Resolution = variant.resolution
+	}
+	return info, isSegment || isVariant
+}
+
+// sweepLoop forgets playlists that haven't been served for the TTL
+func (idx *PlaylistIndex) sweepLoop() {
+	ticker := time.NewTicker(idx.ttl / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		idx.mu.Lock()
+		for key, variant := range idx.variants {
+			if now.After(variant.expires) {
+				delete(idx.variants, key)
+			}
+		}
+		for key, segment := range idx.segments {
+			if now.After(segment.expires) {
+				delete(idx.segments, key)
+			}
+		}
+		idx.mu.Unlock()
+	}
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaylistIndexLookup(t *testing.T) {
+	const master = "https://cdn.example.com/hls/master.m3u8"
+	const media = "https://cdn.example.com/hls/720p/index.m3u8"
+	masterBody := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=1280x720,CODECS=\"avc1.4d401f,mp4a.40.2\"",
+		"720p/index.m3u8",
+		"#EXT-X-STREAM-INF:BANDWIDTH=1600000,RESOLUTION=1920x1080",
+		"1080p/index.m3u8",
+	}, "\n")
+	mediaBody := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-MEDIA-SEQUENCE:100",
+		"#EXTINF:4.5,",
+		"seg-100.ts",
+		"#EXTINF:2.5,title",
+		"seg-101.ts",
+	}, "\n")
+
+	idx := NewPlaylistIndex(time.Minute, 100)
+	idx.OnPlaylist(master, ParsePlaylist([]byte(masterBody), master))
+	idx.OnPlaylist(media, ParsePlaylist([]byte(mediaBody), media))
+
+	tests := []struct {
+		url    string
+		want   StreamInfo
+		wantOK bool
+	}{
+		{
+			url:    "https://cdn.example.com/hls/720p/seg-101.ts",
+			want:   StreamInfo{MasterURL: master, PlaylistURL: media, Bandwidth: 800000, Resolution: "1280x720", Sequence: 101, IsSegment: true, Duration: 2500 * time.Millisecond},
+			wantOK: true,
+		},
+		{
+			url:    "https://cdn.example.com/hls/720p/seg-100.ts",
+			want:   StreamInfo{MasterURL: master, PlaylistURL: media, Bandwidth: 800000, Resolution: "1280x720", Sequence: 100, IsSegment: true, Duration: 4500 * time.Millisecond},
+			wantOK: true,
+		},
+		{
+			url:    "https://cdn.example.com/hls/1080p/index.m3u8",
+			want:   StreamInfo{MasterURL: master, Bandwidth: 1600000, Resolution: "1920x1080"},
+			wantOK: true,
+		},
+		{url: "https://cdn.example.com/hls/480p/seg-1.ts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			got, ok := idx.Lookup(tt.url)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("Lookup = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPlaylistIndexMaxEntries(t *testing.T) {
+	const media = "https://cdn.example.com/hls/index.m3u8"
+	idx := NewPlaylistIndex(time.Minute, 1)
+	idx.OnPlaylist(media, ParsePlaylist([]byte("#EXTINF:4,\nseg-1.ts\n#EXTINF:4,\nseg-2.ts\n"), media))
+
+	if _, ok := idx.Lookup("https://cdn.example.com/hls/seg-1.ts"); !ok {
+		t.Error("first segment not indexed")
+	}
+	if _, ok := idx.Lookup("https://cdn.example.com/hls/seg-2.ts"); ok {
+		t.Error("segment indexed beyond maxEntries")
+	}
+
+	// Entries already indexed are still refreshed when the index is full
+	idx.OnPlaylist(media, ParsePlaylist([]byte("#EXT-X-MEDIA-SEQUENCE:7\n#EXTINF:4,\nseg-1.ts\n"), media))
+	if info, _ := idx.Lookup("https://cdn.example.com/hls/seg-1.ts"); info.Sequence != 7 {
+		t.Errorf("sequence = %d after refresh, want 7", info.Sequence)
+	}
+}
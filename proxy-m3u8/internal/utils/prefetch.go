@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
+)
+
+// Prefetcher warms the segment cache with the segments a viewer is about to
+// request. It learns the segment order from the media playlists it is shown and
+// advances every time one of those segments is served.
+type Prefetcher struct {
+	depth       int
+	concurrency int
+	idleTimeout time.Duration
+	segmentTTL  time.Duration
+
+	mu      sync.Mutex
+	viewers map[string]map[string]*prefetchStream // viewer, then media playlist URL
+}
+
+// prefetchStream is one viewer watching one media playlist
+type prefetchStream struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	headers  map[string]string
+	segments []string
+	index    map[string]int  // Position of each segment URL in segments
+	warmed   map[string]bool // Segments of the current playlist that were fetched or served
+	sem      chan struct{}
+	lastSeen time.Time
+}
+
+var prefetcher = NewPrefetcher(0, 0, 0, 0)
+
+// NewPrefetcher creates a prefetcher warming depth segments ahead with at most
+// concurrency fetches per stream. Streams idle for idleTimeout are cancelled.
+// A zero depth disables prefetching.
+func NewPrefetcher(depth, concurrency int, idleTimeout, segmentTTL time.Duration) *Prefetcher {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	p := &Prefetcher{
+		depth:       depth,
+		concurrency: concurrency,
+		idleTimeout: idleTimeout,
+		segmentTTL:  segmentTTL,
+		viewers:     make(map[string]map[string]*prefetchStream),
+	}
+	if p.Enabled() && idleTimeout > 0 {
+		go p.reapLoop()
+	}
+	return p
+}
+
+// ConfigurePrefetcher replaces the singleton prefetcher
+func ConfigurePrefetcher(depth, concurrency int, idleTimeout, segmentTTL time.Duration) {
+	prefetcher.Stop()
+	prefetcher = NewPrefetcher(depth, concurrency, idleTimeout, segmentTTL)
+}
+
+// GetPrefetcher returns the singleton prefetcher
+func GetPrefetcher() *Prefetcher {
+	return prefetcher
+}
+
+// Enabled reports whether the prefetcher does anything
+func (p *Prefetcher) Enabled() bool {
+	return p.depth > 0
+}
+
+// OnPlaylist registers the segments of a media playlist served to viewer and
+// warms the ones playback will start with: the first segments of a VOD playlist,
+// the last ones of a live playlist.
+func (p *Prefetcher) OnPlaylist(viewer, playlistURL string, playlist *Playlist, headers map[string]string) {
+	if !p.Enabled() || !playlist.IsMedia() {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.viewers == nil {
+		// Stopped
+		return
+	}
+
+	streams, exists := p.viewers[viewer]
+	if !exists {
+		streams = make(map[string]*prefetchStream)
+		p.viewers[viewer] = streams
+	}
+	stream, exists := streams[playlistURL]
+	if !exists {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream = &prefetchStream{
+			ctx:    ctx,
+			cancel: cancel,
+			warmed: make(map[string]bool),
+			sem:    make(chan struct{}, p.concurrency),
+		}
+		streams[playlistURL] = stream
+	}
+	stream.headers = headers
+	stream.segments = playlist.Segments
+	stream.index = make(map[string]int, len(playlist.Segments))
+	for i, segment := range playlist.Segments {
+		stream.index[segment] = i
+	}
+	// Segments a live playlist's window moved past won't be asked for again
+	for segmentURL := range stream.warmed {
+		if _, listed := stream.index[segmentURL]; !listed {
+			delete(stream.warmed, segmentURL)
+		}
+	}
+	stream.lastSeen = time.Now()
+
+	start := 0
+	if !playlist.EndList {
+		start = max(len(playlist.Segments)-p.depth, 0)
+	}
+	p.warmLocked(stream, start, start+p.depth)
+}
+
+// OnSegment advances the viewer's streams that contain segmentURL and warms the
+// segments following it
+func (p *Prefetcher) OnSegment(viewer, segmentURL string) {
+	if !p.Enabled() {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Usually a single stream, a few when the player switches variants
+	for _, stream := range p.viewers[viewer] {
+		if n, ok := stream.index[segmentURL]; ok {
+			stream.lastSeen = time.Now()
+			stream.warmed[segmentURL] = true
+			p.warmLocked(stream, n+1, n+1+p.depth)
+		}
+	}
+}
+
+// warmLocked starts fetches for segments [from, to) that weren't warmed yet;
+// the caller must hold the lock
+func (p *Prefetcher) warmLocked(stream *prefetchStream, from, to int) {
+	to = min(to, len(stream.segments))
+	for i := from; i < to; i++ {
+		segmentURL := stream.segments[i]
+		if stream.warmed[segmentURL] {
+			continue
+		}
+		stream.warmed[segmentURL] = true
+		go p.fetch(stream, segmentURL, stream.headers)
+	}
+}
+
+// fetch downloads one segment into the cache, sharing the fetch with a viewer
+// request for the same segment if one is already in flight. The segment goes
+// through the same destination and cacheability checks as a proxied one.
+func (p *Prefetcher) fetch(stream *prefetchStream, segmentURL string, headers map[string]string) {
+	select {
+	case stream.sem <- struct{}{}:
+		defer func() { <-stream.sem }()
+	case <-stream.ctx.Done():
+		return
+	}
+
+	// Peeking doesn't count as a miss, prefetches would drag down the hit ratio
+	cache := GetSegmentCache()
+	if cache.Contains(segmentURL) {
+		return
+	}
+
+	parsedURL, err := url.Parse(segmentURL)
+	if err != nil {
+		return
+	}
+	if err := CheckDestination(parsedURL); err != nil {
+		slog.Debug("Prefetch denied", "upstream", logging.RedactURL(segmentURL), logging.ErrorAttr(err))
+		return
+	}
+
+	req, err := http.NewRequestWithContext(stream.ctx, http.MethodGet, segmentURL, nil)
+	if err != nil {
+		return
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := UpstreamCoalescer.Do(req)
+	if err != nil {
+		if stream.ctx.Err() == nil {
+			slog.Debug("Prefetch failed", "upstream", logging.RedactURL(segmentURL), logging.ErrorAttr(err))
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !IsCacheableResponse(resp.Header) {
+		return
+	}
+
+	capture := NewCaptureBuffer(resp.ContentLength, cache.MaxEntryBytes())
+	if _, err := io.Copy(capture, io.LimitReader(resp.Body, cache.MaxEntryBytes()+1)); err != nil ||
+		!capture.Complete(resp.ContentLength) {
+		return
+	}
+	cache.SetEntry(segmentURL, NewCacheEntry(resp.Header, capture.Bytes(), false), p.segmentTTL)
+}
+
+// reapLoop cancels the streams of viewers that stopped requesting segments
+func (p *Prefetcher) reapLoop() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.mu.Lock()
+		if p.viewers == nil {
+			p.mu.Unlock()
+			return
+		}
+		for viewer, streams := range p.viewers {
+			for playlistURL, stream := range streams {
+				if time.Since(stream.lastSeen) > p.idleTimeout {
+					stream.cancel()
+					delete(streams, playlistURL)
+				}
+			}
+			if len(streams) == 0 {
+				delete(p.viewers, viewer)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Stop cancels all prefetches
+func (p *Prefetcher) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, streams := range p.viewers {
+		for _, stream := range streams {
+			stream.cancel()
+		}
+	}
+	p.viewers = nil
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/security"
+)
+
+// useTestUpstream points the upstream coalescer at the test servers, allows their
+// loopback addresses and ports and gives the test a fresh memory cache, restoring
+// all three afterwards
+func useTestUpstream(t *testing.T, servers ...*httptest.Server) {
+	t.Helper()
+	savedCoalescer, savedPolicy, savedCache := UpstreamCoalescer, destinationPolicy, segmentCache
+	t.Cleanup(func() {
+		UpstreamCoalescer, destinationPolicy, segmentCache = savedCoalescer, savedPolicy, savedCache
+	})
+	var ports []int
+	for _, srv := range servers {
+		port, _ := strconv.Atoi(srv.URL[strings.LastIndex(srv.URL, ":")+1:])
+		ports = append(ports, port)
+	}
+	UpstreamCoalescer = NewCoalescer(servers[0].Client(), 1<<20)
+	destinationPolicy = security.NewDestinationPolicy(security.DestinationConfig{AllowedPorts: ports, AllowPrivate: true})
+	segmentCache = NewSegmentCache(1<<20, 0, EvictLRU)
+}
+
+// requestLog records the paths a test server was asked for
+type requestLog struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (l *requestLog) add(path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.paths = append(l.paths, path)
+}
+
+func (l *requestLog) sorted() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	paths := slices.Clone(l.paths)
+	slices.Sort(paths)
+	return paths
+}
+
+// testPlaylist builds a media playlist of segments first..last on base
+func testPlaylist(base string, first, last int, endList bool) *Playlist {
+	var body strings.Builder
+	fmt.Fprintf(&body, "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	for i := first; i <= last; i++ {
+		fmt.Fprintf(&body, "#EXTINF:4,\nseg-%d.ts\n", i)
+	}
+	if endList {
+		body.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return ParsePlaylist([]byte(body.String()), base+"/media.m3u8")
+}
+
+func TestPrefetcherWarmsAhead(t *testing.T) {
+	tests := []struct {
+		name     string
+		endList  bool
+		segments []int // Served to the viewer after the playlist
+		want     []string
+	}{
+		{name: "vod starts at the beginning", endList: true, want: []string{"/seg-0.ts", "/seg-1.ts"}},
+		{name: "live starts at the end", want: []string{"/seg-4.ts", "/seg-5.ts"}},
+		{name: "segments advance the window", endList: true, segments: []int{1}, want: []string{"/seg-0.ts", "/seg-1.ts", "/seg-2.ts", "/seg-3.ts"}},
+		{name: "each segment is fetched once", endList: true, segments: []int{0, 1, 2}, want: []string{"/seg-0.ts", "/seg-1.ts", "/seg-2.ts", "/seg-3.ts", "/seg-4.ts"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log requestLog
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				log.add(r.URL.Path)
+				io.WriteString(w, "segment "+r.URL.Path)
+			}))
+			defer srv.Close()
+			useTestUpstream(t, srv)
+
+			p := NewPrefetcher(2, 2, 0, time.Minute)
+			defer p.Stop()
+			p.OnPlaylist("viewer", srv.URL+"/media.m3u8", testPlaylist(srv.URL, 0, 5, tt.endList), nil)
+			for _, n := range tt.segments {
+				p.OnSegment("viewer", fmt.Sprintf("%s/seg-%d.ts", srv.URL, n))
+			}
+
+			cache := GetSegmentCache()
+			waitFor(t, "prefetches", func() bool {
+				for _, path := range tt.want {
+					if !cache.Contains(srv.URL + path) {
+						return false
+					}
+				}
+				return true
+			})
+			if got := log.sorted(); !slices.Equal(got, tt.want) {
+				t.Errorf("fetched %v, want %v", got, tt.want)
+			}
+			if stats := cache.Stats(); stats.Misses != 0 {
+				t.Errorf("cache misses = %d, prefetch checks must not count", stats.Misses)
+			}
+		})
+	}
+}
+
+func TestPrefetcherForgetsSegmentsLeavingTheWindow(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "segment")
+	}))
+	defer srv.Close()
+	useTestUpstream(t, srv)
+
+	p := NewPrefetcher(2, 2, 0, time.Minute)
+	defer p.Stop()
+	playlistURL := srv.URL + "/media.m3u8"
+	for first := 0; first < 20; first++ {
+		p.OnPlaylist("viewer", playlistURL, testPlaylist(srv.URL, first, first+3, false), nil)
+		p.OnSegment("viewer", fmt.Sprintf("%s/seg-%d.ts", srv.URL, first+3))
+	}
+
+	// Every playlist adds one segment, wait for all of them to be in
+	waitFor(t, "prefetches", func() bool {
+		for n := 2; n < 23; n++ {
+			if !GetSegmentCache().Contains(fmt.Sprintf("%s/seg-%d.ts", srv.URL, n)) {
+				return false
+			}
+		}
+		return true
+	})
+
+	p.mu.Lock()
+	warmed := len(p.viewers["viewer"][playlistURL].warmed)
+	p.mu.Unlock()
+	if warmed > 4 {
+		t.Errorf("%d warmed segments remembered, want at most the 4 of the current window", warmed)
+	}
+}
+
+func TestPrefetchSharesViewerFetch(t *testing.T) {
+	var log requestLog
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.URL.Path)
+		<-release
+		io.WriteString(w, "segment")
+	}))
+	defer srv.Close()
+	useTestUpstream(t, srv)
+
+	// Both requests carry the headers the handler generates, each with its own random User-Agent
+	p := NewPrefetcher(1, 1, 0, time.Minute)
+	defer p.Stop()
+	p.OnPlaylist("viewer", srv.URL+"/media.m3u8", testPlaylist(srv.URL, 0, 3, true),
+		GenerateDynamicHeaders("https://example.com/", ""))
+	waitFor(t, "prefetch to start", func() bool { return len(log.sorted()) == 1 })
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/seg-0.ts", nil)
+	for key, value := range GenerateDynamicHeaders("https://example.com/", "") {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("User-Agent", "a different browser")
+	done := make(chan error, 1)
+	go func() {
+		resp, _, err := FetchMirrored(req, []string{req.URL.String()}, true)
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	waitFor(t, "viewer to join the prefetch", func() bool { return UpstreamCoalescer.Stats().Shared == 1 })
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := log.sorted(); len(got) != 1 {
+		t.Errorf("upstream fetches = %v, want a single shared one", got)
+	}
+}
@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dovakiin0/proxy-m3u8/internal/logging"
+	"github.com/dovakiin0/proxy-m3u8/internal/security"
+)
+
+// RetryPolicy retries idempotent upstream GETs that fail transiently, and resumes
+// bodies that break off mid-stream with a Range request from the bytes already read
+type RetryPolicy struct {
+	MaxAttempts int           // Attempts per request or resume, including the first; 1 disables retries
+	BaseDelay   time.Duration // Backoff before the first retry, doubled for every further one
+	MaxDelay    time.Duration // Backoff cap
+	Deadline    time.Duration // No retry starts later than this after the first failed attempt
+}
+
+var retryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// ConfigureRetries replaces the policy used for upstream fetches
+func ConfigureRetries(policy RetryPolicy) {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	retryPolicy = policy
+}
+
+// GetRetryPolicy returns the policy used for upstream fetches
+func GetRetryPolicy() RetryPolicy {
+	return retryPolicy
+}
+
+// Do fetches req through the coalescer, retrying transport errors and 502/503/504
+// responses until the response headers are in
+func (p RetryPolicy) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		resp, err := UpstreamCoalescer.Do(req)
+
+		retryable := (err != nil && isRetryableError(err)) || (err == nil && isRetryableStatus(resp.StatusCode))
+		if !retryable || !p.wait(req.Context(), start, attempt) {
+			return resp, err
+		}
+
+		if err != nil {
+			logging.FromContext(req.Context()).Info("Retrying upstream fetch", "attempt", attempt, logging.ErrorAttr(err))
+		} else {
+			logging.FromContext(req.Context()).Info("Retrying upstream fetch", "attempt", attempt, "status", resp.StatusCode)
+			resp.Body.Close()
+		}
+	}
+}
+
+// Resumable wraps the body of a 200 or 206 response so that a broken transfer
+// continues with a Range request from the current offset. The origin's ETag or
+// Last-Modified is sent as If-Range so a changed object isn't spliced in.
+func (p RetryPolicy) Resumable(req *http.Request, resp *http.Response) io.ReadCloser {
+	if p.MaxAttempts < 2 || resp.Header.Get("Content-Encoding") != "" {
+		// Byte offsets of a decoded body don't map onto the origin's ranges
+		return resp.Body
+	}
+
+	rb := &resumableBody{
+		policy: p,
+		req:    req,
+		body:   resp.Body,
+		end:    -1,
+		total:  -1,
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if resp.ContentLength > 0 {
+			rb.end = resp.ContentLength - 1
+			rb.total = resp.ContentLength
+		}
+	case http.StatusPartialContent:
+		first, last, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok {
+			return resp.Body
+		}
+		rb.offset, rb.end, rb.total = first, last, total
+	default:
+		return resp.Body
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		rb.validator = etag
+	} else {
+		rb.validator = resp.Header.Get("Last-Modified")
+	}
+	return rb
+}
+
+// wait sleeps before retry number attempt, reporting false if no retry should be made
+func (p RetryPolicy) wait(ctx context.Context, start time.Time, attempt int) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+
+	delay := p.backoff(attempt)
+	if p.Deadline > 0 && time.Since(start)+delay > p.Deadline {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// backoff returns a fully jittered exponential delay
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	ceiling := p.BaseDelay << min(attempt-1, 16)
+	if p.MaxDelay > 0 && ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// isRetryableError reports whether a fetch error may go away on its own
+func isRetryableError(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, security.ErrDestinationDenied), errors.Is(err, ErrCircuitOpen):
+		return false
+	}
+	return true
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// resumableBody reads an upstream body, reconnecting with Range requests when the transfer breaks
+type resumableBody struct {
+	policy    RetryPolicy
+	req       *http.Request
+	body      io.ReadCloser
+	offset    int64 // Absolute offset of the next byte
+	end       int64 // Absolute offset of the last byte, -1 if unknown
+	total     int64 // Size of the whole object, -1 if unknown
+	validator string
+}
+
+func (rb *resumableBody) Read(p []byte) (int, error) {
+	n, err := rb.body.Read(p)
+	rb.offset += int64(n)
+	if err == nil || err == io.EOF || !isRetryableError(err) || rb.req.Context().Err() != nil {
+		return n, err
+	}
+	if rb.end >= 0 && rb.offset > rb.end {
+		// Everything arrived, only the connection teardown failed
+		return n, io.EOF
+	}
+
+	if resumeErr := rb.resume(err); resumeErr != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// resume replaces the broken body with the rest of the object
+func (rb *resumableBody) resume(cause error) error {
+	start := time.Now()
+	for attempt := 1; rb.policy.wait(rb.req.Context(), start, attempt); attempt++ {
+		logging.FromContext(rb.req.Context()).Info("Resuming upstream body", "offset", rb.offset, logging.ErrorAttr(cause))
+
+		req := rb.req.Clone(rb.req.Context())
+		byteRange := "bytes=" + strconv.FormatInt(rb.offset, 10) + "-"
+		if rb.end >= 0 {
+			byteRange += strconv.FormatInt(rb.end, 10)
+		}
+		req.Header.Set("Range", byteRange)
+		req.Header.Del("If-Range")
+		if rb.validator != "" {
+			req.Header.Set("If-Range", rb.validator)
+		}
+		for _, name := range ConditionalHeaders {
+			req.Header.Del(name)
+		}
+
+		resp, err := UpstreamCoalescer.Do(req)
+		if err != nil {
+			if !isRetryableError(err) {
+				return err
+			}
+			cause = err
+			continue
+		}
+
+		first, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if resp.StatusCode != http.StatusPartialContent || !ok || first != rb.offset || (rb.total >= 0 && total != rb.total) {
+			// The object changed or the origin ignores ranges, the bytes already sent can't be completed
+			resp.Body.Close()
+			return errors.New("upstream can't resume at byte " + strconv.FormatInt(rb.offset, 10))
+		}
+
+		rb.body.Close()
+		rb.body = resp.Body
+		return nil
+	}
+	return cause
+}
+
+func (rb *resumableBody) Close() error {
+	return rb.body.Close()
+}
+
+// parseContentRange parses "bytes first-last/total"; total is -1 when given as "*"
+func parseContentRange(header string) (first, last, total int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	span, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	firstStr, lastStr, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+
+	var err error
+	if first, err = strconv.ParseInt(firstStr, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if last, err = strconv.ParseInt(lastStr, 10, 64); err != nil || last < first {
+		return 0, 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, 0, false
+		}
+	}
+	return first, last, total, true
+}
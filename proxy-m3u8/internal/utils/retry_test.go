@@ -0,0 +1,306 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDo(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int // Answer to each attempt, the last one repeated
+		maxAttempts  int
+		wantStatus   int
+		wantAttempts int64
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, maxAttempts: 3, wantStatus: http.StatusOK, wantAttempts: 1},
+		{name: "bad gateway retried", statuses: []int{http.StatusBadGateway, http.StatusOK}, maxAttempts: 3, wantStatus: http.StatusOK, wantAttempts: 2},
+		{name: "unavailable retried", statuses: []int{http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusOK}, maxAttempts: 3, wantStatus: http.StatusOK, wantAttempts: 3},
+		{name: "gives up after max attempts", statuses: []int{http.StatusServiceUnavailable}, maxAttempts: 3, wantStatus: http.StatusServiceUnavailable, wantAttempts: 3},
+		{name: "retries disabled", statuses: []int{http.StatusServiceUnavailable}, maxAttempts: 1, wantStatus: http.StatusServiceUnavailable, wantAttempts: 1},
+		{name: "internal server error not retried", statuses: []int{http.StatusInternalServerError, http.StatusOK}, maxAttempts: 3, wantStatus: http.StatusInternalServerError, wantAttempts: 1},
+		{name: "not found not retried", statuses: []int{http.StatusNotFound, http.StatusOK}, maxAttempts: 3, wantStatus: http.StatusNotFound, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := attempts.Add(1)
+				w.WriteHeader(tt.statuses[min(int(n), len(tt.statuses))-1])
+			}))
+			defer srv.Close()
+			useTestUpstream(t, srv)
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/seg-1.ts", nil)
+			resp, err := RetryPolicy{MaxAttempts: tt.maxAttempts}.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDoTransportErrors(t *testing.T) {
+	// A listener that accepts and immediately drops every connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var attempts atomic.Int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			attempts.Add(1)
+			conn.Close()
+		}
+	}()
+
+	saved := UpstreamCoalescer
+	defer func() { UpstreamCoalescer = saved }()
+	UpstreamCoalescer = NewCoalescer(&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}, 1<<20)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/seg-1.ts", nil)
+	if _, err := (RetryPolicy{MaxAttempts: 3}).Do(req); err == nil {
+		t.Fatal("Do succeeded against a server dropping every connection")
+	}
+	if got := attempts.Load(); got < 3 {
+		t.Errorf("connections = %d, want every attempt retried", got)
+	}
+
+	// A cancelled request isn't retried
+	attempts.Store(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, "http://"+listener.Addr().String()+"/seg-1.ts", nil)
+	if _, err := (RetryPolicy{MaxAttempts: 3}).Do(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("Do = %v, want context.Canceled", err)
+	}
+	if got := attempts.Load(); got > 1 {
+		t.Errorf("connections = %d for a cancelled request", got)
+	}
+}
+
+func TestRetryPolicyDeadline(t *testing.T) {
+	var attempts atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	useTestUpstream(t, srv)
+
+	// Any backoff long enough to matter would overrun the deadline, so no retry starts
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, Deadline: time.Millisecond}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/seg-1.ts", nil)
+	start := time.Now()
+	resp, err := policy.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, elapsed := attempts.Load(), time.Since(start); got != 1 || elapsed > time.Second {
+		t.Errorf("attempts = %d after %v, want no retry past the deadline", got, elapsed)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	for attempt, ceiling := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 300 * time.Millisecond, 10: 300 * time.Millisecond} {
+		for range 50 {
+			if delay := policy.backoff(attempt); delay < 0 || delay > ceiling {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", attempt, delay, ceiling)
+			}
+		}
+	}
+	if delay := (RetryPolicy{}).backoff(3); delay != 0 {
+		t.Errorf("backoff without a base delay = %v, want 0", delay)
+	}
+}
+
+// flakyOrigin serves body with Range support and, while breaks is positive, cuts
+// off each response after breakAfter bytes
+type flakyOrigin struct {
+	body       []byte
+	etag       string
+	breakAfter int
+	breaks     atomic.Int64
+	noRanges   bool // Answer range requests with the whole body
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (o *flakyOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.ranges = append(o.ranges, r.Header.Get("Range"))
+	o.mu.Unlock()
+
+	w.Header().Set("ETag", o.etag)
+	if ifRange := r.Header.Get("If-Range"); o.noRanges || (ifRange != "" && ifRange != o.etag) {
+		r.Header.Del("Range")
+	}
+	if o.breaks.Add(-1) < 0 {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(o.body))
+		return
+	}
+
+	// Send the headers of the full answer, then drop the connection mid-body
+	start := 0
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		first, _, _ := strings.Cut(strings.TrimPrefix(rangeHeader, "bytes="), "-")
+		start, _ = strconv.Atoi(first)
+		w.Header().Set("Content-Range", "bytes "+first+"-"+strconv.Itoa(len(o.body)-1)+"/"+strconv.Itoa(len(o.body)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.body)-start))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.body)))
+	}
+	w.Write(o.body[start:min(start+o.breakAfter, len(o.body))])
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func (o *flakyOrigin) rangeRequests() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.Clone(o.ranges[1:])
+}
+
+func TestRetryPolicyResumable(t *testing.T) {
+	body := make([]byte, 64<<10)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+
+	tests := []struct {
+		name        string
+		breaks      int64
+		maxAttempts int
+		changed     bool // The object changes after the first response
+		noRanges    bool
+		wantRanges  []string
+		wantErr     bool
+	}{
+		{name: "unbroken", maxAttempts: 3},
+		{name: "resumed once", breaks: 1, maxAttempts: 3, wantRanges: []string{"bytes=10000-65535"}},
+		{name: "resumed twice", breaks: 2, maxAttempts: 3, wantRanges: []string{"bytes=10000-65535", "bytes=20000-65535"}},
+		{name: "every break gets its own attempts", breaks: 3, maxAttempts: 2, wantRanges: []string{"bytes=10000-65535", "bytes=20000-65535", "bytes=30000-65535"}},
+		{name: "retries disabled", breaks: 1, maxAttempts: 1, wantErr: true},
+		{name: "origin ignores ranges", breaks: 1, maxAttempts: 3, noRanges: true, wantRanges: []string{"bytes=10000-65535"}, wantErr: true},
+		{name: "changed object not spliced", breaks: 1, maxAttempts: 3, changed: true, wantRanges: []string{"bytes=10000-65535"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := &flakyOrigin{body: body, etag: `"v1"`, breakAfter: 10000, noRanges: tt.noRanges}
+			origin.breaks.Store(tt.breaks)
+			srv := httptest.NewServer(origin)
+			defer srv.Close()
+			useTestUpstream(t, srv)
+			// Each resume must be its own fetch, not a join of the broken one
+			UpstreamCoalescer = NewCoalescer(srv.Client(), 0)
+
+			policy := RetryPolicy{MaxAttempts: tt.maxAttempts}
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/seg-1.ts", nil)
+			resp, err := policy.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.changed {
+				origin.etag = `"v2"`
+			}
+			reader := policy.Resumable(req, resp)
+			data, err := io.ReadAll(reader)
+			reader.Close()
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("read error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(data, body) {
+				t.Errorf("read %d bytes that don't match the %d byte body", len(data), len(body))
+			}
+			if tt.wantErr && !bytes.Equal(data, body[:len(data)]) {
+				t.Error("bytes read before the failure don't match the body")
+			}
+			if got := origin.rangeRequests(); strings.Join(got, ",") != strings.Join(tt.wantRanges, ",") {
+				t.Errorf("resume requests = %q, want %q", got, tt.wantRanges)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyResumableSkipsUnresumableBodies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		resp   *http.Response
+	}{
+		{name: "retries disabled", policy: RetryPolicy{MaxAttempts: 1}, resp: &http.Response{StatusCode: http.StatusOK}},
+		{name: "encoded body", policy: RetryPolicy{MaxAttempts: 3}, resp: &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Encoding": {"gzip"}}}},
+		{name: "not found", policy: RetryPolicy{MaxAttempts: 3}, resp: &http.Response{StatusCode: http.StatusNotFound}},
+		{name: "bad content range", policy: RetryPolicy{MaxAttempts: 3}, resp: &http.Response{StatusCode: http.StatusPartialContent, Header: http.Header{"Content-Range": {"bytes */100"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.resp.Header == nil {
+				tt.resp.Header = http.Header{}
+			}
+			tt.resp.Body = io.NopCloser(strings.NewReader("body"))
+			req, _ := http.NewRequest(http.MethodGet, "https://cdn.example.com/seg-1.ts", nil)
+			if got := tt.policy.Resumable(req, tt.resp); got != tt.resp.Body {
+				t.Error("body wrapped although it can't be resumed")
+			}
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header             string
+		first, last, total int64
+		ok                 bool
+	}{
+		{header: "bytes 0-99/100", first: 0, last: 99, total: 100, ok: true},
+		{header: "bytes 100-199/*", first: 100, last: 199, total: -1, ok: true},
+		{header: "bytes */100"},
+		{header: "bytes 10-5/100"},
+		{header: "items 0-9/10"},
+		{header: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			first, last, total, ok := parseContentRange(tt.header)
+			if ok != tt.ok || (ok && (first != tt.first || last != tt.last || total != tt.total)) {
+				t.Errorf("parseContentRange(%q) = %d, %d, %d, %v, want %d, %d, %d, %v",
+					tt.header, first, last, total, ok, tt.first, tt.last, tt.total, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// diskWriteQueueSize bounds the writes waiting for the disk tier; further writes are
+// dropped and counted in the disk tier's stats
+const diskWriteQueueSize = 64
+
+// TieredCache puts a memory cache in front of a disk cache. Entries are written to
+// both tiers (the disk write happens in the background and only for long-lived
+// entries); disk hits are promoted to memory once they have been read often enough.
+type TieredCache struct {
+	memory      *SegmentCache
+	disk        *DiskCache
+	promoteHits int64
+	minDiskTTL  time.Duration
+	writes      chan diskWrite
+
+	droppedWrites atomic.Int64
+}
+
+type diskWrite struct {
+	key   string
+	entry *CacheEntry
+	ttl   time.Duration
+}
+
+// NewTieredCache creates a two-tier cache. Entries with a TTL below minDiskTTL,
+// e.g. live playlists, stay in memory only.
+func NewTieredCache(memory *SegmentCache, disk *DiskCache, promoteHits int64, minDiskTTL time.Duration) *TieredCache {
+	if promoteHits < 1 {
+		promoteHits = 1
+	}
+	tc := &TieredCache{
+		memory:      memory,
+		disk:        disk,
+		promoteHits: promoteHits,
+		minDiskTTL:  minDiskTTL,
+		writes:      make(chan diskWrite, diskWriteQueueSize),
+	}
+	go tc.writeLoop()
+	return tc
+}
+
+func (tc *TieredCache) writeLoop() {
+	for w := range tc.writes {
+		tc.disk.SetEntry(w.key, w.entry, w.ttl)
+	}
+}
+
+// Enabled reports whether either tier stores anything
+func (tc *TieredCache) Enabled() bool {
+	return tc.memory.Enabled() || tc.disk.Enabled()
+}
+
+// MaxEntryBytes returns the size of the largest object one of the tiers accepts
+func (tc *TieredCache) MaxEntryBytes() int64 {
+	return max(tc.memory.MaxEntryBytes(), tc.disk.MaxEntryBytes())
+}
+
+// GetEntry looks in memory first, then on disk
+func (tc *TieredCache) GetEntry(key string) (*CacheEntry, bool) {
+	if entry, ok := tc.memory.GetEntry(key); ok {
+		return entry, true
+	}
+
+	entry, ok := tc.disk.GetEntry(key)
+	if !ok {
+		return nil, false
+	}
+
+	if tc.disk.hitCount(key) >= tc.promoteHits {
+		if ttl := time.Until(entry.ExpiresAt); ttl > 0 {
+			promoted := *entry
+			tc.memory.SetEntry(key, &promoted, ttl)
+		}
+	}
+	return entry, true
+}
+
+// Contains reports whether either tier holds the key
+func (tc *TieredCache) Contains(key string) bool {
+	return tc.memory.Contains(key) || tc.disk.Contains(key)
+}
+
+// SetEntry stores an entry in memory and queues it for the disk tier
+func (tc *TieredCache) SetEntry(key string, entry *CacheEntry, ttl time.Duration) {
+	tc.memory.SetEntry(key, entry, ttl)
+
+	if ttl < tc.minDiskTTL || int64(len(entry.Data)) > tc.disk.MaxEntryBytes() {
+		return
+	}
+	select {
+	case tc.writes <- diskWrite{key: key, entry: entry, ttl: ttl}:
+	default:
+		tc.droppedWrites.Add(1)
+	}
+}
+
+// Delete removes a key from both tiers
+func (tc *TieredCache) Delete(key string) {
+	tc.memory.Delete(key)
+	tc.disk.Delete(key)
+}
+
+// Cleanup removes expired entries from both tiers
+func (tc *TieredCache) Cleanup() {
+	tc.memory.Cleanup()
+	tc.disk.Cleanup()
+}
+
+// Stats returns the memory tier counters with the disk tier nested
+func (tc *TieredCache) Stats() CacheStats {
+	stats := tc.memory.Stats()
+	diskStats := tc.disk.Stats()
+	diskStats.DroppedWrites = tc.droppedWrites.Load()
+	stats.Disk = &diskStats
+	return stats
+}
+
+// Health reports the disk tier's health, the memory tier can't fail
+func (tc *TieredCache) Health() error {
+	return tc.disk.Health()
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestTieredCache(t *testing.T, promoteHits int64) *TieredCache {
+	t.Helper()
+	disk, err := OpenDiskCache(t.TempDir(), 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTieredCache(NewSegmentCache(1<<20, 0, EvictLRU), disk, promoteHits, time.Minute)
+}
+
+func TestTieredCachePromotion(t *testing.T) {
+	tests := []struct {
+		name        string
+		promoteHits int64
+		wantInDisk  int // Disk hits served before the entry is back in memory
+	}{
+		{name: "first disk hit promotes", promoteHits: 1, wantInDisk: 1},
+		{name: "promoted after two disk hits", promoteHits: 2, wantInDisk: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := newTestTieredCache(t, tt.promoteHits)
+			const key = "https://cdn.example.com/seg-1.ts"
+			tc.SetEntry(key, testEntry("segment"), time.Hour)
+			waitFor(t, "disk write", func() bool { return tc.disk.Contains(key) })
+
+			// Evicted from memory, the entry is still on disk
+			tc.memory.Delete(key)
+			for i := 1; i <= tt.wantInDisk; i++ {
+				entry, ok := tc.GetEntry(key)
+				if !ok || string(entry.Data) != "segment" {
+					t.Fatalf("disk hit %d = %+v, %v", i, entry, ok)
+				}
+				if promoted := tc.memory.Contains(key); promoted != (i == tt.wantInDisk) {
+					t.Errorf("in memory after disk hit %d = %v", i, promoted)
+				}
+			}
+
+			// Later reads are served from memory
+			tc.GetEntry(key)
+			if hits := tc.disk.Stats().Hits; hits != int64(tt.wantInDisk) {
+				t.Errorf("disk hits = %d, want %d", hits, tt.wantInDisk)
+			}
+			if stats := tc.Stats(); stats.Hits != 1 || stats.Disk == nil {
+				t.Errorf("Stats = %+v, want one memory hit and the disk tier nested", stats)
+			}
+		})
+	}
+}
+
+func TestTieredCacheShortTTLStaysInMemory(t *testing.T) {
+	tc := newTestTieredCache(t, 1)
+	tc.SetEntry("live.m3u8", testEntry("#EXTM3U"), 2*time.Second)
+	tc.SetEntry("seg-1.ts", testEntry("segment"), time.Hour)
+	waitFor(t, "disk write", func() bool { return tc.disk.Contains("seg-1.ts") })
+
+	if tc.disk.Contains("live.m3u8") {
+		t.Error("entry with a TTL below the disk minimum was written to disk")
+	}
+	if !tc.Contains("live.m3u8") {
+		t.Error("short-lived entry missing from memory")
+	}
+
+	tc.Delete("seg-1.ts")
+	if tc.Contains("seg-1.ts") || tc.disk.Contains("seg-1.ts") {
+		t.Error("Delete left the entry in a tier")
+	}
+}